@@ -0,0 +1,561 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	tmpKnownHostPathPrefix = "git-mirror-me-known_hosts-"
+	knownHostsPerm         = 0o600
+	// Git hosting services accept any user name with a token so this is used
+	// when no user name is configured.
+	defaultHTTPUsername = "git"
+	// The user used for SSH authentication when none is configured.
+	defaultSSHUser = "git"
+)
+
+var (
+	ErrNoAgentKeys  = errors.New("SSH agent has no identities")
+	ErrNoTunnelAuth = errors.New("SSH authentication through a jump host " +
+		"or an SSH proxy requires an SSH private key, an identity file or " +
+		"the SSH agent to be configured")
+)
+
+// isHTTPRepo reports whether a repository is accessed over HTTP(S).
+func isHTTPRepo(repo string) bool {
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return false
+	}
+
+	return endpoint.Protocol == "http" || endpoint.Protocol == "https"
+}
+
+// newHTTPAuth sets up the HTTP authentication method of a repository based on
+// an HTTP configuration. The configured token or GitHub App takes precedence
+// over the git credential helper which takes precedence over the netrc file.
+// A nil authentication method is returned when no credentials are found or
+// when the repository URL provides them.
+func newHTTPAuth(ctx context.Context, conf Config, logger *Logger, httpConf HTTPConf, repo string) (transport.AuthMethod, error) {
+	if httpConf.GitHubApp.isSet() {
+		auth, err := newGitHubAppAuth(ctx, conf, logger, httpConf.GitHubApp)
+		if err != nil {
+			return nil, err
+		}
+
+		return auth, nil
+	}
+
+	if httpConf.hasToken() {
+		token, err := httpConf.getToken()
+		if err != nil {
+			return nil, err
+		}
+
+		username := httpConf.Username
+		if len(username) == 0 {
+			username = defaultHTTPUsername
+		}
+
+		return &http.BasicAuth{
+			Username: username,
+			Password: token,
+		}, nil
+	}
+
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+
+	if len(endpoint.Password) != 0 {
+		return nil, nil
+	}
+
+	username := httpConf.Username
+	if len(username) == 0 {
+		username = endpoint.User
+	}
+
+	if len(httpConf.CredentialHelper) != 0 {
+		auth, err := newCredentialAuth(httpConf.CredentialHelper, repo, username)
+		if err != nil {
+			return nil, err
+		}
+
+		if auth != nil {
+			return auth, nil
+		}
+	}
+
+	entries, err := loadNetrc(conf.NetrcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, found := lookupNetrc(entries, endpoint.Host, username)
+	if !found || len(entry.password) == 0 {
+		return nil, nil
+	}
+
+	if len(entry.login) != 0 {
+		username = entry.login
+	} else if len(username) == 0 {
+		username = defaultHTTPUsername
+	}
+
+	return &http.BasicAuth{
+		Username: username,
+		Password: entry.password,
+	}, nil
+}
+
+// checkSSHKeyPassphrase checks that an encrypted SSH private key can be
+// decrypted with the passphrase. Other private key errors are not reported
+// here but when setting up the SSH authentication.
+func checkSSHKeyPassphrase(key, passphrase string) error {
+	var missingErr *gossh.PassphraseMissingError
+
+	_, err := gossh.ParsePrivateKey([]byte(key))
+	if !errors.As(err, &missingErr) {
+		return nil
+	}
+
+	if len(passphrase) == 0 {
+		return ErrNoPassphrase
+	}
+
+	_, err = gossh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+
+	switch {
+	case errors.Is(err, x509.IncorrectPasswordError):
+		return ErrWrongPassphrase
+	case err != nil:
+		return fmt.Errorf("failed to decrypt the SSH private key: %w", err)
+	}
+
+	return nil
+}
+
+// newAgentAuth sets up the SSH authentication method using the identities of
+// the SSH agent listening on a socket. The returned function closes the
+// connection to the SSH agent.
+func newAgentAuth(socket, user string) (*ssh.PublicKeysCallback, func(), error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the SSH agent: %w", err)
+	}
+
+	agentClient := agent.NewClient(conn)
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		conn.Close()
+
+		return nil, nil, fmt.Errorf("failed to get the SSH agent identities: %w",
+			err)
+	}
+
+	if len(signers) == 0 {
+		conn.Close()
+
+		return nil, nil, ErrNoAgentKeys
+	}
+
+	return &ssh.PublicKeysCallback{
+		User:     user,
+		Callback: agentClient.Signers,
+	}, func() { conn.Close() }, nil
+}
+
+// newIdentityFilesAuth sets up the SSH authentication method using the
+// identity files of the SSH client configuration file. As in OpenSSH, the
+// identity files which don't exist are skipped. The encrypted identity files
+// are decrypted with the passphrase of the SSH configuration. A nil
+// authentication method is returned when no identity file exists.
+func newIdentityFilesAuth(sshConf SSHConf, identityFiles []string, user string) (*ssh.PublicKeysCallback, error) {
+	passphrase, err := sshConf.getPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []gossh.Signer
+
+	for _, identityFile := range identityFiles {
+		key, err := os.ReadFile(identityFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the identity file: %w", err)
+		}
+
+		if err := checkSSHKeyPassphrase(string(key), passphrase); err != nil {
+			return nil, fmt.Errorf("identity file %s: %w", identityFile, err)
+		}
+
+		signer, err := gossh.ParsePrivateKey(key)
+		if len(passphrase) != 0 && err != nil {
+			signer, err = gossh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup the identity file %s: %w",
+				identityFile, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, nil
+	}
+
+	return &ssh.PublicKeysCallback{
+		User: user,
+		Callback: func() ([]gossh.Signer, error) {
+			return signers, nil
+		},
+	}, nil
+}
+
+// existingFiles returns the files which exist out of a list of files.
+func existingFiles(files []string) []string {
+	var existing []string
+
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	return existing
+}
+
+// newSSHAuth sets up the SSH authentication method used with a repository
+// based on an SSH configuration and the SSH client configuration file. The
+// returned URL is the one used to access the repository: it points to the
+// host name and the port resolved with the SSH client configuration file, the
+// connections being tunnelled by the authentication method when a jump host
+// or an SSH proxy is used. A nil authentication method is returned when no
+// authentication is configured. The returned cleanup function releases the
+// temporary resources used by the authentication method and needs to be
+// called once the authentication method is not needed anymore. On error, the
+// resources are released before returning.
+//
+// The SSH agent and the SSH private key of the SSH configuration take
+// precedence over the identity files of the SSH client configuration file.
+// Similarly, the known hosts of the SSH configuration take precedence over the
+// known hosts files of the SSH client configuration file.
+func newSSHAuth(conf Config, sshConf SSHConf, repo string) (repoURL string, auth transport.AuthMethod, cleanup func(), err error) {
+	cleanup = func() {}
+
+	defer func() {
+		if err != nil {
+			cleanup()
+			cleanup = func() {}
+		}
+	}()
+
+	resolved, err := resolveSSHRepo(conf, sshConf, repo)
+	if err != nil {
+		return "", nil, cleanup, err
+	}
+
+	// Set up the public host key.
+	//
+	// The host public keys can be provided via both content and path. When
+	// it is provided via content, we need to use a temporary known_hosts
+	// file.
+	knownHostsPaths := existingFiles(resolved.knownHostsFiles)
+	if len(sshConf.KnownHostsPath) != 0 {
+		knownHostsPaths = []string{sshConf.KnownHostsPath}
+	}
+
+	if len(sshConf.KnownHosts) != 0 {
+		knownHostsPath, removeKnownHosts, err := writeKnownHosts(sshConf.KnownHosts)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		cleanup = removeKnownHosts
+		knownHostsPaths = []string{knownHostsPath}
+	}
+
+	// Set up SSH authentication.
+	var baseAuth ssh.AuthMethod
+
+	switch {
+	case sshConf.Agent:
+		agentAuth, closeAgent, err := newAgentAuth(sshConf.AgentSocket,
+			resolved.user)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		removeKnownHosts := cleanup
+		cleanup = func() {
+			closeAgent()
+			removeKnownHosts()
+		}
+
+		baseAuth = agentAuth
+	case sshConf.hasPrivateKey():
+		privateKey, err := sshConf.getPrivateKey()
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		passphrase, err := sshConf.getPassphrase()
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		sshKeys, err := ssh.NewPublicKeys(resolved.user, []byte(privateKey),
+			passphrase)
+		if err != nil {
+			return "", nil, cleanup, fmt.Errorf("failed to setup the SSH key: %w",
+				err)
+		}
+
+		baseAuth = sshKeys
+	default:
+		identityAuth, err := newIdentityFilesAuth(sshConf,
+			resolved.identityFiles, resolved.user)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		if identityAuth != nil {
+			baseAuth = identityAuth
+		}
+	}
+
+	var dialer proxy.Dialer
+
+	if resolved.endpoint.Protocol == "ssh" {
+		dialer, err = newSSHProxyDialer(conf.Proxy)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+	}
+
+	// Connections through a jump host or a proxy are tunnelled by the
+	// authentication method.
+	tunnel := len(resolved.jumpAddr) != 0 || dialer != nil
+
+	// Tunnelling needs an authentication method. Rather than implicitly
+	// using the SSH agent, it needs to be configured.
+	if baseAuth == nil && tunnel {
+		return "", nil, cleanup, fmt.Errorf("%w: %s", ErrNoTunnelAuth,
+			RedactURL(repo))
+	}
+
+	if baseAuth == nil {
+		return resolved.url(resolved.hostName, resolved.port), nil, cleanup, nil
+	}
+
+	// Without known hosts, go-git uses the default known hosts files.
+	if len(knownHostsPaths) != 0 {
+		hostKeyCallback, err := ssh.NewKnownHostsCallback(knownHostsPaths...)
+		if err != nil {
+			return "", nil, cleanup, fmt.Errorf("failed to set up host keys: %w",
+				err)
+		}
+
+		setHostKeyCallback(baseAuth, hostKeyCallback)
+	}
+
+	sshAuth := withSSHOptions(baseAuth, resolved.opts)
+	repoURL = resolved.url(resolved.hostName, resolved.port)
+
+	if !tunnel {
+		return repoURL, sshAuth, cleanup, nil
+	}
+
+	// Without an SSH proxy, the jump host is reached directly.
+	if dialer == nil {
+		dialer = proxy.Direct
+	}
+
+	// Connect to the repository through the jump host and/or the proxy. The
+	// host public key is checked against the repository address as the
+	// repository URL is left as it is.
+	tunnelAuth := &sshTunnelAuth{
+		AuthMethod: sshAuth,
+		dialer:     dialer,
+	}
+
+	if len(resolved.jumpAddr) != 0 {
+		jumpConfig, err := newJumpConfig(sshConf, resolved, baseAuth,
+			knownHostsPaths)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+
+		tunnelAuth.jumpAddr = resolved.jumpAddr
+		tunnelAuth.jumpConfig = jumpConfig
+	}
+
+	return repoURL, tunnelAuth, cleanup, nil
+}
+
+// writeKnownHosts writes host public keys to a temporary known_hosts file. The
+// returned function removes the file.
+func writeKnownHosts(knownHosts string) (string, func(), error) {
+	knownHostsFile, err := ioutil.TempFile("/tmp", tmpKnownHostPathPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating known_hosts tmp file: %w",
+			err)
+	}
+
+	remove := func() {
+		knownHostsFile.Close()
+		os.Remove(knownHostsFile.Name())
+	}
+
+	err = os.WriteFile(knownHostsFile.Name(), []byte(knownHosts), knownHostsPerm)
+	if err != nil {
+		remove()
+
+		return "", nil, fmt.Errorf("error writing known_hosts tmp file: %w", err)
+	}
+
+	return knownHostsFile.Name(), remove, nil
+}
+
+// newJumpConfig sets up the SSH client configuration used with the jump host
+// of a repository. The private key and the host public keys of the bastion,
+// when configured, take precedence over the authentication method and the
+// known_hosts files used with the repository. The bastion known hosts content
+// is only needed while setting up the configuration as the known_hosts files
+// are read at once.
+func newJumpConfig(sshConf SSHConf, resolved *sshRepo, auth ssh.AuthMethod, knownHostsPaths []string) (*gossh.ClientConfig, error) {
+	bastion := sshConf.Bastion
+
+	if len(bastion.KnownHostsPath) != 0 {
+		knownHostsPaths = []string{bastion.KnownHostsPath}
+	}
+
+	if len(bastion.KnownHosts) != 0 {
+		knownHostsPath, removeKnownHosts, err := writeKnownHosts(bastion.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		defer removeKnownHosts()
+
+		knownHostsPaths = []string{knownHostsPath}
+	}
+
+	// Without known hosts, the go-git default known hosts files are used.
+	var hostKeyCallback gossh.HostKeyCallback
+
+	if len(knownHostsPaths) != 0 {
+		var err error
+
+		hostKeyCallback, err = ssh.NewKnownHostsCallback(knownHostsPaths...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the jump host keys: %w", err)
+		}
+	}
+
+	if bastion.hasPrivateKey() {
+		privateKey, err := bastion.getPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		passphrase, err := bastion.getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		bastionKeys, err := ssh.NewPublicKeys(resolved.jumpUser,
+			[]byte(privateKey), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup the SSH bastion key: %w", err)
+		}
+
+		bastionKeys.HostKeyCallback = hostKeyCallback
+		auth = bastionKeys
+	}
+
+	config, err := withSSHOptions(auth, resolved.opts).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the jump host: %w", err)
+	}
+
+	config.User = resolved.jumpUser
+
+	if hostKeyCallback != nil {
+		config.HostKeyCallback = hostKeyCallback
+	}
+
+	return config, nil
+}
+
+// setHostKeyCallback sets the host key callback of the SSH authentication
+// methods set up by newSSHAuth.
+func setHostKeyCallback(auth ssh.AuthMethod, hostKeyCallback gossh.HostKeyCallback) {
+	helper := ssh.HostKeyCallbackHelper{HostKeyCallback: hostKeyCallback}
+
+	switch auth := auth.(type) {
+	case *ssh.PublicKeys:
+		auth.HostKeyCallbackHelper = helper
+	case *ssh.PublicKeysCallback:
+		auth.HostKeyCallbackHelper = helper
+	}
+}
+
+// newRepoAuth sets up the authentication method used with a repository. The
+// HTTP configuration is used for repositories accessed over HTTP(S) and the
+// SSH configuration otherwise. See newSSHAuth for the returned values.
+func newRepoAuth(ctx context.Context, conf Config, logger *Logger, repo string, sshConf SSHConf, httpConf HTTPConf) (string, transport.AuthMethod, func(), error) {
+	if isHTTPRepo(repo) {
+		auth, err := newHTTPAuth(ctx, conf, logger, httpConf, repo)
+		if auth != nil {
+			logger.Debug(conf.Debug, "Using HTTP authentication for",
+				RedactURL(repo), ".")
+		}
+
+		return repo, auth, func() {}, err
+	}
+
+	repoURL, auth, cleanup, err := newSSHAuth(conf, sshConf, repo)
+	if auth != nil {
+		logger.Debug(conf.Debug, "Using SSH authentication for",
+			RedactURL(repo), ".")
+	}
+
+	return repoURL, auth, cleanup, err
+}
+
+// newAuth sets up the authentication method used with a destination
+// repository based on configuration. See newRepoAuth for details.
+func newAuth(ctx context.Context, conf Config, logger *Logger, dstRepo string) (string, transport.AuthMethod, func(), error) {
+	return newRepoAuth(ctx, conf, logger, dstRepo, conf.SSH, conf.HTTP)
+}
+
+// newSrcAuth sets up the authentication method used with the source
+// repository based on configuration. See newRepoAuth for details.
+func newSrcAuth(ctx context.Context, conf Config, logger *Logger) (string, transport.AuthMethod, func(), error) {
+	return newRepoAuth(ctx, conf, logger, conf.SrcRepo, conf.SrcSSH, conf.SrcHTTP)
+}
@@ -0,0 +1,228 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+const (
+	cacheDirPerm  = 0o755
+	cacheLockPerm = 0o644
+	// cacheLockPoll is how often the lock of a cached staging repository
+	// held by another run is tried again.
+	cacheLockPoll = 100 * time.Millisecond
+)
+
+// lockCache serialises the runs using the same cached staging repository,
+// within the process and across the processes sharing the cache directory.
+// The lock is an exclusive flock(2) of a lock file next to the cached staging
+// repository so it is released by the kernel if the process dies. Waiting for
+// the lock stops when the context is done. It returns the function releasing
+// the lock.
+func lockCache(ctx context.Context, path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), cacheDirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create the cache directory: %w", err)
+	}
+
+	lockPath := path + ".lock"
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, cacheLockPerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the staging cache lock %s: %w",
+			lockPath, err)
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			file.Close()
+
+			return nil, fmt.Errorf("failed to lock the staging cache %s: %w",
+				path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+
+			return nil, fmt.Errorf("failed to lock the staging cache %s: %w",
+				path, ctx.Err())
+		case <-time.After(cacheLockPoll):
+		}
+	}
+
+	return func() {
+		// Closing the lock file releases the lock.
+		file.Close()
+	}, nil
+}
+
+// cachePath returns the path of the cached staging repository of the source
+// repository. Each source repository has its own cached staging repository
+// named after the hash of the source repository URL.
+func cachePath(conf Config) string {
+	return filepath.Join(conf.CacheDir, mask(conf.SrcRepo))
+}
+
+// openCacheRepo opens the cached staging repository of the source repository.
+// A bare repository is initialised when it doesn't exist yet.
+func openCacheRepo(conf Config) (*git.Repository, error) {
+	path := cachePath(conf)
+
+	// Creating the directory upfront also avoids git.PlainOpen panicking
+	// on paths it can't stat.
+	if err := os.MkdirAll(path, cacheDirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create the staging cache %s: %w",
+			path, err)
+	}
+
+	repo, err := git.PlainOpen(path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(path, true)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the staging cache %s: %w",
+			path, err)
+	}
+
+	return repo, nil
+}
+
+// pruneCacheRefs removes the references of a cached staging repository that
+// are no longer available in the source. The srcRefs are the references the
+// source advertised to the fetch so that they match the fetched ones.
+func pruneCacheRefs(repo *git.Repository, srcRefs []*plumbing.Reference) error {
+	srcRefNames := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range srcRefs {
+		srcRefNames[ref.Name()] = true
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return fmt.Errorf("failed to get references: %w", err)
+	}
+
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if isFilterable(ref.Name()) && !srcRefNames[ref.Name()] {
+			if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+				return fmt.Errorf("failed to remove reference: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// advertisedKey is the context key holding the recorder of the references
+// advertised by the remotes.
+type advertisedKey struct{}
+
+// refsRecorder records the references advertised by a remote to the last
+// session of a remote operation.
+type refsRecorder struct {
+	mu       sync.Mutex
+	refs     []*plumbing.Reference
+	recorded bool
+}
+
+// withAdvertisedRefs returns a context recording the references advertised
+// to the remote operations.
+func withAdvertisedRefs(ctx context.Context, recorder *refsRecorder) context.Context {
+	return context.WithValue(ctx, advertisedKey{}, recorder)
+}
+
+// contextAdvertisedRefs returns the advertised references recorder of a
+// context or nil when they are not recorded.
+func contextAdvertisedRefs(ctx context.Context) *refsRecorder {
+	recorder, _ := ctx.Value(advertisedKey{}).(*refsRecorder)
+
+	return recorder
+}
+
+// record records the advertised references, replacing the ones of a previous
+// session (for example, of a failed attempt).
+func (r *refsRecorder) record(ar *packp.AdvRefs) {
+	refs := advertisedRefs(ar)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refs, r.recorded = refs, true
+}
+
+// get returns the recorded references and whether any were recorded.
+func (r *refsRecorder) get() ([]*plumbing.Reference, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.refs, r.recorded
+}
+
+// filteredStorer is a view of the storage of a cached staging repository
+// hiding the references that don't pass the reference filter. The cached
+// staging repository keeps all the references of the source so that the
+// filters can change between the runs without losing them.
+type filteredStorer struct {
+	storage.Storer
+	filter refFilter
+}
+
+// hidden reports whether a reference is hidden by the reference filter.
+func (s filteredStorer) hidden(name plumbing.ReferenceName) bool {
+	return isFilterable(name) && !s.filter.match(name.String())
+}
+
+func (s filteredStorer) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if s.hidden(name) {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+
+	return s.Storer.Reference(name)
+}
+
+func (s filteredStorer) IterReferences() (storer.ReferenceIter, error) {
+	refs, err := s.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	return storer.NewReferenceFilteredIter(func(ref *plumbing.Reference) bool {
+		return !s.hidden(ref.Name())
+	}, refs), nil
+}
+
+// filterCacheRepo returns a view of a cached staging repository with only
+// the references passing the reference filter.
+func filterCacheRepo(repo *git.Repository, filter refFilter) (*git.Repository, error) {
+	if len(filter) == 0 {
+		return repo, nil
+	}
+
+	filtered, err := git.Open(filteredStorer{repo.Storer, filter}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to filter the staging cache: %w", err)
+	}
+
+	return filtered, nil
+}
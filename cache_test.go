@@ -0,0 +1,370 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// TestLockCache tests serialising the use of the cached staging repositories.
+func TestLockCache(t *testing.T) {
+	t.Parallel()
+
+	cacheDir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-cache-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary cache dir: %s", err)
+	}
+
+	defer os.RemoveAll(cacheDir)
+
+	pathA := filepath.Join(cacheDir, "a")
+
+	unlock, err := lockCache(context.Background(), pathA)
+	if err != nil {
+		t.Fatalf("failed to lock the cache: %s", err)
+	}
+
+	// The lock is a file next to the cached staging repository so that it
+	// is shared with the other processes.
+	if _, err := os.Stat(pathA + ".lock"); err != nil {
+		t.Fatalf("cache lock file was not created: %s", err)
+	}
+
+	// Different caches are not serialised.
+	unlockB, err := lockCache(context.Background(),
+		filepath.Join(cacheDir, "b"))
+	if err != nil {
+		t.Fatalf("failed to lock another cache: %s", err)
+	}
+
+	unlockB()
+
+	// Waiting for the lock stops with the context.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	if _, err := lockCache(ctx, pathA); !errors.Is(err,
+		context.DeadlineExceeded) {
+		t.Fatalf("the same cache was locked twice: %v", err)
+	}
+
+	locked := make(chan struct{})
+
+	go func() {
+		defer close(locked)
+
+		if unlock, err := lockCache(context.Background(), pathA); err == nil {
+			unlock()
+		}
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("the same cache was locked twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+
+	// Fail on an invalid cache directory.
+	if _, err := lockCache(context.Background(),
+		"/dev/null/invalid/a"); err == nil {
+		t.Fatal("invalid cache directory was allowed")
+	}
+}
+
+// TestCachePath tests the path of the cached staging repositories.
+func TestCachePath(t *testing.T) {
+	t.Parallel()
+
+	path := cachePath(Config{SrcRepo: "foo", CacheDir: "/cache"})
+	if path != "/cache/2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+		t.Fatalf("unexpected cache path: %s", path)
+	}
+
+	if path == cachePath(Config{SrcRepo: "bar", CacheDir: "/cache"}) {
+		t.Fatal("different sources share the same cache path")
+	}
+}
+
+// TestOpenCacheRepo tests initialising and opening a cached staging
+// repository.
+func TestOpenCacheRepo(t *testing.T) {
+	t.Parallel()
+
+	cacheDir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-cache-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary cache dir: %s", err)
+	}
+
+	defer os.RemoveAll(cacheDir)
+
+	conf := Config{SrcRepo: "src", CacheDir: cacheDir}
+
+	repo, err := openCacheRepo(conf)
+	if err != nil {
+		t.Fatalf("failed to initialise the cached staging repo: %s", err)
+	}
+
+	hash := plumbing.NewHash("1111111111111111111111111111111111111111")
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/a",
+		hash))
+	if err != nil {
+		t.Fatalf("failed to set reference: %s", err)
+	}
+
+	// The cached staging repository is bare.
+	if _, err := os.Stat(filepath.Join(cachePath(conf), "HEAD")); err != nil {
+		t.Fatalf("cached staging repo is not bare: %s", err)
+	}
+
+	repo, err = openCacheRepo(conf)
+	if err != nil {
+		t.Fatalf("failed to open the cached staging repo: %s", err)
+	}
+
+	ref, err := repo.Reference("refs/heads/a", false)
+	if err != nil || ref.Hash() != hash {
+		t.Fatalf("cached staging repo was not reused: %s", err)
+	}
+
+	// Fail on an invalid cache directory.
+	if _, err := openCacheRepo(Config{
+		SrcRepo:  "src",
+		CacheDir: "/dev/null/invalid",
+	}); err == nil {
+		t.Fatal("invalid cache directory was allowed")
+	}
+}
+
+// TestPruneCacheRefs tests removing the references deleted in the source from
+// a cached staging repository.
+func TestPruneCacheRefs(t *testing.T) {
+	t.Parallel()
+
+	path, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary repo: %s", err)
+	}
+
+	defer os.RemoveAll(path)
+
+	repo, head, err := utils.NewTestRepo(path, []string{
+		"refs/heads/a",
+		"refs/heads/b",
+		"refs/tags/v1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test repo: %s", err)
+	}
+
+	err = pruneCacheRefs(repo, []*plumbing.Reference{
+		plumbing.NewHashReference("HEAD", head),
+		plumbing.NewHashReference("refs/heads/master", head),
+		plumbing.NewHashReference("refs/heads/a", head),
+	})
+	if err != nil {
+		t.Fatalf("failed to prune the refs: %s", err)
+	}
+
+	repoRefs, err := utils.RepoRefsSlice(repo)
+	if err != nil {
+		t.Fatalf("failed to get the repo refs: %s", err)
+	}
+
+	if !utils.SlicesAreEqual(repoRefs, []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}) {
+		t.Fatalf("unexpected refs after pruning: %s", repoRefs)
+	}
+}
+
+// TestDoMirrorCache tests mirroring multiple times using a cached staging
+// repository.
+func TestDoMirrorCache(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	// Create a source repository.
+	srcRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-src-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary src repo: %s", err)
+	}
+
+	defer os.RemoveAll(srcRepoPath)
+
+	srcRepo, srcHead, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+		"refs/heads/b",
+		"refs/pull/1/head",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	// Create two destination repositories.
+	var dstRepos []*git.Repository
+
+	conf := Config{
+		SrcRepo: srcRepoPath,
+	}
+
+	for i := 0; i < 2; i++ {
+		dstRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-dst-")
+		if err != nil {
+			t.Fatalf("failed to create a temporary dst repo: %s", err)
+		}
+
+		defer os.RemoveAll(dstRepoPath)
+
+		dstRepo, _, err := utils.NewTestRepo(dstRepoPath, []string{
+			"refs/heads/c",
+		})
+		if err != nil {
+			t.Fatalf("failed to create a test dst repo: %s", err)
+		}
+
+		dstRepos = append(dstRepos, dstRepo)
+		conf.DstRepos = append(conf.DstRepos, dstRepoPath)
+	}
+
+	// Create a cache directory.
+	conf.CacheDir, err = ioutil.TempDir("/tmp", "git-mirror-me-test-cache-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary cache dir: %s", err)
+	}
+
+	defer os.RemoveAll(conf.CacheDir)
+
+	checkRefs := func(expected []string, hashes map[string]plumbing.Hash) {
+		t.Helper()
+
+		for _, dstRepo := range dstRepos {
+			dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+			if err != nil {
+				t.Fatalf("failed to get the dst repo refs: %s", err)
+			}
+
+			if !utils.SlicesAreEqual(dstRepoRefs, expected) {
+				t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+			}
+
+			for name, hash := range hashes {
+				ref, err := dstRepo.Reference(plumbing.ReferenceName(name), false)
+				if err != nil || ref.Hash() != hash {
+					t.Fatalf("unexpected %s ref in the dst repo", name)
+				}
+			}
+		}
+	}
+
+	// The first run populates the cache.
+	if err := DoMirror(conf, logger); err != nil {
+		t.Fatalf("DoMirror failed: %s", err)
+	}
+
+	checkRefs([]string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+		"refs/heads/b",
+	}, map[string]plumbing.Hash{"refs/heads/a": srcHead})
+
+	// Update, delete and force-update references in the source.
+	child := commitOnTop(t, srcRepo, srcHead)
+
+	err = srcRepo.Storer.SetReference(plumbing.NewHashReference(
+		"refs/heads/a", child))
+	if err != nil {
+		t.Fatalf("failed to set reference: %s", err)
+	}
+
+	if err := srcRepo.Storer.RemoveReference("refs/heads/b"); err != nil {
+		t.Fatalf("failed to remove reference: %s", err)
+	}
+
+	// The second run fetches incrementally and prunes the deleted reference.
+	if err := DoMirror(conf, logger); err != nil {
+		t.Fatalf("DoMirror failed: %s", err)
+	}
+
+	checkRefs([]string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}, map[string]plumbing.Hash{"refs/heads/a": child})
+
+	// Force-update a reference back in the source.
+	err = srcRepo.Storer.SetReference(plumbing.NewHashReference(
+		"refs/heads/a", srcHead))
+	if err != nil {
+		t.Fatalf("failed to set reference: %s", err)
+	}
+
+	if err := DoMirror(conf, logger); err != nil {
+		t.Fatalf("DoMirror failed: %s", err)
+	}
+
+	checkRefs([]string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}, map[string]plumbing.Hash{"refs/heads/a": srcHead})
+
+	// The cache follows the source. The filtered out references are kept so
+	// that the filters can change between the runs.
+	cacheRepo, err := git.PlainOpen(cachePath(conf))
+	if err != nil {
+		t.Fatalf("failed to open the cached staging repo: %s", err)
+	}
+
+	cacheRepoRefs, err := utils.RepoRefsSlice(cacheRepo)
+	if err != nil {
+		t.Fatalf("failed to get the cached staging repo refs: %s", err)
+	}
+
+	if !utils.SlicesAreEqual(cacheRepoRefs, []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+		"refs/pull/1/head",
+	}) {
+		t.Fatalf("unexpected refs in the cached staging repo: %s",
+			cacheRepoRefs)
+	}
+
+	// The filtered out references are mirrored once the filters allow them.
+	conf.RefFilters = []string{"refs/*"}
+
+	if err := DoMirror(conf, logger); err != nil {
+		t.Fatalf("DoMirror failed: %s", err)
+	}
+
+	checkRefs([]string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+		"refs/pull/1/head",
+	}, map[string]plumbing.Hash{"refs/pull/1/head": srcHead})
+}
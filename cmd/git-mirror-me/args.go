@@ -9,19 +9,103 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"path"
+	"strings"
 
 	mirror "github.com/agherzan/git-mirror-me"
 )
 
-var ErrVersion = errors.New("mirror: version requested")
+// The SSH private key path reading the SSH private key from the standard
+// input.
+const stdinPath = "-"
 
-// parseArgs returns a configuration structure initialised from parsing the
-// 'arguments' string slice argument.
-func parseArgs(progName string, arguments []string) (*mirror.Config, string, error) {
-	var srcRepo, dstRepo, knownHostsPath string
+var (
+	ErrVersion  = errors.New("mirror: version requested")
+	ErrStdinKey = errors.New("only one SSH private key can be read from " +
+		"the standard input")
+	ErrJobsFlag = errors.New("invalid jobs file flags")
+)
+
+// The flags supported in conjunction with '-config' and whether they
+// require it. The rest of the configuration is provided by the jobs file.
+var jobsFlags = map[string]bool{
+	"config":              true,
+	"job":                 true,
+	"serve":               true,
+	"workers":             true,
+	"shutdown-timeout":    true,
+	"listen":              true,
+	"webhook-secret-path": true,
+	"webhook-debounce":    true,
+	"report":              false,
+	"report-file":         false,
+	"dry-run":             false,
+	"debug":               false,
+}
+
+// The flags only supported in daemon mode.
+var serveFlags = map[string]bool{
+	"workers":             true,
+	"shutdown-timeout":    true,
+	"listen":              true,
+	"webhook-secret-path": true,
+	"webhook-debounce":    true,
+}
+
+// runConf holds the configuration of a run not covered by the mirroring
+// configuration.
+type runConf struct {
+	// Report is the configuration of the machine-readable report.
+	Report reportConf
+	// JobsPath is the path of the jobs file. The mirroring configuration is
+	// provided by the CLI arguments and environment variables when empty.
+	JobsPath string
+	// Jobs are the names of the jobs to run. All the jobs of the jobs file
+	// run when empty.
+	Jobs []string
+	// Serve runs the jobs on their schedules in daemon mode.
+	Serve bool
+	// Daemon is the configuration of the daemon mode.
+	Daemon mirror.DaemonConf
+}
+
+// listFlag is a flag.Value that collects the values of a flag that can be
+// provided multiple times.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+
+	return nil
+}
+
+// parseArgs returns a configuration structure and a run configuration
+// initialised from parsing the 'arguments' string slice argument.
+func parseArgs(progName string, arguments []string) (*mirror.Config, runConf, string, error) {
+	var srcRepo, cacheDir, privateKeyPath, knownHostsPath string
+
+	var srcPrivateKeyPath, srcKnownHostsPath, sshConfigPath string
+
+	var credentialHelper, srcCredentialHelper, netrcPath string
+
+	var bastion, srcBastion mirror.BastionConf
+
+	var githubApp, srcGitHubApp mirror.GitHubAppConf
 
-	var debug, version bool
+	var tlsConf mirror.TLSConf
+
+	var retryConf mirror.RetryConf
+
+	var rc runConf
+
+	var dstRepos, refFilters, refMappings, sshOptions, srcSSHOptions, jobs listFlag
+
+	var sshAgent, srcSSHAgent, dryRun, debug, version bool
 
 	var flagsOutput bytes.Buffer
 
@@ -39,6 +123,13 @@ CLI arguments/flags
 		fmt.Fprintf(output,
 			`
 Environment variables
+  The secret-bearing environment variables have a '_FILE' variant providing
+  the path to a file holding the secret instead (for example, Docker or
+  Kubernetes secrets): 'GMM_SSH_PRIVATE_KEY_FILE', 'GMM_SSH_KNOWN_HOSTS_FILE',
+  'GMM_SSH_BASTION_PRIVATE_KEY_FILE', 'GMM_SSH_BASTION_KNOWN_HOSTS_FILE',
+  'GMM_HTTP_TOKEN_FILE', 'GMM_GITHUB_APP_PRIVATE_KEY_FILE' and their 'GMM_SRC_'
+  equivalents. Providing a secret via both variants is an error.
+
   GMM_SRC_REPO
   GITHUB_SERVER_URL
   GITHUB_REPOSITORY
@@ -48,32 +139,410 @@ Environment variables
       * the 'GMM_SRC_REPO' environment variable
       * using the 'GITHUB_SERVER_URL' and 'GITHUB_REPOSITORY' environment
         variables as 'GITHUB_SERVER_URL/GITHUB_REPOSITORY'
+  GMM_USE_GITHUB_TOKEN
+  GITHUB_TOKEN
+    Set 'GMM_USE_GITHUB_TOKEN' to '1' to fetch the source repository with the
+    GitHub Actions token ('GITHUB_TOKEN') when the source is derived from
+    'GITHUB_SERVER_URL' and 'GITHUB_REPOSITORY'. The token is never used with
+    the destination repositories nor with another source repository. The
+    configured source HTTP authentication takes precedence.
   GMM_DST_REPO
     Same as '-destination-repository' but overridden by the CLI argument.
+    Multiple destination repositories can be provided as a comma or
+    whitespace separated list.
+  GMM_REF_FILTERS
+    Same as '-ref-filter' but overridden by the CLI argument. Multiple rules
+    can be provided as a comma or whitespace separated list.
+  GMM_REF_MAPPINGS
+    Same as '-ref-mapping' but overridden by the CLI argument. Multiple rules
+    can be provided as a comma or whitespace separated list.
+  GMM_CACHE_DIR
+    Same as '-cache-dir' but overridden by the CLI argument.
   GMM_SSH_PRIVATE_KEY
     The SSH private key used for SSH authentication during git operations. When
     defined, a host public key configuration is required. See
     'GMM_SSH_KNOWN_HOSTS' and '-ssh-known-hosts-path'.
+  GMM_SSH_PRIVATE_KEY_PASSPHRASE
+    The passphrase of an encrypted SSH private key. A missing or wrong
+    passphrase is reported before any git operation.
+  GMM_SSH_PRIVATE_KEY_PASSPHRASE_FILE
+    The path to a file providing the passphrase of an encrypted SSH private
+    key. The trailing newline characters are ignored. This can't be used in
+    conjunction with 'GMM_SSH_PRIVATE_KEY_PASSPHRASE'.
   GMM_SSH_KNOWN_HOSTS
     The host public keys used for host validation. The format needs to be based
     on the 'known_hosts' file. See
     http://man.openbsd.org/sshd#SSH_KNOWN_HOSTS_FILE_FORMAT
     for more information.
     This can't be used in conjunction with '-ssh-known-hosts-path'.
+  GMM_SSH_OPTIONS
+    Same as '-ssh-option' but overridden by the CLI argument. Multiple
+    options can be provided as a whitespace separated list.
+  GMM_SSH_AGENT
+    Set this to '1' to authenticate with the identities of the SSH agent. See
+    '-ssh-agent'.
+  SSH_AUTH_SOCK
+    The socket of the SSH agent used with '-ssh-agent' and
+    '-source-ssh-agent'.
+  GMM_SSH_CONFIG
+    Same as '-ssh-config' but overridden by the CLI argument.
+  GMM_SSH_BASTION_HOST
+  GMM_SSH_BASTION_USER
+  GMM_SSH_BASTION_PRIVATE_KEY
+  GMM_SSH_BASTION_KNOWN_HOSTS
+    The bastion (jump host) the SSH connections to the destination
+    repositories are tunnelled through. See '-ssh-bastion-host'. The private
+    key and the host public keys of the bastion default to the ones used with
+    the destination repositories.
+  GMM_SSH_BASTION_PASSPHRASE
+  GMM_SSH_BASTION_PASSPHRASE_FILE
+    Same as 'GMM_SSH_PRIVATE_KEY_PASSPHRASE' and
+    'GMM_SSH_PRIVATE_KEY_PASSPHRASE_FILE' but used to decrypt the bastion
+    private key. The passphrase of the destination repositories is never
+    used with the bastion private key.
+  GMM_HTTP_USERNAME
+  GMM_HTTP_TOKEN
+    The user name and token (for example, a personal access token or a deploy
+    token) used for HTTP authentication when pushing to the destination
+    repositories accessed over HTTP(S). The user name defaults to 'git' as
+    most git hosting services accept any user name with a token. The
+    authentication is picked based on the URL scheme of each destination:
+    HTTP for 'http://' and 'https://' destinations and SSH otherwise.
+    Configuring only the authentication not matching the URL scheme of a
+    destination is an error.
+  GMM_GITHUB_APP_ID
+  GMM_GITHUB_APP_INSTALLATION_ID
+  GMM_GITHUB_APP_PRIVATE_KEY
+  GMM_GITHUB_APP_API_URL
+    The GitHub App whose installation tokens are used for HTTP authentication
+    with the destination repositories instead of a token. See
+    '-github-app-id'. The private key is the PEM private key of the app.
+  GITHUB_API_URL
+    The GitHub API URL used with the GitHub Apps when no API URL is
+    configured. It is set by GitHub Actions. Defaults to
+    'https://api.github.com'.
+  GMM_CREDENTIAL_HELPER
+  GMM_SRC_CREDENTIAL_HELPER
+  GMM_NETRC
+    Same as '-credential-helper', '-source-credential-helper' and '-netrc'
+    but overridden by the CLI arguments.
+  GMM_SRC_SSH_PRIVATE_KEY
+  GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE
+  GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE_FILE
+  GMM_SRC_SSH_KNOWN_HOSTS
+  GMM_SRC_SSH_AGENT
+  GMM_SRC_SSH_OPTIONS
+  GMM_SRC_SSH_BASTION_HOST
+  GMM_SRC_SSH_BASTION_USER
+  GMM_SRC_SSH_BASTION_PRIVATE_KEY
+  GMM_SRC_SSH_BASTION_PASSPHRASE
+  GMM_SRC_SSH_BASTION_PASSPHRASE_FILE
+  GMM_SRC_SSH_BASTION_KNOWN_HOSTS
+    Same as the 'GMM_SSH_' environment variables above but used for
+    fetching from the source repository when it is not accessed over
+    HTTP(S). See '-source-ssh-known-hosts-path'.
+  GMM_SRC_HTTP_USERNAME
+  GMM_SRC_HTTP_TOKEN
+    The user name and token used for HTTP authentication when fetching from
+    a source repository accessed over HTTP(S). The user name defaults to
+    'git' as most git hosting services accept any user name with a token.
+  GMM_SRC_GITHUB_APP_ID
+  GMM_SRC_GITHUB_APP_INSTALLATION_ID
+  GMM_SRC_GITHUB_APP_PRIVATE_KEY
+  GMM_SRC_GITHUB_APP_API_URL
+    Same as the 'GMM_GITHUB_APP_' environment variables above but used for
+    fetching from a source repository accessed over HTTP(S).
+  HTTPS_PROXY
+  HTTP_PROXY
+  NO_PROXY
+    The proxies used to reach the repositories accessed over HTTPS and HTTP
+    and the comma separated hosts, domains and networks reached directly. The
+    lower case variables are used when the upper case ones are not set.
+  GMM_SSH_PROXY
+    The SOCKS5 proxy ('socks5://' or 'socks5h://' URL) used to reach the
+    repositories accessed over SSH and their bastions. It defaults to
+    'ALL_PROXY' (or 'all_proxy') when that is a SOCKS5 proxy. The hosts
+    matching 'NO_PROXY' are reached directly.
+  GMM_CA_BUNDLE
+  GMM_TLS_CLIENT_CERT
+  GMM_TLS_CLIENT_KEY
+    Same as '-ca-bundle', '-tls-client-cert' and '-tls-client-key' but
+    overridden by the CLI arguments.
+  GMM_INSECURE_SKIP_TLS_VERIFY
+    Set this to '1' to skip the TLS verification. See
+    '-insecure-skip-tls-verify'.
+  GMM_WEBHOOK_SECRET
+  GMM_WEBHOOK_SECRET_FILE
+    The secret verifying the webhooks in daemon mode or the path to a file
+    providing it. See '-listen'.
+  GMM_DRY_RUN
+    Set this to '1' to run the tool in dry-run mode.
   GMM_DEBUG
     Set this to '1' to run the tool in debug mode.
+
+Jobs file
+  The jobs file provided with '-config' is a YAML document with the
+  'defaults' shared by the jobs and the 'jobs' list. Each job has a unique
+  'name' and the same keys as the defaults, overriding them: 'source',
+  'destinations', 'ref-filters', 'ref-mappings', 'cache-dir', 'ssh',
+  'source-ssh', 'http', 'source-http', 'ssh-config', 'netrc', 'proxy', 'tls',
+  'retry', 'dry-run' and 'debug'. The secrets can only be provided as paths
+  to files (for example, 'ssh.private-key-path' or 'http.token-path'). The
+  environment variables above provide the values not set by a job.
+  In daemon mode, the 'schedule' of a job provides either an 'interval' (for
+  example, '15m'), the job running when the daemon starts and then every
+  interval, or a 'cron' expression (five fields evaluated in the local time
+  zone or a macro like '@hourly'), and a random delay up to 'jitter' added
+  to each run. The schedule of a job replaces the default one.
+
+Report
+  With '-report=json' or '-report-file', a JSON document describing the run
+  is written at the end of the run, including on failure. It provides the
+  source and the destinations (with their credentials redacted), the status
+  ('success', 'failure' or 'not-in-sync'), the pre-existing references and
+  the reference updates of each destination ('created', 'updated', 'forced',
+  'deleted', 'unchanged' or 'rejected'), the pruned references, the phase
+  durations in seconds and, on failure, the error with its class ('config',
+  'fetch', 'destination' or 'not-in-sync' for the run and 'auth', 'list',
+  'push' or 'prune' for the destinations). With '-config', the report
+  provides the overall status and this document for each job that ran,
+  along with its name.
+
+Exit status
+  0 on success. In dry-run mode, 0 also means that all the destinations are
+  in sync with the source.
+  1 on failure. With '-config', when at least one job failed.
+  2 in dry-run mode, when at least one destination is not in sync with the
+  source. With '-config', when no job failed otherwise.
 `)
 	}
 	flags.StringVar(&srcRepo, "source-repository", "",
 		"The source repository for the mirroring operation.\nCan also be "+
 			"set via environment variables.")
-	flags.StringVar(&dstRepo, "destination-repository", "",
-		"The destination repository for the mirroring operation.\nCan also "+
-			"be set via environment variables.")
+	flags.Var(&dstRepos, "destination-repository",
+		"The destination repository for the mirroring operation.\nCan be "+
+			"provided multiple times to mirror to multiple destinations.\n"+
+			"Can also be set via environment variables.")
+	flags.Var(&refFilters, "ref-filter",
+		"A reference filter rule. Rules are glob patterns ('*' matches any\n"+
+			"sequence of characters and '?' matches any single character)\n"+
+			"including the matching references. Rules prefixed with '!'\n"+
+			"exclude the matching references instead. Can be provided\n"+
+			"multiple times and the rules are evaluated in order, the last\n"+
+			"matching rule deciding. When at least one include rule is\n"+
+			"provided, references not matching any rule are excluded.\n"+
+			"Defaults to '!refs/pull/*'. Can also be set via environment\n"+
+			"variables.")
+	flags.Var(&refMappings, "ref-mapping",
+		"A reference mapping rule in the '<src>:<dst>' format (for\n"+
+			"example 'refs/heads/*:refs/heads/upstream/*'). Source references\n"+
+			"matching '<src>' are mirrored as '<dst>' with the '*' wildcard,\n"+
+			"if any, replaced. Can be provided multiple times. When set, only\n"+
+			"the mapped references are mirrored and only the destination\n"+
+			"references inside the mapped namespaces are pruned. Defaults to\n"+
+			"'refs/*:refs/*'. Can also be set via environment variables.")
+	flags.StringVar(&cacheDir, "cache-dir", "",
+		"A directory keeping an on-disk staging repository for each source\n"+
+			"repository. The source is fetched incrementally into it on\n"+
+			"subsequent runs instead of fetching it entirely in memory. Can\n"+
+			"also be set via environment variables.")
+	flags.StringVar(&privateKeyPath, "ssh-private-key-path", "",
+		"Defines the path to the SSH private key. Use '-' to read the\n"+
+			"SSH private key from the standard input. This is an alternative\n"+
+			"to providing the SSH private key via the 'GMM_SSH_PRIVATE_KEY'\n"+
+			"environment variable.")
 	flags.StringVar(&knownHostsPath, "ssh-known-hosts-path", "",
 		"Defines the path to the 'known_hosts' file.\nThis is an alternative to "+
 			"providing the host public keys via the\n'GMM_SSH_KNOWN_HOSTS' "+
 			"environment variable.")
+	flags.Var(&sshOptions, "ssh-option",
+		"An SSH client option in the 'Key=Value' format, named after its\n"+
+			"OpenSSH equivalent: 'User', 'Port', 'HostKeyAlgorithms',\n"+
+			"'KexAlgorithms', 'Ciphers' (comma separated lists) and\n"+
+			"'ConnectTimeout' (in seconds). Can be provided multiple times.\n"+
+			"Can also be set via environment variables.")
+	flags.BoolVar(&sshAgent, "ssh-agent", false,
+		"Authenticate with the identities of the SSH agent (see\n"+
+			"'SSH_AUTH_SOCK') instead of an SSH private key. Host public\n"+
+			"keys are still required. Can also be enabled by setting the\n"+
+			"environment variable 'GMM_SSH_AGENT' to '1'.")
+	flags.StringVar(&sshConfigPath, "ssh-config", "",
+		"The path to the OpenSSH client configuration file used when\n"+
+			"resolving the repositories accessed over SSH. Its 'HostName',\n"+
+			"'User', 'Port', 'IdentityFile', 'UserKnownHostsFile' and\n"+
+			"'ProxyJump' keywords are honoured. Defaults to '~/.ssh/config'\n"+
+			"when it exists. Use 'none' to ignore it. Can also be set via\n"+
+			"environment variables.")
+	flags.StringVar(&bastion.Host, "ssh-bastion-host", "",
+		"The bastion (jump host) in the 'host[:port]' format the SSH\n"+
+			"connections to the destination repositories are tunnelled\n"+
+			"through. It takes precedence over the 'ProxyJump' of the SSH\n"+
+			"client configuration file. The host public keys of both the\n"+
+			"bastion and the destinations are validated. Can also be set via\n"+
+			"environment variables.")
+	flags.StringVar(&bastion.User, "ssh-bastion-user", "",
+		"The user used with the bastion. Defaults to the one used with the\n"+
+			"repository. Can also be set via environment variables.")
+	flags.StringVar(&bastion.PrivateKeyPath, "ssh-bastion-private-key-path", "",
+		"Defines the path to the SSH private key used with the bastion.\n"+
+			"Defaults to the authentication used with the repository.")
+	flags.StringVar(&bastion.KnownHostsPath, "ssh-bastion-known-hosts-path", "",
+		"Defines the path to the 'known_hosts' file used with the bastion.\n"+
+			"Defaults to the host public keys used with the repository.")
+	flags.StringVar(&rc.JobsPath, "config", "",
+		"The path to a YAML jobs file describing multiple mirroring jobs\n"+
+			"and their shared defaults. All the jobs run, one after the\n"+
+			"other, unless '-job' is provided. Only '-job', '-serve',\n"+
+			"'-workers', '-shutdown-timeout', '-listen',\n"+
+			"'-webhook-secret-path', '-webhook-debounce', '-report',\n"+
+			"'-report-file', '-dry-run' and '-debug' can be used in\n"+
+			"conjunction with it. See the 'Jobs file' section below.")
+	flags.Var(&jobs, "job",
+		"The name of a job of the jobs file to run. Can be provided\n"+
+			"multiple times to run multiple jobs. Requires '-config'.")
+	flags.BoolVar(&rc.Serve, "serve", false,
+		"Run in daemon mode: keep running and run each job on its\n"+
+			"schedule (see the 'Jobs file' section below) and on the push\n"+
+			"webhooks (see '-listen') until SIGTERM or SIGINT. The runs of a\n"+
+			"job never overlap. Requires '-config' and can't be used with\n"+
+			"'-report'.")
+	flags.IntVar(&rc.Daemon.Workers, "workers", mirror.DefaultWorkers,
+		"The maximum number of jobs running at the same time in daemon\n"+
+			"mode.")
+	flags.DurationVar(&rc.Daemon.ShutdownTimeout, "shutdown-timeout",
+		mirror.DefaultShutdownTimeout,
+		"How long the in-flight jobs are given to finish on shutdown in\n"+
+			"daemon mode before they are cancelled.")
+	flags.StringVar(&rc.Daemon.Listen, "listen", "",
+		"The 'host:port' address of the HTTP server receiving the GitHub,\n"+
+			"GitLab and Gitea push webhooks on '/webhook' and serving the\n"+
+			"Prometheus metrics of the jobs on '/metrics' in daemon mode. A\n"+
+			"push queues a run of the jobs whose source is the pushed\n"+
+			"repository. The webhooks are disabled without a webhook secret\n"+
+			"(see '-webhook-secret-path').")
+	flags.StringVar(&rc.Daemon.WebhookSecretPath, "webhook-secret-path", "",
+		"Defines the path to the secret verifying the webhooks: the\n"+
+			"HMAC-SHA256 signature secret for GitHub and Gitea and the secret\n"+
+			"token for GitLab. This is an alternative to providing the secret\n"+
+			"via the 'GMM_WEBHOOK_SECRET' environment variable.")
+	flags.DurationVar(&rc.Daemon.WebhookDebounce, "webhook-debounce",
+		mirror.DefaultWebhookDebounce,
+		"How long the pushes to a repository are collected into a single\n"+
+			"run of its jobs in daemon mode.")
+	flags.StringVar(&rc.Report.Format, "report", "",
+		"Write a machine-readable report of the run. The only supported\n"+
+			"format is 'json'. The report is written to the standard output\n"+
+			"unless '-report-file' is provided.")
+	flags.StringVar(&rc.Report.File, "report-file", "",
+		"Write the report to this file instead of the standard output.\n"+
+			"Implies '-report=json' when no report format is provided.")
+	flags.StringVar(&srcPrivateKeyPath, "source-ssh-private-key-path", "",
+		"Same as '-ssh-private-key-path' but used when fetching from the\n"+
+			"source repository.")
+	flags.StringVar(&srcKnownHostsPath, "source-ssh-known-hosts-path", "",
+		"Defines the path to the 'known_hosts' file used with the source\n"+
+			"repository. This is an alternative to providing the host public\n"+
+			"keys via the 'GMM_SRC_SSH_KNOWN_HOSTS' environment variable.")
+	flags.Var(&srcSSHOptions, "source-ssh-option",
+		"Same as '-ssh-option' but used when fetching from the source\n"+
+			"repository.")
+	flags.BoolVar(&srcSSHAgent, "source-ssh-agent", false,
+		"Same as '-ssh-agent' but used when fetching from the source\n"+
+			"repository. Can also be enabled by setting the environment\n"+
+			"variable 'GMM_SRC_SSH_AGENT' to '1'.")
+	flags.StringVar(&srcBastion.Host, "source-ssh-bastion-host", "",
+		"Same as '-ssh-bastion-host' but used when fetching from the\n"+
+			"source repository.")
+	flags.StringVar(&srcBastion.User, "source-ssh-bastion-user", "",
+		"Same as '-ssh-bastion-user' but used when fetching from the\n"+
+			"source repository.")
+	flags.StringVar(&srcBastion.PrivateKeyPath,
+		"source-ssh-bastion-private-key-path", "",
+		"Same as '-ssh-bastion-private-key-path' but used when fetching\n"+
+			"from the source repository.")
+	flags.StringVar(&srcBastion.KnownHostsPath,
+		"source-ssh-bastion-known-hosts-path", "",
+		"Same as '-ssh-bastion-known-hosts-path' but used when fetching\n"+
+			"from the source repository.")
+	flags.StringVar(&credentialHelper, "credential-helper", "",
+		"The git credential helper providing the credentials of the\n"+
+			"destination repositories accessed over HTTP(S) when neither a\n"+
+			"token nor a GitHub App is configured. Like for git, it is a\n"+
+			"helper name (run as 'git-credential-<name>'), an absolute path\n"+
+			"or a shell snippet prefixed with '!'. The credentials are\n"+
+			"approved or rejected based on the outcome of the mirroring.")
+	flags.StringVar(&srcCredentialHelper, "source-credential-helper", "",
+		"Same as '-credential-helper' but used when fetching from the\n"+
+			"source repository.")
+	flags.StringVar(&githubApp.AppID, "github-app-id", "",
+		"The ID of the GitHub App whose installation tokens are used for\n"+
+			"HTTP authentication with the destination repositories. Requires\n"+
+			"'-github-app-installation-id' and the private key of the app.\n"+
+			"The tokens are refreshed before they expire. Can also be set via\n"+
+			"environment variables.")
+	flags.StringVar(&githubApp.InstallationID, "github-app-installation-id", "",
+		"The ID of the GitHub App installation with access to the\n"+
+			"destination repositories.")
+	flags.StringVar(&githubApp.PrivateKeyPath, "github-app-private-key-path", "",
+		"Defines the path to the PEM private key of the GitHub App.")
+	flags.StringVar(&githubApp.APIURL, "github-api-url", "",
+		"The GitHub API URL the installation tokens are requested from.\n"+
+			"Defaults to 'GITHUB_API_URL' or 'https://api.github.com'. Set\n"+
+			"this for GitHub Enterprise Server (for example,\n"+
+			"'https://github.example.com/api/v3').")
+	flags.StringVar(&srcGitHubApp.AppID, "source-github-app-id", "",
+		"Same as '-github-app-id' but used when fetching from the source\n"+
+			"repository.")
+	flags.StringVar(&srcGitHubApp.InstallationID,
+		"source-github-app-installation-id", "",
+		"Same as '-github-app-installation-id' but used when fetching\n"+
+			"from the source repository.")
+	flags.StringVar(&srcGitHubApp.PrivateKeyPath,
+		"source-github-app-private-key-path", "",
+		"Same as '-github-app-private-key-path' but used when fetching\n"+
+			"from the source repository.")
+	flags.StringVar(&srcGitHubApp.APIURL, "source-github-api-url", "",
+		"Same as '-github-api-url' but used when fetching from the source\n"+
+			"repository.")
+	flags.StringVar(&netrcPath, "netrc", "",
+		"The path to the netrc file providing the credentials of the\n"+
+			"repositories accessed over HTTP(S) when no token, GitHub App or\n"+
+			"credential helper provides them. Defaults to '~/.netrc' when it\n"+
+			"exists. Use 'none' to ignore it.")
+	flags.StringVar(&tlsConf.CABundlePath, "ca-bundle", "",
+		"The path to a PEM file with the CA certificates trusted, in\n"+
+			"addition to the system ones, for the source and the destination\n"+
+			"repositories accessed over HTTPS (for example, an internal CA).")
+	flags.StringVar(&tlsConf.ClientCertPath, "tls-client-cert", "",
+		"The path to the PEM TLS client certificate used for mutual TLS\n"+
+			"with the source and the destination repositories accessed over\n"+
+			"HTTPS. Requires '-tls-client-key'.")
+	flags.StringVar(&tlsConf.ClientKeyPath, "tls-client-key", "",
+		"The path to the PEM private key of the TLS client certificate.")
+	flags.BoolVar(&tlsConf.InsecureSkipVerify, "insecure-skip-tls-verify", false,
+		"Skip the verification of the TLS certificates of the repositories\n"+
+			"accessed over HTTPS. This is INSECURE and only meant for testing.\n"+
+			"Can also be enabled by setting the environment variable\n"+
+			"'GMM_INSECURE_SKIP_TLS_VERIFY' to '1'.")
+	flags.IntVar(&retryConf.Attempts, "retry-attempts", 0,
+		"The maximum number of attempts of the remote operations\n"+
+			"(setting up the authentication, fetching the source and\n"+
+			"listing, pushing to and pruning the destinations) failing with\n"+
+			"a transient network error or timeout. The other errors (for\n"+
+			"example, authentication failures or refused connections) are\n"+
+			"not retried. No retry happens by default.")
+	flags.DurationVar(&retryConf.Backoff, "retry-backoff", 0,
+		"The delay before the first retry, doubled with each retry.\n"+
+			"Defaults to 1s.")
+	flags.DurationVar(&retryConf.MaxBackoff, "retry-max-backoff", 0,
+		"The maximum delay between retries. Defaults to 1m.")
+	flags.DurationVar(&retryConf.Jitter, "retry-jitter", 0,
+		"The maximum random delay added to each retry delay.")
+	flags.BoolVar(&dryRun, "dry-run", false, "Run this tool in dry-run mode. "+
+		"The source is fetched and the\ndestinations are listed to print the "+
+		"changes mirroring would make\nbut nothing is written to the "+
+		"destinations. Can also be enabled by\nsetting the environment "+
+		"variable 'GMM_DRY_RUN' to '1'.")
 	flags.BoolVar(&debug, "debug", false, "Run this tool in debug mode. Can "+
 		"also be enabled by setting the environment variable 'GMM_DEBUG' to "+
 		"'1'.")
@@ -81,19 +550,110 @@ Environment variables
 		"tool.")
 
 	if err := flags.Parse(arguments); err != nil {
-		return nil, flagsOutput.String(), err
+		return nil, rc, flagsOutput.String(), err
 	}
 
 	if version {
-		return nil, "", ErrVersion
+		return nil, rc, "", ErrVersion
+	}
+
+	rc.Jobs = jobs
+
+	if err := rc.validateFlags(flags); err != nil {
+		return nil, rc, "", err
 	}
 
 	return &mirror.Config{
-		SrcRepo: srcRepo,
-		DstRepo: dstRepo,
+		SrcRepo:     srcRepo,
+		DstRepos:    dstRepos,
+		RefFilters:  refFilters,
+		RefMappings: refMappings,
+		CacheDir:    cacheDir,
 		SSH: mirror.SSHConf{
+			PrivateKeyPath: privateKeyPath,
+			Agent:          sshAgent,
 			KnownHostsPath: knownHostsPath,
+			Options:        sshOptions,
+			Bastion:        bastion,
 		},
-		Debug: debug,
-	}, flagsOutput.String(), nil
+		HTTP: mirror.HTTPConf{
+			GitHubApp:        githubApp,
+			CredentialHelper: credentialHelper,
+		},
+		SrcSSH: mirror.SSHConf{
+			PrivateKeyPath: srcPrivateKeyPath,
+			Agent:          srcSSHAgent,
+			KnownHostsPath: srcKnownHostsPath,
+			Options:        srcSSHOptions,
+			Bastion:        srcBastion,
+		},
+		SrcHTTP: mirror.HTTPConf{
+			GitHubApp:        srcGitHubApp,
+			CredentialHelper: srcCredentialHelper,
+		},
+		SSHConfigPath: sshConfigPath,
+		NetrcPath:     netrcPath,
+		TLS:           tlsConf,
+		Retry:         retryConf,
+		DryRun:        dryRun,
+		Debug:         debug,
+	}, rc, flagsOutput.String(), nil
+}
+
+// validateFlags checks that only the flags supported in conjunction with a
+// jobs file are provided with one, that the jobs file flags are only provided
+// with a jobs file and that the daemon mode flags are only provided in daemon
+// mode.
+func (rc runConf) validateFlags(flags *flag.FlagSet) error {
+	var err error
+
+	flags.Visit(func(f *flag.Flag) {
+		requiresJobs, supported := jobsFlags[f.Name]
+
+		switch {
+		case err != nil:
+		case len(rc.JobsPath) == 0 && requiresJobs:
+			err = fmt.Errorf("%w: -%s requires -config", ErrJobsFlag, f.Name)
+		case len(rc.JobsPath) != 0 && !supported:
+			err = fmt.Errorf("%w: -%s can't be used with -config",
+				ErrJobsFlag, f.Name)
+		case !rc.Serve && serveFlags[f.Name]:
+			err = fmt.Errorf("%w: -%s requires -serve", ErrJobsFlag, f.Name)
+		case rc.Serve && (f.Name == "report" || f.Name == "report-file"):
+			err = fmt.Errorf("%w: -%s can't be used with -serve", ErrJobsFlag,
+				f.Name)
+		}
+	})
+
+	return err
+}
+
+// readStdinKey reads the SSH private key from the standard input when its
+// path is '-'. Only one SSH private key can be read from the standard input.
+func readStdinKey(conf *mirror.Config, stdin io.Reader) error {
+	if conf.SSH.PrivateKeyPath == stdinPath &&
+		conf.SrcSSH.PrivateKeyPath == stdinPath {
+		return ErrStdinKey
+	}
+
+	for _, sshConf := range []*mirror.SSHConf{&conf.SSH, &conf.SrcSSH} {
+		if sshConf.PrivateKeyPath != stdinPath {
+			continue
+		}
+
+		if len(sshConf.PrivateKey) != 0 {
+			return mirror.ErrPrivateKey
+		}
+
+		privateKey, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read the SSH private key from the "+
+				"standard input: %w", err)
+		}
+
+		sshConf.PrivateKey = string(privateKey)
+		sshConf.PrivateKeyPath = ""
+	}
+
+	return nil
 }
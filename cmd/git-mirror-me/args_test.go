@@ -6,7 +6,9 @@ package main
 
 import (
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	mirror "github.com/agherzan/git-mirror-me"
 	"github.com/google/go-cmp/cmp"
@@ -17,7 +19,7 @@ func TestParseArgs(t *testing.T) {
 	t.Parallel()
 	{
 		// Test passing -source-repository.
-		config, _, err := parseArgs("test", []string{"-source-repository=src"})
+		config, _, _, err := parseArgs("test", []string{"-source-repository=src"})
 		if err != nil {
 			t.Fatalf("setting src failed: %s", err)
 		}
@@ -27,18 +29,85 @@ func TestParseArgs(t *testing.T) {
 	}
 	{
 		// Test passing -destination-repository.
-		config, _, err := parseArgs("test",
+		config, _, _, err := parseArgs("test",
 			[]string{"-destination-repository=dst"})
 		if err != nil {
 			t.Fatalf("setting dst failed: %s", err)
 		}
-		if !cmp.Equal(*config, mirror.Config{DstRepo: "dst"}) {
+		if !cmp.Equal(*config, mirror.Config{DstRepos: []string{"dst"}}) {
 			t.Fatalf("unexpected dst value: %s", config.Pretty())
 		}
 	}
+	{
+		// Test passing -destination-repository multiple times.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-destination-repository=dst1",
+				"-destination-repository=dst2",
+			})
+		if err != nil {
+			t.Fatalf("setting multiple dst failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			DstRepos: []string{"dst1", "dst2"},
+		}) {
+			t.Fatalf("unexpected multiple dst value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -ref-filter multiple times.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-ref-filter=refs/heads/release/*",
+				"-ref-filter=!refs/heads/release/old",
+			})
+		if err != nil {
+			t.Fatalf("setting ref filters failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			RefFilters: []string{
+				"refs/heads/release/*",
+				"!refs/heads/release/old",
+			},
+		}) {
+			t.Fatalf("unexpected ref filters value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -ref-mapping multiple times.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-ref-mapping=refs/heads/*:refs/heads/upstream/*",
+				"-ref-mapping=refs/tags/*:refs/tags/vendor-*",
+			})
+		if err != nil {
+			t.Fatalf("setting ref mappings failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			RefMappings: []string{
+				"refs/heads/*:refs/heads/upstream/*",
+				"refs/tags/*:refs/tags/vendor-*",
+			},
+		}) {
+			t.Fatalf("unexpected ref mappings value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -cache-dir.
+		config, _, _, err := parseArgs("test",
+			[]string{"-cache-dir=cache"})
+		if err != nil {
+			t.Fatalf("setting cache dir failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			CacheDir: "cache",
+		}) {
+			t.Fatalf("unexpected cache dir value: %s", config.Pretty())
+		}
+	}
 	{
 		// Test passing -ssh-known-hosts-path.
-		config, _, err := parseArgs("test",
+		config, _, _, err := parseArgs("test",
 			[]string{"-ssh-known-hosts-path=file"})
 		if err != nil {
 			t.Fatalf("setting host key failed: %s", err)
@@ -51,9 +120,331 @@ func TestParseArgs(t *testing.T) {
 			t.Fatalf("unexpected host key value: %s", config.Pretty())
 		}
 	}
+	{
+		// Test passing -source-ssh-known-hosts-path.
+		config, _, _, err := parseArgs("test",
+			[]string{"-source-ssh-known-hosts-path=file"})
+		if err != nil {
+			t.Fatalf("setting source host key failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SrcSSH: mirror.SSHConf{
+				KnownHostsPath: "file",
+			},
+		}) {
+			t.Fatalf("unexpected source host key value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -ssh-private-key-path and
+		// -source-ssh-private-key-path.
+		config, _, _, err := parseArgs("test",
+			[]string{"-ssh-private-key-path=key",
+				"-source-ssh-private-key-path=srckey"})
+		if err != nil {
+			t.Fatalf("setting the SSH private key path failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SSH: mirror.SSHConf{
+				PrivateKeyPath: "key",
+			},
+			SrcSSH: mirror.SSHConf{
+				PrivateKeyPath: "srckey",
+			},
+		}) {
+			t.Fatalf("unexpected SSH private key path value: %s",
+				config.Pretty())
+		}
+	}
+	{
+		// Test passing -ssh-option and -source-ssh-option.
+		config, _, _, err := parseArgs("test",
+			[]string{"-ssh-option", "User=gerrit", "-ssh-option",
+				"Port=29418", "-source-ssh-option", "ConnectTimeout=10"})
+		if err != nil {
+			t.Fatalf("setting SSH options failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SSH: mirror.SSHConf{
+				Options: []string{"User=gerrit", "Port=29418"},
+			},
+			SrcSSH: mirror.SSHConf{
+				Options: []string{"ConnectTimeout=10"},
+			},
+		}) {
+			t.Fatalf("unexpected SSH options value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -ssh-agent and -source-ssh-agent.
+		config, _, _, err := parseArgs("test",
+			[]string{"-ssh-agent", "-source-ssh-agent"})
+		if err != nil {
+			t.Fatalf("setting the SSH agent failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SSH: mirror.SSHConf{
+				Agent: true,
+			},
+			SrcSSH: mirror.SSHConf{
+				Agent: true,
+			},
+		}) {
+			t.Fatalf("unexpected SSH agent value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing the SSH bastion flags.
+		config, _, _, err := parseArgs("test",
+			[]string{"-ssh-bastion-host", "bastion:2222", "-ssh-bastion-user",
+				"user", "-ssh-bastion-private-key-path", "key",
+				"-ssh-bastion-known-hosts-path", "kh",
+				"-source-ssh-bastion-host", "srcbastion",
+				"-source-ssh-bastion-user", "srcuser",
+				"-source-ssh-bastion-private-key-path", "srckey",
+				"-source-ssh-bastion-known-hosts-path", "srckh"})
+		if err != nil {
+			t.Fatalf("setting the SSH bastion failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SSH: mirror.SSHConf{
+				Bastion: mirror.BastionConf{
+					Host:           "bastion:2222",
+					User:           "user",
+					PrivateKeyPath: "key",
+					KnownHostsPath: "kh",
+				},
+			},
+			SrcSSH: mirror.SSHConf{
+				Bastion: mirror.BastionConf{
+					Host:           "srcbastion",
+					User:           "srcuser",
+					PrivateKeyPath: "srckey",
+					KnownHostsPath: "srckh",
+				},
+			},
+		}) {
+			t.Fatalf("unexpected SSH bastion value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -ssh-config.
+		config, _, _, err := parseArgs("test",
+			[]string{"-ssh-config", "sshconfig"})
+		if err != nil {
+			t.Fatalf("setting the SSH client configuration failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			SSHConfigPath: "sshconfig",
+		}) {
+			t.Fatalf("unexpected SSH client configuration value: %s",
+				config.Pretty())
+		}
+	}
+	{
+		// Test passing the credential helpers and the netrc file.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-credential-helper", "store",
+				"-source-credential-helper", "!helper",
+				"-netrc", "netrc",
+			})
+		if err != nil {
+			t.Fatalf("setting the credential helpers failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			HTTP:      mirror.HTTPConf{CredentialHelper: "store"},
+			SrcHTTP:   mirror.HTTPConf{CredentialHelper: "!helper"},
+			NetrcPath: "netrc",
+		}) {
+			t.Fatalf("unexpected credential helper values: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing the retry flags.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-retry-attempts", "3",
+				"-retry-backoff", "2s",
+				"-retry-max-backoff", "30s",
+				"-retry-jitter", "500ms",
+			})
+		if err != nil {
+			t.Fatalf("setting the retry configuration failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			Retry: mirror.RetryConf{
+				Attempts:   3,
+				Backoff:    2 * time.Second,
+				MaxBackoff: 30 * time.Second,
+				Jitter:     500 * time.Millisecond,
+			},
+		}) {
+			t.Fatalf("unexpected retry configuration value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing the GitHub App flags.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-github-app-id", "1",
+				"-github-app-installation-id", "2",
+				"-github-app-private-key-path", "appkey",
+				"-github-api-url", "https://api.example.com",
+				"-source-github-app-id", "3",
+				"-source-github-app-installation-id", "4",
+				"-source-github-app-private-key-path", "srcappkey",
+				"-source-github-api-url", "https://srcapi.example.com",
+			})
+		if err != nil {
+			t.Fatalf("setting the GitHub Apps failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			HTTP: mirror.HTTPConf{GitHubApp: mirror.GitHubAppConf{
+				AppID:          "1",
+				InstallationID: "2",
+				PrivateKeyPath: "appkey",
+				APIURL:         "https://api.example.com",
+			}},
+			SrcHTTP: mirror.HTTPConf{GitHubApp: mirror.GitHubAppConf{
+				AppID:          "3",
+				InstallationID: "4",
+				PrivateKeyPath: "srcappkey",
+				APIURL:         "https://srcapi.example.com",
+			}},
+		}) {
+			t.Fatalf("unexpected GitHub App values: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing the TLS flags.
+		config, _, _, err := parseArgs("test",
+			[]string{
+				"-ca-bundle", "cabundle",
+				"-tls-client-cert", "clientcert",
+				"-tls-client-key", "clientkey",
+				"-insecure-skip-tls-verify",
+			})
+		if err != nil {
+			t.Fatalf("setting the TLS configuration failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			TLS: mirror.TLSConf{
+				CABundlePath:       "cabundle",
+				ClientCertPath:     "clientcert",
+				ClientKeyPath:      "clientkey",
+				InsecureSkipVerify: true,
+			},
+		}) {
+			t.Fatalf("unexpected TLS configuration value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -dry-run.
+		config, _, _, err := parseArgs("test",
+			[]string{"-dry-run"})
+		if err != nil {
+			t.Fatalf("setting dry-run failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{
+			DryRun: true,
+		}) {
+			t.Fatalf("unexpected dry-run value: %s", config.Pretty())
+		}
+	}
+	{
+		// Test passing -report and -report-file.
+		config, rc, _, err := parseArgs("test",
+			[]string{"-report=json", "-report-file=report.json"})
+		if err != nil {
+			t.Fatalf("setting report failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{}) {
+			t.Fatalf("unexpected config value: %s", config.Pretty())
+		}
+		if rc.Report != (reportConf{Format: "json", File: "report.json"}) {
+			t.Fatalf("unexpected report value: %v", rc.Report)
+		}
+	}
+	{
+		// Test passing -config and -job.
+		config, rc, _, err := parseArgs("test",
+			[]string{"-config=jobs.yml", "-job=a", "-job=b", "-dry-run",
+				"-report=json"})
+		if err != nil {
+			t.Fatalf("setting config failed: %s", err)
+		}
+		if !cmp.Equal(*config, mirror.Config{DryRun: true}) {
+			t.Fatalf("unexpected config value: %s", config.Pretty())
+		}
+		if !cmp.Equal(rc, runConf{
+			Report:   reportConf{Format: "json"},
+			JobsPath: "jobs.yml",
+			Jobs:     []string{"a", "b"},
+			Daemon: mirror.DaemonConf{
+				Workers:         mirror.DefaultWorkers,
+				ShutdownTimeout: mirror.DefaultShutdownTimeout,
+				WebhookDebounce: mirror.DefaultWebhookDebounce,
+			},
+		}) {
+			t.Fatalf("unexpected run value: %v", rc)
+		}
+	}
+	{
+		// Test passing the daemon mode flags.
+		_, rc, _, err := parseArgs("test",
+			[]string{"-config=jobs.yml", "-serve", "-workers=2",
+				"-shutdown-timeout=30s", "-listen=:8080",
+				"-webhook-secret-path=secret", "-webhook-debounce=1s"})
+		if err != nil {
+			t.Fatalf("setting serve failed: %s", err)
+		}
+		if !rc.Serve || rc.Daemon != (mirror.DaemonConf{
+			Workers:           2,
+			ShutdownTimeout:   30 * time.Second,
+			Listen:            ":8080",
+			WebhookSecretPath: "secret",
+			WebhookDebounce:   time.Second,
+		}) {
+			t.Fatalf("unexpected run value: %v", rc)
+		}
+	}
+	{
+		// Test passing invalid daemon mode flags.
+		for _, args := range [][]string{
+			{"-serve"},
+			{"-config=jobs.yml", "-workers=2"},
+			{"-config=jobs.yml", "-shutdown-timeout=30s"},
+			{"-config=jobs.yml", "-listen=:8080"},
+			{"-config=jobs.yml", "-webhook-secret-path=secret"},
+			{"-config=jobs.yml", "-webhook-debounce=1s"},
+			{"-config=jobs.yml", "-serve", "-report=json"},
+			{"-config=jobs.yml", "-serve", "-report-file=report.json"},
+		} {
+			if _, _, _, err := parseArgs("test", args); !errors.Is(err,
+				ErrJobsFlag) {
+				t.Fatalf("invalid flags succeeded: %v", args)
+			}
+		}
+	}
+	{
+		// Test passing -config with flags provided by the jobs file.
+		_, _, _, err := parseArgs("test",
+			[]string{"-config=jobs.yml", "-source-repository=src"})
+		if !errors.Is(err, ErrJobsFlag) {
+			t.Fatal("config with a source repository succeeded")
+		}
+	}
+	{
+		// Test passing -job without -config.
+		_, _, _, err := parseArgs("test", []string{"-job=a"})
+		if !errors.Is(err, ErrJobsFlag) {
+			t.Fatal("job without config succeeded")
+		}
+	}
 	{
 		// Test passing -debug.
-		config, _, err := parseArgs("test",
+		config, _, _, err := parseArgs("test",
 			[]string{"-debug"})
 		if err != nil {
 			t.Fatalf("setting debug failed: %s", err)
@@ -66,7 +457,7 @@ func TestParseArgs(t *testing.T) {
 	}
 	{
 		// Test passing invalid flag.
-		_, _, err := parseArgs("test", []string{"-invalid-flag"})
+		_, _, _, err := parseArgs("test", []string{"-invalid-flag"})
 		if err == nil {
 			t.Fatal("invalid flag succeeded")
 		}
@@ -77,8 +468,65 @@ func TestParseArgs(t *testing.T) {
 func TestVersionFlag(t *testing.T) {
 	t.Parallel()
 
-	_, _, err := parseArgs("test", []string{"-version"})
+	_, _, _, err := parseArgs("test", []string{"-version"})
 	if !errors.Is(err, ErrVersion) {
 		t.Fatal("version error was not returned")
 	}
 }
+
+// TestReadStdinKey tests reading the SSH private key from the standard input.
+func TestReadStdinKey(t *testing.T) {
+	t.Parallel()
+
+	{
+		// Nothing is read without the '-' path.
+		conf := mirror.Config{SSH: mirror.SSHConf{PrivateKeyPath: "key"}}
+		if err := readStdinKey(&conf, strings.NewReader("stdinkey")); err != nil {
+			t.Fatalf("reading no key from stdin failed: %s", err)
+		}
+		if !cmp.Equal(conf.SSH, mirror.SSHConf{PrivateKeyPath: "key"}) {
+			t.Fatal("unexpected SSH configuration")
+		}
+	}
+	{
+		// Read the SSH private key from stdin.
+		conf := mirror.Config{SSH: mirror.SSHConf{PrivateKeyPath: "-"}}
+		if err := readStdinKey(&conf, strings.NewReader("stdinkey")); err != nil {
+			t.Fatalf("reading the key from stdin failed: %s", err)
+		}
+		if !cmp.Equal(conf.SSH, mirror.SSHConf{PrivateKey: "stdinkey"}) {
+			t.Fatal("unexpected SSH configuration")
+		}
+	}
+	{
+		// Read the source SSH private key from stdin.
+		conf := mirror.Config{SrcSSH: mirror.SSHConf{PrivateKeyPath: "-"}}
+		if err := readStdinKey(&conf, strings.NewReader("stdinkey")); err != nil {
+			t.Fatalf("reading the source key from stdin failed: %s", err)
+		}
+		if !cmp.Equal(conf.SrcSSH, mirror.SSHConf{PrivateKey: "stdinkey"}) {
+			t.Fatal("unexpected source SSH configuration")
+		}
+	}
+	{
+		// Only one key can be read from stdin.
+		conf := mirror.Config{
+			SSH:    mirror.SSHConf{PrivateKeyPath: "-"},
+			SrcSSH: mirror.SSHConf{PrivateKeyPath: "-"},
+		}
+		err := readStdinKey(&conf, strings.NewReader("stdinkey"))
+		if !errors.Is(err, ErrStdinKey) {
+			t.Fatal("reading two keys from stdin was allowed")
+		}
+	}
+	{
+		// The key can't be provided by both content and stdin.
+		conf := mirror.Config{
+			SSH: mirror.SSHConf{PrivateKey: "key", PrivateKeyPath: "-"},
+		}
+		err := readStdinKey(&conf, strings.NewReader("stdinkey"))
+		if !errors.Is(err, mirror.ErrPrivateKey) {
+			t.Fatal("key provided by both content and stdin was allowed")
+		}
+	}
+}
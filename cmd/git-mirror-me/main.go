@@ -5,17 +5,33 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"strings"
+	"syscall"
 
 	mirror "github.com/agherzan/git-mirror-me"
 )
 
+// Exit status used in dry-run mode when the destinations are not in sync.
+const exitNotInSync = 2
+
+var ErrJobsFailed = errors.New("jobs failed")
+
+// notifyContext returns the context of the daemon mode, done on SIGTERM or
+// SIGINT. It is replaceable for testing.
+var notifyContext = func() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM,
+		os.Interrupt)
+}
+
 func run(logger *mirror.Logger, env map[string]string, progName string, args []string) error {
-	conf, output, err := parseArgs(progName, args)
+	conf, rc, output, err := parseArgs(progName, args)
 
 	switch {
 	case errors.Is(err, flag.ErrHelp):
@@ -31,17 +47,133 @@ func run(logger *mirror.Logger, env map[string]string, progName string, args []s
 		return fmt.Errorf("%w", err)
 	}
 
+	if err := rc.Report.validate(); err != nil {
+		return fmt.Errorf("configuration failed: %w", err)
+	}
+
+	if len(rc.JobsPath) != 0 {
+		return runJobs(logger, env, conf, rc)
+	}
+
 	conf.ProcessEnv(logger, env)
 	logger.Debug(conf.Debug, conf.Pretty())
 
-	err = conf.Validate(logger)
+	var result *mirror.MirrorResult
+
+	err = readStdinKey(conf, os.Stdin)
+	if err == nil {
+		err = conf.Validate(logger)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("configuration failed: %w", err)
+	} else {
+		result, err = mirror.Mirror(*conf, logger)
+		if err != nil {
+			err = fmt.Errorf("mirror operation failed: %w", err)
+		}
+	}
+
+	// The report is written even when the run failed.
+	if reportErr := writeReport(rc.Report, newReport(conf, result, err)); reportErr != nil {
+		if err != nil {
+			logger.Error(reportErr)
+
+			return err
+		}
+
+		return reportErr
+	}
+
+	return err
+}
+
+// runJobs runs the jobs of a jobs file, once or in daemon mode. The dry-run
+// and debug modes of the configuration apply to all the jobs and the
+// environment variables provide the values not set by a job.
+func runJobs(logger *mirror.Logger, env map[string]string, conf *mirror.Config,
+	rc runConf,
+) error {
+	jobs, err := mirror.LoadJobs(rc.JobsPath)
+	if err == nil {
+		jobs, err = mirror.SelectJobs(jobs, rc.Jobs)
+	}
+
 	if err != nil {
 		return fmt.Errorf("configuration failed: %w", err)
 	}
 
-	err = mirror.DoMirror(*conf, logger)
+	for i := range jobs {
+		jobConf := &jobs[i].Config
+		jobConf.DryRun = jobConf.DryRun || conf.DryRun
+		jobConf.Debug = jobConf.Debug || conf.Debug
+
+		jobConf.ProcessEnv(logger, env)
+		logger.Debug(jobConf.Debug, jobs[i].Name, jobConf.Pretty())
+	}
+
+	if rc.Serve {
+		return serveJobs(logger, env, jobs, rc.Daemon)
+	}
+
+	results := mirror.RunJobs(jobs, logger)
+	err = jobsError(results)
+
+	// The report is written even when jobs failed.
+	if reportErr := writeReport(rc.Report, newJobsReport(results)); reportErr != nil {
+		if err != nil {
+			logger.Error(reportErr)
+
+			return err
+		}
+
+		return reportErr
+	}
+
+	return err
+}
+
+// serveJobs runs the jobs in daemon mode until SIGTERM or SIGINT.
+func serveJobs(logger *mirror.Logger, env map[string]string,
+	jobs []mirror.Job, conf mirror.DaemonConf,
+) error {
+	conf.ProcessEnv(env)
+
+	daemon, err := mirror.NewDaemon(jobs, conf, logger)
 	if err != nil {
-		return fmt.Errorf("mirror operation failed: %w", err)
+		return fmt.Errorf("configuration failed: %w", err)
+	}
+
+	ctx, stop := notifyContext()
+	defer stop()
+
+	if err := daemon.Run(ctx); err != nil {
+		return fmt.Errorf("daemon failed: %w", err)
+	}
+
+	return nil
+}
+
+// jobsError returns the error of a jobs file run. It is ErrNotInSync when
+// the only failures are jobs not in sync.
+func jobsError(results []mirror.JobResult) error {
+	var failed, notInSync []string
+
+	for _, result := range results {
+		switch {
+		case errors.Is(result.Err, mirror.ErrNotInSync):
+			notInSync = append(notInSync, result.Job.Name)
+		case result.Err != nil:
+			failed = append(failed, result.Job.Name)
+		}
+	}
+
+	switch {
+	case len(failed) != 0:
+		return fmt.Errorf("%w: %s", ErrJobsFailed, strings.Join(failed, ", "))
+	case len(notInSync) != 0:
+		return fmt.Errorf("%w: %s", mirror.ErrNotInSync,
+			strings.Join(notInSync, ", "))
 	}
 
 	return nil
@@ -57,9 +189,82 @@ func main() {
 		"GMM_SRC_REPO",
 		"GITHUB_SERVER_URL",
 		"GITHUB_REPOSITORY",
+		"GITHUB_TOKEN",
+		"GMM_USE_GITHUB_TOKEN",
 		"GMM_DST_REPO",
+		"GMM_REF_FILTERS",
+		"GMM_REF_MAPPINGS",
+		"GMM_CACHE_DIR",
 		"GMM_SSH_PRIVATE_KEY",
+		"GMM_SSH_PRIVATE_KEY_FILE",
+		"GMM_SSH_PRIVATE_KEY_PASSPHRASE",
+		"GMM_SSH_PRIVATE_KEY_PASSPHRASE_FILE",
 		"GMM_SSH_KNOWN_HOSTS",
+		"GMM_SSH_KNOWN_HOSTS_FILE",
+		"GMM_SSH_OPTIONS",
+		"GMM_SSH_AGENT",
+		"SSH_AUTH_SOCK",
+		"GMM_SSH_CONFIG",
+		"GMM_SSH_BASTION_HOST",
+		"GMM_SSH_BASTION_USER",
+		"GMM_SSH_BASTION_PRIVATE_KEY",
+		"GMM_SSH_BASTION_PRIVATE_KEY_FILE",
+		"GMM_SSH_BASTION_PASSPHRASE",
+		"GMM_SSH_BASTION_PASSPHRASE_FILE",
+		"GMM_SSH_BASTION_KNOWN_HOSTS",
+		"GMM_SSH_BASTION_KNOWN_HOSTS_FILE",
+		"GMM_HTTP_USERNAME",
+		"GMM_HTTP_TOKEN",
+		"GMM_HTTP_TOKEN_FILE",
+		"GMM_GITHUB_APP_ID",
+		"GMM_GITHUB_APP_INSTALLATION_ID",
+		"GMM_GITHUB_APP_PRIVATE_KEY",
+		"GMM_GITHUB_APP_PRIVATE_KEY_FILE",
+		"GMM_GITHUB_APP_API_URL",
+		"GITHUB_API_URL",
+		"GMM_CREDENTIAL_HELPER",
+		"GMM_SRC_CREDENTIAL_HELPER",
+		"GMM_NETRC",
+		"GMM_SRC_SSH_PRIVATE_KEY",
+		"GMM_SRC_SSH_PRIVATE_KEY_FILE",
+		"GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE",
+		"GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE_FILE",
+		"GMM_SRC_SSH_KNOWN_HOSTS",
+		"GMM_SRC_SSH_KNOWN_HOSTS_FILE",
+		"GMM_SRC_SSH_AGENT",
+		"GMM_SRC_SSH_OPTIONS",
+		"GMM_SRC_SSH_BASTION_HOST",
+		"GMM_SRC_SSH_BASTION_USER",
+		"GMM_SRC_SSH_BASTION_PRIVATE_KEY",
+		"GMM_SRC_SSH_BASTION_PRIVATE_KEY_FILE",
+		"GMM_SRC_SSH_BASTION_PASSPHRASE",
+		"GMM_SRC_SSH_BASTION_PASSPHRASE_FILE",
+		"GMM_SRC_SSH_BASTION_KNOWN_HOSTS",
+		"GMM_SRC_SSH_BASTION_KNOWN_HOSTS_FILE",
+		"GMM_SRC_HTTP_USERNAME",
+		"GMM_SRC_HTTP_TOKEN",
+		"GMM_SRC_HTTP_TOKEN_FILE",
+		"GMM_SRC_GITHUB_APP_ID",
+		"GMM_SRC_GITHUB_APP_INSTALLATION_ID",
+		"GMM_SRC_GITHUB_APP_PRIVATE_KEY",
+		"GMM_SRC_GITHUB_APP_PRIVATE_KEY_FILE",
+		"GMM_SRC_GITHUB_APP_API_URL",
+		"HTTPS_PROXY",
+		"https_proxy",
+		"HTTP_PROXY",
+		"http_proxy",
+		"NO_PROXY",
+		"no_proxy",
+		"GMM_SSH_PROXY",
+		"ALL_PROXY",
+		"all_proxy",
+		"GMM_CA_BUNDLE",
+		"GMM_TLS_CLIENT_CERT",
+		"GMM_TLS_CLIENT_KEY",
+		"GMM_INSECURE_SKIP_TLS_VERIFY",
+		"GMM_WEBHOOK_SECRET",
+		"GMM_WEBHOOK_SECRET_FILE",
+		"GMM_DRY_RUN",
 		"GMM_DEBUG",
 	}
 
@@ -70,6 +275,11 @@ func main() {
 	}
 
 	if err := run(logger, env, os.Args[0], os.Args[1:]); err != nil {
+		if errors.Is(err, mirror.ErrNotInSync) {
+			logger.Info(err)
+			os.Exit(exitNotInSync)
+		}
+
 		logger.Fatal(err)
 	}
 }
@@ -5,12 +5,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	mirror "github.com/agherzan/git-mirror-me"
 	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5"
 )
 
 // TestRun tests the run function.
@@ -81,6 +87,12 @@ func TestRun(t *testing.T) {
 		t.Fatal("invalid configuration passed")
 	}
 
+	// Fail on an invalid report format.
+	args = []string{"-report=xml"}
+	if err := run(logger, map[string]string{}, "test", args); err == nil {
+		t.Fatal("invalid report format passed")
+	}
+
 	// Fail on an invalid destination repository.
 	env := map[string]string{"GMM_SRC_REPO": srcRepoPath}
 	args = []string{"--destination-repository", "invalid"}
@@ -89,14 +101,41 @@ func TestRun(t *testing.T) {
 		t.Fatal("run succeeded with an invalid dst repository")
 	}
 
-	// Valid run.
+	// Dry-run with the destination not in sync.
 	env = map[string]string{"GMM_SRC_REPO": srcRepoPath}
-	args = []string{"--destination-repository", dstRepoPath}
+	args = []string{"--dry-run", "--destination-repository", dstRepoPath}
+
+	if err := run(logger, env, "test", args); !errors.Is(err, mirror.ErrNotInSync) {
+		t.Fatalf("dry-run didn't report the destination not in sync: %s", err)
+	}
+
+	// Valid run with a report.
+	reportPath := path.Join(srcRepoPath, "report.json")
+	env = map[string]string{"GMM_SRC_REPO": srcRepoPath}
+	args = []string{"--destination-repository", dstRepoPath,
+		"--report-file", reportPath}
 
 	if err := run(logger, env, "test", args); err != nil {
 		t.Fatalf("run failed: %s", err)
 	}
 
+	// Verify the report.
+	content, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read the report: %s", err)
+	}
+
+	var rep report
+	if err := json.Unmarshal(content, &rep); err != nil {
+		t.Fatalf("failed to parse the report: %s", err)
+	}
+
+	if rep.Status != reportStatusSuccess || len(rep.Destinations) != 1 ||
+		len(rep.Destinations[0].Pruned) != 1 ||
+		rep.Destinations[0].Pruned[0] != "refs/heads/c" {
+		t.Fatalf("unexpected report: %s", content)
+	}
+
 	// Verify the destination.
 	dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
 	if err != nil {
@@ -121,4 +160,226 @@ func TestRun(t *testing.T) {
 	if !ok {
 		t.Fatal("unexpected hash test result for the dst repo")
 	}
+
+	// Dry-run with the destination in sync.
+	env = map[string]string{"GMM_SRC_REPO": srcRepoPath, "GMM_DRY_RUN": "1"}
+	args = []string{"--destination-repository", dstRepoPath}
+
+	if err := run(logger, env, "test", args); err != nil {
+		t.Fatalf("dry-run failed with the destination in sync: %s", err)
+	}
+}
+
+// TestRunJobs tests the run function with a jobs file.
+func TestRunJobs(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := mirror.NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	srcRepoPath := path.Join(dir, "src")
+	if _, _, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+	}); err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	dstRepoPaths := []string{path.Join(dir, "dst1"), path.Join(dir, "dst2")}
+	dstRepos := make([]*git.Repository, 0, len(dstRepoPaths))
+
+	for _, dstRepoPath := range dstRepoPaths {
+		dstRepo, _, err := utils.NewTestRepo(dstRepoPath, []string{})
+		if err != nil {
+			t.Fatalf("failed to create a test dst repo: %s", err)
+		}
+
+		dstRepos = append(dstRepos, dstRepo)
+	}
+
+	jobsPath := path.Join(dir, "jobs.yml")
+	if err := ioutil.WriteFile(jobsPath, []byte(`
+defaults:
+  source: `+srcRepoPath+`
+jobs:
+  - name: first
+    destinations: [`+dstRepoPaths[0]+`]
+  - name: second
+    destinations: [`+dstRepoPaths[1]+`]
+  - name: failing
+    source: `+path.Join(dir, "missing")+`
+    destinations: [`+dstRepoPaths[1]+`]
+`), 0o600); err != nil {
+		t.Fatalf("failed to write the jobs file: %s", err)
+	}
+
+	// Fail on an invalid jobs file.
+	args := []string{"-config", path.Join(dir, "missing.yml")}
+	if err := run(logger, map[string]string{}, "test", args); !errors.Is(err,
+		mirror.ErrJobs) {
+		t.Fatalf("run succeeded with an invalid jobs file: %s", err)
+	}
+
+	// Fail on an unknown job.
+	args = []string{"-config", jobsPath, "-job", "unknown"}
+	if err := run(logger, map[string]string{}, "test", args); !errors.Is(err,
+		mirror.ErrUnknownJob) {
+		t.Fatalf("run succeeded with an unknown job: %s", err)
+	}
+
+	// Dry-run with the destinations not in sync.
+	args = []string{"-config", jobsPath, "-job", "first", "-job", "second",
+		"-dry-run"}
+	if err := run(logger, map[string]string{}, "test", args); !errors.Is(err,
+		mirror.ErrNotInSync) {
+		t.Fatalf("dry-run didn't report the destinations not in sync: %s", err)
+	}
+
+	// Run all the jobs with a report.
+	reportPath := path.Join(dir, "report.json")
+	args = []string{"-config", jobsPath, "-report-file", reportPath}
+
+	if err := run(logger, map[string]string{}, "test", args); !errors.Is(err,
+		ErrJobsFailed) {
+		t.Fatalf("run didn't report the failing job: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read the report: %s", err)
+	}
+
+	var rep jobsReport
+	if err := json.Unmarshal(content, &rep); err != nil {
+		t.Fatalf("failed to parse the report: %s", err)
+	}
+
+	if rep.Status != reportStatusFailure || len(rep.Jobs) != 3 ||
+		rep.Jobs[0].Name != "first" ||
+		rep.Jobs[0].Status != reportStatusSuccess ||
+		rep.Jobs[1].Name != "second" ||
+		rep.Jobs[1].Status != reportStatusSuccess ||
+		rep.Jobs[2].Name != "failing" ||
+		rep.Jobs[2].Status != reportStatusFailure {
+		t.Fatalf("unexpected report: %s", content)
+	}
+
+	for _, dstRepo := range dstRepos {
+		dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+		if err != nil {
+			t.Fatalf("failed to get the dst repo refs: %s", err)
+		}
+
+		if !utils.SlicesAreEqual(dstRepoRefs, []string{
+			"HEAD",
+			"refs/heads/master",
+			"refs/heads/a",
+		}) {
+			t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+		}
+	}
+
+	// Run the jobs in sync.
+	args = []string{"-config", jobsPath, "-job", "first", "-job", "second"}
+	env := map[string]string{"GMM_DRY_RUN": "1"}
+
+	if err := run(logger, env, "test", args); err != nil {
+		t.Fatalf("dry-run failed with the destinations in sync: %s", err)
+	}
+}
+
+// TestServeJobs tests the run function in daemon mode. The test isn't
+// parallel as it replaces the daemon mode context.
+func TestServeJobs(t *testing.T) {
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := mirror.NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	srcRepoPath := path.Join(dir, "src")
+	if _, _, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+	}); err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	dstRepoPath := path.Join(dir, "dst")
+
+	dstRepo, _, err := utils.NewTestRepo(dstRepoPath, []string{})
+	if err != nil {
+		t.Fatalf("failed to create a test dst repo: %s", err)
+	}
+
+	jobsPath := path.Join(dir, "jobs.yml")
+	if err := ioutil.WriteFile(jobsPath, []byte(`
+jobs:
+  - name: project
+    source: `+srcRepoPath+`
+    destinations: [`+dstRepoPath+`]
+    schedule:
+      interval: 1h
+`), 0o600); err != nil {
+		t.Fatalf("failed to write the jobs file: %s", err)
+	}
+
+	defer func(orig func() (context.Context, context.CancelFunc)) {
+		notifyContext = orig
+	}(notifyContext)
+
+	// Stop the daemon once the job, running when the daemon starts, had
+	// the time to start.
+	notifyContext = func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 500*time.Millisecond)
+	}
+
+	args := []string{"-config", jobsPath, "-serve", "-workers", "1"}
+	if err := run(logger, map[string]string{}, "test", args); err != nil {
+		t.Fatalf("daemon failed: %s", err)
+	}
+
+	dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+	if err != nil {
+		t.Fatalf("failed to get the dst repo refs: %s", err)
+	}
+
+	if !utils.SlicesAreEqual(dstRepoRefs, []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}) {
+		t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+	}
+
+	// Fail on invalid daemon configuration.
+	args = []string{"-config", jobsPath, "-serve", "-workers", "-1"}
+	if err := run(logger, map[string]string{}, "test", args); !errors.Is(err,
+		mirror.ErrDaemon) {
+		t.Fatalf("daemon succeeded with negative workers: %s", err)
+	}
+
+	// Fail on a webhook secret provided twice.
+	env := map[string]string{"GMM_WEBHOOK_SECRET": "secret"}
+	args = []string{"-config", jobsPath, "-serve", "-webhook-secret-path",
+		path.Join(dir, "secret")}
+
+	if err := run(logger, env, "test", args); !errors.Is(err,
+		mirror.ErrDaemon) {
+		t.Fatalf("daemon succeeded with the webhook secret provided twice: %s",
+			err)
+	}
 }
@@ -0,0 +1,309 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mirror "github.com/agherzan/git-mirror-me"
+)
+
+const (
+	reportFormatJSON = "json"
+	reportFilePerm   = 0o644
+)
+
+// Report statuses.
+const (
+	reportStatusSuccess   = "success"
+	reportStatusFailure   = "failure"
+	reportStatusNotInSync = "not-in-sync"
+)
+
+// Report error classes. The phases of the mirroring are used as classes for
+// mirroring failures.
+const (
+	reportClassConfig      = "config"
+	reportClassDestination = "destination"
+	reportClassNotInSync   = "not-in-sync"
+	reportClassUnknown     = "unknown"
+)
+
+var ErrReportFormat = errors.New("invalid report format")
+
+// reportConf holds the configuration of the machine-readable report.
+type reportConf struct {
+	// Format is the format of the report. No report is written when empty.
+	Format string
+	// File is the path of the report file. The report is written to the
+	// standard output when empty.
+	File string
+}
+
+// validate checks the report configuration. Providing a report file without
+// a format defaults the format to JSON.
+func (c *reportConf) validate() error {
+	if len(c.Format) == 0 && len(c.File) != 0 {
+		c.Format = reportFormatJSON
+	}
+
+	if len(c.Format) != 0 && c.Format != reportFormatJSON {
+		return fmt.Errorf("%w: %q", ErrReportFormat, c.Format)
+	}
+
+	return nil
+}
+
+type reportRef struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+type reportUpdate struct {
+	Name   string           `json:"name"`
+	Old    string           `json:"old"`
+	New    string           `json:"new"`
+	Action mirror.RefAction `json:"action"`
+}
+
+type reportError struct {
+	Class   string           `json:"class"`
+	Kind    mirror.ErrorKind `json:"kind,omitempty"`
+	Message string           `json:"message"`
+}
+
+type reportDst struct {
+	Repository string                   `json:"repository"`
+	Refs       []reportRef              `json:"refs"`
+	Updates    []reportUpdate           `json:"updates"`
+	Pruned     []string                 `json:"pruned"`
+	Counts     map[mirror.RefAction]int `json:"counts"`
+	Durations  map[mirror.Phase]float64 `json:"durations_seconds"`
+	Error      *reportError             `json:"error,omitempty"`
+}
+
+// report is the machine-readable report of a run. The durations are provided
+// in seconds.
+type report struct {
+	Source       string                   `json:"source"`
+	DryRun       bool                     `json:"dry_run"`
+	Status       string                   `json:"status"`
+	Destinations []reportDst              `json:"destinations"`
+	Counts       map[mirror.RefAction]int `json:"counts"`
+	Durations    map[mirror.Phase]float64 `json:"durations_seconds"`
+	Duration     float64                  `json:"duration_seconds"`
+	Error        *reportError             `json:"error,omitempty"`
+}
+
+// jobReport is the report of a job of a jobs file.
+type jobReport struct {
+	Name string `json:"name"`
+	report
+}
+
+// jobsReport is the machine-readable report of a jobs file run. The status is
+// 'failure' when at least one job failed and 'not-in-sync' when at least one
+// job is not in sync and none failed.
+type jobsReport struct {
+	Status string      `json:"status"`
+	Jobs   []jobReport `json:"jobs"`
+}
+
+// classifyError returns the report error for an error. The class is the
+// failed phase of the mirroring, if known, or the provided default class. The
+// errors of a mirroring phase also get the kind of their remote operation
+// error.
+func classifyError(err error, class string) *reportError {
+	if err == nil {
+		return nil
+	}
+
+	var (
+		dstsErr  *mirror.DstsError
+		phaseErr *mirror.PhaseError
+		kind     mirror.ErrorKind
+	)
+
+	switch {
+	case errors.Is(err, mirror.ErrNotInSync):
+		class = reportClassNotInSync
+	case errors.As(err, &dstsErr):
+		class = reportClassDestination
+	case errors.As(err, &phaseErr):
+		class = string(phaseErr.Phase)
+		kind = mirror.ClassifyError(phaseErr.Err)
+	}
+
+	return &reportError{
+		Class:   class,
+		Kind:    kind,
+		Message: err.Error(),
+	}
+}
+
+// reportDurations converts durations to seconds.
+func reportDurations(durations map[mirror.Phase]time.Duration) map[mirror.Phase]float64 {
+	seconds := make(map[mirror.Phase]float64, len(durations))
+	for phase, duration := range durations {
+		seconds[phase] = duration.Seconds()
+	}
+
+	return seconds
+}
+
+// newReport builds the report of a run. The result is nil when the mirroring
+// didn't run (for example, when the configuration failed). The err argument is
+// the error of the run. The credentials in the repository URLs are redacted.
+func newReport(conf *mirror.Config, result *mirror.MirrorResult, err error) report {
+	rep := report{
+		Source:       mirror.RedactURL(conf.SrcRepo),
+		DryRun:       conf.DryRun,
+		Status:       reportStatusSuccess,
+		Destinations: []reportDst{},
+		Counts:       map[mirror.RefAction]int{},
+		Durations:    map[mirror.Phase]float64{},
+	}
+
+	switch {
+	case errors.Is(err, mirror.ErrNotInSync):
+		rep.Status = reportStatusNotInSync
+	case err != nil:
+		rep.Status = reportStatusFailure
+	}
+
+	if result == nil {
+		// The mirroring didn't run so the configuration failed.
+		rep.Error = classifyError(err, reportClassConfig)
+
+		for _, dstRepo := range conf.DstRepos {
+			rep.Destinations = append(rep.Destinations, reportDst{
+				Repository: mirror.RedactURL(dstRepo),
+				Refs:       []reportRef{},
+				Updates:    []reportUpdate{},
+				Pruned:     []string{},
+				Counts:     map[mirror.RefAction]int{},
+				Durations:  map[mirror.Phase]float64{},
+			})
+		}
+
+		return rep
+	}
+
+	rep.Error = classifyError(err, reportClassUnknown)
+	rep.Counts = result.Counts()
+	rep.Durations = reportDurations(result.Durations)
+	rep.Duration = result.Duration.Seconds()
+
+	for _, dst := range result.Dsts {
+		repDst := reportDst{
+			Repository: mirror.RedactURL(dst.Repo),
+			Refs:       make([]reportRef, 0, len(dst.Refs)),
+			Updates:    make([]reportUpdate, 0, len(dst.Updates)),
+			Pruned:     []string{},
+			Counts:     dst.Counts(),
+			Durations:  reportDurations(dst.Durations),
+			Error:      classifyError(dst.Err, reportClassUnknown),
+		}
+
+		for _, ref := range dst.Refs {
+			repDst.Refs = append(repDst.Refs, reportRef{
+				Name: ref.Name().String(),
+				Hash: ref.Hash().String(),
+			})
+		}
+
+		for _, update := range dst.Updates {
+			repDst.Updates = append(repDst.Updates, reportUpdate{
+				Name:   update.Name.String(),
+				Old:    update.Old.String(),
+				New:    update.New.String(),
+				Action: update.Action,
+			})
+
+			if update.Action == mirror.RefDeleted {
+				repDst.Pruned = append(repDst.Pruned, update.Name.String())
+			}
+		}
+
+		rep.Destinations = append(rep.Destinations, repDst)
+	}
+
+	return rep
+}
+
+// newJobsReport builds the report of a jobs file run from the results of its
+// jobs.
+func newJobsReport(results []mirror.JobResult) jobsReport {
+	rep := jobsReport{
+		Status: reportStatusSuccess,
+		Jobs:   make([]jobReport, 0, len(results)),
+	}
+
+	for i := range results {
+		jobRep := jobReport{
+			Name: results[i].Job.Name,
+			report: newReport(&results[i].Job.Config, results[i].Result,
+				results[i].Err),
+		}
+
+		switch {
+		case jobRep.Status == reportStatusFailure:
+			rep.Status = reportStatusFailure
+		case jobRep.Status == reportStatusNotInSync &&
+			rep.Status == reportStatusSuccess:
+			rep.Status = reportStatusNotInSync
+		}
+
+		rep.Jobs = append(rep.Jobs, jobRep)
+	}
+
+	return rep
+}
+
+// writeReport writes the report of a run based on the report configuration.
+func writeReport(rc reportConf, rep any) error {
+	if len(rc.Format) == 0 {
+		return nil
+	}
+
+	if len(rc.File) == 0 {
+		return encodeReport(os.Stdout, rep)
+	}
+
+	file, err := os.OpenFile(rc.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		reportFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open the report file: %w", err)
+	}
+
+	if err := encodeReport(file, rep); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write the report: %w", err)
+	}
+
+	return nil
+}
+
+// encodeReport writes a report in the JSON format.
+func encodeReport(out io.Writer, rep any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(rep); err != nil {
+		return fmt.Errorf("failed to write the report: %w", err)
+	}
+
+	return nil
+}
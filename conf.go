@@ -7,6 +7,11 @@ package mirror
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -15,23 +20,181 @@ var (
 	ErrNoHostKey = errors.New("SSH authentication requires host public keys")
 	ErrHostKey   = errors.New("host public keys provided via both file path " +
 		"and content")
+	ErrPrivateKey = errors.New("SSH private key provided via both file path " +
+		"and content")
+	ErrToken = errors.New("HTTP token provided via both file path and " +
+		"content")
+	ErrPassphrase = errors.New("SSH private key passphrase provided via both " +
+		"file path and content")
+	ErrNoPassphrase = errors.New("SSH private key is encrypted but no " +
+		"passphrase was provided")
+	ErrWrongPassphrase = errors.New("wrong SSH private key passphrase")
+	ErrAgentKey        = errors.New("SSH agent and SSH private key can't be " +
+		"used together")
+	ErrNoAgentSocket = errors.New("SSH agent authentication requires the " +
+		"SSH agent socket")
+	ErrAuthMismatch = errors.New("authentication not matching the repository " +
+		"URL scheme")
+	ErrBastionHost       = errors.New("invalid SSH bastion host")
+	ErrBastionPrivateKey = errors.New("SSH bastion private key provided via " +
+		"both file path and content")
+	ErrBastionHostKey = errors.New("SSH bastion host public keys provided via " +
+		"both file path and content")
+	ErrBastionPassphrase = errors.New("SSH bastion private key passphrase " +
+		"provided via both file path and content")
+	ErrProxy = errors.New("invalid proxy")
+	ErrTLS   = errors.New("invalid TLS configuration")
 )
 
 // SSHConf structure defines SSH configuration used for git authentication over
 // SSH.
 type SSHConf struct {
-	PrivateKey     string
-	KnownHosts     string
-	KnownHostsPath string
+	PrivateKey     string `yaml:"-"`
+	PrivateKeyPath string `yaml:"private-key-path"`
+	Passphrase     string `yaml:"-"`
+	PassphrasePath string `yaml:"passphrase-path"`
+	// Agent enables the authentication with the identities of the SSH agent
+	// listening on AgentSocket.
+	Agent          bool   `yaml:"agent"`
+	AgentSocket    string `yaml:"agent-socket"`
+	KnownHosts     string `yaml:"known-hosts"`
+	KnownHostsPath string `yaml:"known-hosts-path"`
+	// Options are OpenSSH-like client options in the 'Key=Value' format
+	// (User, Port, HostKeyAlgorithms, KexAlgorithms, Ciphers and
+	// ConnectTimeout).
+	Options []string    `yaml:"options"`
+	Bastion BastionConf `yaml:"bastion"`
+}
+
+// BastionConf structure defines the bastion (jump host) the SSH connections
+// are tunnelled through. The user, the private key and the host public keys
+// default to the ones used with the repository. The passphrase only decrypts
+// the bastion private key.
+type BastionConf struct {
+	// Host is the bastion address in the 'host[:port]' format.
+	Host           string `yaml:"host"`
+	User           string `yaml:"user"`
+	PrivateKey     string `yaml:"-"`
+	PrivateKeyPath string `yaml:"private-key-path"`
+	Passphrase     string `yaml:"-"`
+	PassphrasePath string `yaml:"passphrase-path"`
+	KnownHosts     string `yaml:"known-hosts"`
+	KnownHostsPath string `yaml:"known-hosts-path"`
+}
+
+// HTTPConf structure defines HTTP configuration used for git authentication
+// over HTTP(S) with a token or a GitHub App. Without those, the credentials
+// are obtained from the git credential helper, if any, and then from the
+// netrc file.
+type HTTPConf struct {
+	Username         string        `yaml:"username"`
+	Token            string        `yaml:"-"`
+	TokenPath        string        `yaml:"token-path"`
+	GitHubApp        GitHubAppConf `yaml:"github-app"`
+	CredentialHelper string        `yaml:"credential-helper"`
+}
+
+// GitHubAppConf structure defines the GitHub App installation whose tokens
+// are used for HTTP authentication. The private key is the PEM key of the
+// app. The API URL defaults to the one of github.com and needs to be set for
+// GitHub Enterprise Server.
+type GitHubAppConf struct {
+	AppID          string `yaml:"app-id"`
+	InstallationID string `yaml:"installation-id"`
+	PrivateKey     string `yaml:"-"`
+	PrivateKeyPath string `yaml:"private-key-path"`
+	APIURL         string `yaml:"api-url"`
+}
+
+// ProxyConf structure defines the proxies used to reach the repositories. The
+// HTTP(S) proxies are used with the repositories accessed over HTTP(S) and the
+// SOCKS5 proxy with the repositories accessed over SSH. NoProxy is a comma
+// separated list of hosts, domains and networks reached directly. When no
+// proxy is configured, the proxies of the process environment are used.
+type ProxyConf struct {
+	HTTPSProxy string `yaml:"https-proxy"`
+	HTTPProxy  string `yaml:"http-proxy"`
+	NoProxy    string `yaml:"no-proxy"`
+	SSHProxy   string `yaml:"ssh-proxy"`
+}
+
+// TLSConf structure defines the TLS configuration used with the repositories
+// accessed over HTTPS. The CA bundle is a PEM file with the certificates
+// trusted in addition to the system ones. The client certificate and key are
+// PEM files used for mutual TLS.
+type TLSConf struct {
+	CABundlePath       string `yaml:"ca-bundle"`
+	ClientCertPath     string `yaml:"client-cert"`
+	ClientKeyPath      string `yaml:"client-key"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
 }
 
 // Config structure provides all the configuration need for the tool to perform
-// its operations. It can be populated via a CLI component.
+// its operations. It can be populated via a CLI component or from a jobs file.
+// The secrets can't be provided in a jobs file, only their file paths.
 type Config struct {
-	SrcRepo string
-	DstRepo string
-	SSH     SSHConf
-	Debug   bool
+	SrcRepo  string   `yaml:"source"`
+	DstRepos []string `yaml:"destinations"`
+	// DstRepo is the destination repository.
+	//
+	// Deprecated: Use DstRepos. DstRepo is added to the destination
+	// repositories when set.
+	DstRepo     string   `yaml:"-" json:"-"`
+	RefFilters  []string `yaml:"ref-filters"`
+	RefMappings []string `yaml:"ref-mappings"`
+	CacheDir    string   `yaml:"cache-dir"`
+	SSH         SSHConf  `yaml:"ssh"`
+	HTTP        HTTPConf `yaml:"http"`
+	SrcSSH      SSHConf  `yaml:"source-ssh"`
+	SrcHTTP     HTTPConf `yaml:"source-http"`
+	// SSHConfigPath is the path of the SSH client configuration file. It
+	// defaults to the one of the user and 'none' disables it.
+	SSHConfigPath string `yaml:"ssh-config"`
+	// NetrcPath is the path of the netrc file providing HTTP credentials. It
+	// defaults to the one of the user and 'none' disables it.
+	NetrcPath string    `yaml:"netrc"`
+	Proxy     ProxyConf `yaml:"proxy"`
+	TLS       TLSConf   `yaml:"tls"`
+	Retry     RetryConf `yaml:"retry"`
+	DryRun    bool      `yaml:"dry-run"`
+	Debug     bool      `yaml:"debug"`
+}
+
+// dstRepos returns the destination repositories, including the deprecated
+// DstRepo one when set.
+func (conf Config) dstRepos() []string {
+	if len(conf.DstRepo) == 0 {
+		return conf.DstRepos
+	}
+
+	for _, dstRepo := range conf.DstRepos {
+		if dstRepo == conf.DstRepo {
+			return conf.DstRepos
+		}
+	}
+
+	return append([]string{conf.DstRepo}, conf.DstRepos...)
+}
+
+// GetRefFilters returns the reference filter rules from a configuration
+// struct. The configured rules follow the default rules so that the default
+// exclusions apply unless a configured rule includes the excluded references
+// again.
+func (conf Config) GetRefFilters() []string {
+	filters := make([]string, 0, len(defaultRefFilters)+len(conf.RefFilters))
+	filters = append(filters, defaultRefFilters...)
+
+	return append(filters, conf.RefFilters...)
+}
+
+// GetRefMappings returns the reference mapping rules from a configuration
+// struct. When no rules are configured, the default rules are returned.
+func (conf Config) GetRefMappings() []string {
+	if len(conf.RefMappings) == 0 {
+		return defaultRefMappings
+	}
+
+	return conf.RefMappings
 }
 
 // GetSSHKey is the getter function for the private SSH key from a
@@ -72,12 +235,41 @@ func (conf *Config) SetKnownHostsPath(file string) {
 
 // Pretty provides a string representation of the configuration structure. It
 // does that by making sure sensitive information is masked using a hash
-// function - e.g. the SSH private key.
+// function - e.g. the SSH private key. The credentials embedded in the
+// repository URLs are redacted.
 func (conf Config) Pretty() string {
 	// It's important to have a passed by value conf struct to not have the
 	// masking affect the struct's actual values.
 	conf.SetSSHKey(mask(conf.SSH.PrivateKey))
 	conf.SetKnownHosts(mask(conf.SSH.KnownHosts))
+	conf.SSH.Passphrase = mask(conf.SSH.Passphrase)
+	conf.HTTP.Token = mask(conf.HTTP.Token)
+	conf.SrcSSH.PrivateKey = mask(conf.SrcSSH.PrivateKey)
+	conf.SrcSSH.Passphrase = mask(conf.SrcSSH.Passphrase)
+	conf.SrcSSH.KnownHosts = mask(conf.SrcSSH.KnownHosts)
+	conf.SSH.Bastion.PrivateKey = mask(conf.SSH.Bastion.PrivateKey)
+	conf.SSH.Bastion.Passphrase = mask(conf.SSH.Bastion.Passphrase)
+	conf.SSH.Bastion.KnownHosts = mask(conf.SSH.Bastion.KnownHosts)
+	conf.SrcSSH.Bastion.PrivateKey = mask(conf.SrcSSH.Bastion.PrivateKey)
+	conf.SrcSSH.Bastion.Passphrase = mask(conf.SrcSSH.Bastion.Passphrase)
+	conf.SrcSSH.Bastion.KnownHosts = mask(conf.SrcSSH.Bastion.KnownHosts)
+	conf.SrcHTTP.Token = mask(conf.SrcHTTP.Token)
+	conf.HTTP.GitHubApp.PrivateKey = mask(conf.HTTP.GitHubApp.PrivateKey)
+	conf.SrcHTTP.GitHubApp.PrivateKey = mask(conf.SrcHTTP.GitHubApp.PrivateKey)
+	conf.Proxy.HTTPSProxy = maskProxyURL(conf.Proxy.HTTPSProxy)
+	conf.Proxy.HTTPProxy = maskProxyURL(conf.Proxy.HTTPProxy)
+	conf.Proxy.SSHProxy = maskProxyURL(conf.Proxy.SSHProxy)
+	conf.SrcRepo = RedactURL(conf.SrcRepo)
+	conf.DstRepos = conf.dstRepos()
+
+	if conf.DstRepos != nil {
+		dstRepos := make([]string, 0, len(conf.DstRepos))
+		for _, dstRepo := range conf.DstRepos {
+			dstRepos = append(dstRepos, RedactURL(dstRepo))
+		}
+
+		conf.DstRepos = dstRepos
+	}
 
 	out, err := json.MarshalIndent(conf, "", "\t")
 	if err != nil {
@@ -91,6 +283,8 @@ func (conf Config) Pretty() string {
 // configuration based on a map that models environment variables.
 func (conf *Config) ProcessEnv(logger *Logger, env map[string]string) {
 	// Fallback to environment variables for the source repository value.
+	var githubSrc bool
+
 	if len(conf.SrcRepo) == 0 {
 		if src, srcSet := env["GMM_SRC_REPO"]; srcSet {
 			conf.SrcRepo = src
@@ -98,16 +292,200 @@ func (conf *Config) ProcessEnv(logger *Logger, env map[string]string) {
 			url := env["GITHUB_SERVER_URL"]
 			repo := env["GITHUB_REPOSITORY"]
 			conf.SrcRepo = url + "/" + repo
+			githubSrc = true
 		}
 	}
 
-	// Fallback to environment variables for the destination repository value.
-	if len(conf.DstRepo) == 0 {
-		conf.DstRepo = env["GMM_DST_REPO"]
+	// The deprecated destination repository is merged into the destination
+	// repositories.
+	conf.DstRepos = conf.dstRepos()
+
+	// Fallback to environment variables for the destination repositories
+	// value.
+	if len(conf.DstRepos) == 0 {
+		conf.DstRepos = splitList(env["GMM_DST_REPO"])
+	}
+
+	// Fallback to environment variables for the reference filters value.
+	if len(conf.RefFilters) == 0 {
+		conf.RefFilters = splitList(env["GMM_REF_FILTERS"])
+	}
+
+	// Fallback to environment variables for the reference mappings value.
+	if len(conf.RefMappings) == 0 {
+		conf.RefMappings = splitList(env["GMM_REF_MAPPINGS"])
+	}
+
+	// Fallback to environment variables for the cache directory value.
+	if len(conf.CacheDir) == 0 {
+		conf.CacheDir = env["GMM_CACHE_DIR"]
+	}
+
+	// Fallback to environment variables for the SSH values. The jobs files can
+	// set the known hosts themselves.
+	if len(conf.SSH.PrivateKey) == 0 {
+		conf.SSH.PrivateKey = env["GMM_SSH_PRIVATE_KEY"]
+	}
+
+	if len(conf.SSH.KnownHosts) == 0 {
+		conf.SSH.KnownHosts = env["GMM_SSH_KNOWN_HOSTS"]
+	}
+
+	// The secrets can also be provided via files using the '_FILE' variants
+	// of the environment variables (for example, Docker or Kubernetes
+	// secrets). The files are read when needed.
+	if len(conf.SSH.PrivateKeyPath) == 0 {
+		conf.SSH.PrivateKeyPath = env["GMM_SSH_PRIVATE_KEY_FILE"]
+	}
+
+	if len(conf.SSH.KnownHostsPath) == 0 {
+		conf.SSH.KnownHostsPath = env["GMM_SSH_KNOWN_HOSTS_FILE"]
+	}
+
+	// Fallback to environment variables for the SSH private key passphrase
+	// values.
+	if len(conf.SSH.Passphrase) == 0 {
+		conf.SSH.Passphrase = env["GMM_SSH_PRIVATE_KEY_PASSPHRASE"]
+	}
+
+	if len(conf.SSH.PassphrasePath) == 0 {
+		conf.SSH.PassphrasePath = env["GMM_SSH_PRIVATE_KEY_PASSPHRASE_FILE"]
+	}
+
+	// Fallback to environment variables for the HTTP authentication
+	// values.
+	if len(conf.HTTP.Username) == 0 {
+		conf.HTTP.Username = env["GMM_HTTP_USERNAME"]
+	}
+
+	if len(conf.HTTP.Token) == 0 {
+		conf.HTTP.Token = env["GMM_HTTP_TOKEN"]
+	}
+
+	if len(conf.HTTP.TokenPath) == 0 {
+		conf.HTTP.TokenPath = env["GMM_HTTP_TOKEN_FILE"]
+	}
+
+	if len(conf.HTTP.CredentialHelper) == 0 {
+		conf.HTTP.CredentialHelper = env["GMM_CREDENTIAL_HELPER"]
+	}
+
+	// Fallback to environment variables for the source authentication
+	// values.
+	if len(conf.SrcSSH.PrivateKey) == 0 {
+		conf.SrcSSH.PrivateKey = env["GMM_SRC_SSH_PRIVATE_KEY"]
+	}
+
+	if len(conf.SrcSSH.PrivateKeyPath) == 0 {
+		conf.SrcSSH.PrivateKeyPath = env["GMM_SRC_SSH_PRIVATE_KEY_FILE"]
+	}
+
+	if len(conf.SrcSSH.Passphrase) == 0 {
+		conf.SrcSSH.Passphrase = env["GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE"]
+	}
+
+	if len(conf.SrcSSH.PassphrasePath) == 0 {
+		conf.SrcSSH.PassphrasePath =
+			env["GMM_SRC_SSH_PRIVATE_KEY_PASSPHRASE_FILE"]
+	}
+
+	if len(conf.SrcSSH.KnownHosts) == 0 {
+		conf.SrcSSH.KnownHosts = env["GMM_SRC_SSH_KNOWN_HOSTS"]
+	}
+
+	if len(conf.SrcSSH.KnownHostsPath) == 0 {
+		conf.SrcSSH.KnownHostsPath = env["GMM_SRC_SSH_KNOWN_HOSTS_FILE"]
+	}
+
+	// Fallback to environment variables for the SSH bastion values.
+	conf.SSH.Bastion.processEnv(env, "GMM_SSH_BASTION_")
+	conf.SrcSSH.Bastion.processEnv(env, "GMM_SRC_SSH_BASTION_")
+
+	// Fallback to environment variables for the SSH options. The options are
+	// whitespace separated as the algorithm lists are comma separated.
+	if len(conf.SSH.Options) == 0 {
+		conf.SSH.Options = strings.Fields(env["GMM_SSH_OPTIONS"])
+	}
+
+	if len(conf.SrcSSH.Options) == 0 {
+		conf.SrcSSH.Options = strings.Fields(env["GMM_SRC_SSH_OPTIONS"])
+	}
+
+	// Fallback to environment variables for the SSH agent authentication.
+	// The agent socket defaults to the one of the SSH agent of the
+	// environment.
+	if !conf.SSH.Agent {
+		conf.SSH.Agent = env["GMM_SSH_AGENT"] == "1"
+	}
+
+	if !conf.SrcSSH.Agent {
+		conf.SrcSSH.Agent = env["GMM_SRC_SSH_AGENT"] == "1"
+	}
+
+	if conf.SSH.Agent && len(conf.SSH.AgentSocket) == 0 {
+		conf.SSH.AgentSocket = env["SSH_AUTH_SOCK"]
+	}
+
+	if conf.SrcSSH.Agent && len(conf.SrcSSH.AgentSocket) == 0 {
+		conf.SrcSSH.AgentSocket = env["SSH_AUTH_SOCK"]
+	}
+
+	if len(conf.SrcHTTP.Username) == 0 {
+		conf.SrcHTTP.Username = env["GMM_SRC_HTTP_USERNAME"]
+	}
+
+	if len(conf.SrcHTTP.Token) == 0 {
+		conf.SrcHTTP.Token = env["GMM_SRC_HTTP_TOKEN"]
+	}
+
+	if len(conf.SrcHTTP.TokenPath) == 0 {
+		conf.SrcHTTP.TokenPath = env["GMM_SRC_HTTP_TOKEN_FILE"]
+	}
+
+	if len(conf.SrcHTTP.CredentialHelper) == 0 {
+		conf.SrcHTTP.CredentialHelper = env["GMM_SRC_CREDENTIAL_HELPER"]
 	}
 
-	conf.SSH.PrivateKey = env["GMM_SSH_PRIVATE_KEY"]
-	conf.SSH.KnownHosts = env["GMM_SSH_KNOWN_HOSTS"]
+	if env["GMM_USE_GITHUB_TOKEN"] == "1" {
+		conf.useGitHubToken(logger, env, githubSrc)
+	}
+
+	conf.HTTP.GitHubApp.processEnv(env, "GMM_GITHUB_APP_")
+	conf.SrcHTTP.GitHubApp.processEnv(env, "GMM_SRC_GITHUB_APP_")
+
+	if len(conf.SSHConfigPath) == 0 {
+		conf.SSHConfigPath = env["GMM_SSH_CONFIG"]
+	}
+
+	if len(conf.NetrcPath) == 0 {
+		conf.NetrcPath = env["GMM_NETRC"]
+	}
+
+	conf.Proxy.processEnv(env)
+
+	if len(conf.TLS.CABundlePath) == 0 {
+		conf.TLS.CABundlePath = env["GMM_CA_BUNDLE"]
+	}
+
+	if len(conf.TLS.ClientCertPath) == 0 {
+		conf.TLS.ClientCertPath = env["GMM_TLS_CLIENT_CERT"]
+	}
+
+	if len(conf.TLS.ClientKeyPath) == 0 {
+		conf.TLS.ClientKeyPath = env["GMM_TLS_CLIENT_KEY"]
+	}
+
+	if !conf.TLS.InsecureSkipVerify {
+		if env["GMM_INSECURE_SKIP_TLS_VERIFY"] == "1" {
+			conf.TLS.InsecureSkipVerify = true
+		}
+	}
+
+	if !conf.DryRun {
+		if env["GMM_DRY_RUN"] == "1" {
+			conf.DryRun = true
+		}
+	}
 
 	if !conf.Debug {
 		if env["GMM_DEBUG"] == "1" {
@@ -116,31 +494,508 @@ func (conf *Config) ProcessEnv(logger *Logger, env map[string]string) {
 	}
 }
 
+// useGitHubToken sets the GitHub Actions token as the HTTP token of the
+// source repository. The token is only used when the source is the
+// repository of the workflow so that it is never sent to another host. The
+// configured source HTTP authentication takes precedence.
+func (conf *Config) useGitHubToken(logger *Logger, env map[string]string, githubSrc bool) {
+	switch {
+	case !githubSrc:
+		logger.Warn("GITHUB_TOKEN not used as the source repository is not " +
+			"the GitHub Actions one.")
+	case len(env["GITHUB_TOKEN"]) == 0:
+		logger.Warn("GITHUB_TOKEN not used as it is not set.")
+	case conf.SrcHTTP.hasAuth():
+		logger.Info("GITHUB_TOKEN not used as the source HTTP authentication " +
+			"is configured.")
+	default:
+		logger.Info("Using GITHUB_TOKEN for the source repository.")
+
+		conf.SrcHTTP.Username = githubAppUsername
+		conf.SrcHTTP.Token = env["GITHUB_TOKEN"]
+	}
+}
+
+// processEnv populates the proxy configuration values not already set from
+// the standard proxy environment variables, the upper case ones taking
+// precedence. The SSH proxy falls back to ALL_PROXY only when it is a SOCKS5
+// proxy as it is often set for other tools with an HTTP proxy.
+func (proxyConf *ProxyConf) processEnv(env map[string]string) {
+	getEnv := func(names ...string) string {
+		for _, name := range names {
+			if value := env[name]; len(value) != 0 {
+				return value
+			}
+		}
+
+		return ""
+	}
+
+	if len(proxyConf.HTTPSProxy) == 0 {
+		proxyConf.HTTPSProxy = getEnv("HTTPS_PROXY", "https_proxy")
+	}
+
+	if len(proxyConf.HTTPProxy) == 0 {
+		proxyConf.HTTPProxy = getEnv("HTTP_PROXY", "http_proxy")
+	}
+
+	if len(proxyConf.NoProxy) == 0 {
+		proxyConf.NoProxy = getEnv("NO_PROXY", "no_proxy")
+	}
+
+	if len(proxyConf.SSHProxy) == 0 {
+		proxyConf.SSHProxy = env["GMM_SSH_PROXY"]
+	}
+
+	if allProxy := getEnv("ALL_PROXY", "all_proxy"); len(proxyConf.SSHProxy) == 0 &&
+		isSOCKS5Proxy(allProxy) {
+		proxyConf.SSHProxy = allProxy
+	}
+}
+
+// processEnv populates the bastion configuration values not already set from
+// the environment variables with the provided prefix.
+func (bastionConf *BastionConf) processEnv(env map[string]string, prefix string) {
+	for _, value := range []struct {
+		field  *string
+		envVar string
+	}{
+		{&bastionConf.Host, "HOST"},
+		{&bastionConf.User, "USER"},
+		{&bastionConf.PrivateKey, "PRIVATE_KEY"},
+		{&bastionConf.PrivateKeyPath, "PRIVATE_KEY_FILE"},
+		{&bastionConf.Passphrase, "PASSPHRASE"},
+		{&bastionConf.PassphrasePath, "PASSPHRASE_FILE"},
+		{&bastionConf.KnownHosts, "KNOWN_HOSTS"},
+		{&bastionConf.KnownHostsPath, "KNOWN_HOSTS_FILE"},
+	} {
+		if len(*value.field) == 0 {
+			*value.field = env[prefix+value.envVar]
+		}
+	}
+}
+
+// processEnv populates the GitHub App configuration values not already set
+// from the environment variables with the provided prefix. The API URL falls
+// back to the one of the GitHub Actions runner, if any, as it points to the
+// right GitHub Enterprise Server instance.
+func (appConf *GitHubAppConf) processEnv(env map[string]string, prefix string) {
+	for _, value := range []struct {
+		field  *string
+		envVar string
+	}{
+		{&appConf.AppID, "ID"},
+		{&appConf.InstallationID, "INSTALLATION_ID"},
+		{&appConf.PrivateKey, "PRIVATE_KEY"},
+		{&appConf.PrivateKeyPath, "PRIVATE_KEY_FILE"},
+		{&appConf.APIURL, "API_URL"},
+	} {
+		if len(*value.field) == 0 {
+			*value.field = env[prefix+value.envVar]
+		}
+	}
+
+	if len(appConf.APIURL) == 0 && len(appConf.AppID) != 0 {
+		appConf.APIURL = env["GITHUB_API_URL"]
+	}
+}
+
 // Validate provides the logic of validating a configuration.
 func (conf Config) Validate(logger *Logger) error {
+	conf.DstRepos = conf.dstRepos()
+
 	if len(conf.SrcRepo) == 0 {
 		return ErrNoSrc
 	}
 
-	logger.Info("Source repository:", conf.SrcRepo, ".")
+	logger.Info("Source repository:", RedactURL(conf.SrcRepo), ".")
 
-	if len(conf.DstRepo) == 0 {
+	if len(conf.DstRepos) == 0 {
 		return ErrNoDst
 	}
 
-	logger.Info("Destination repository:", conf.DstRepo, ".")
+	for _, dstRepo := range conf.DstRepos {
+		if len(dstRepo) == 0 {
+			return ErrNoDst
+		}
 
-	if len(conf.GetSSHKey()) == 0 {
+		logger.Info("Destination repository:", RedactURL(dstRepo), ".")
+	}
+
+	if _, err := newRefsConf(conf); err != nil {
+		return err
+	}
+
+	logger.Info("Reference filters:", conf.GetRefFilters(), ".")
+	logger.Info("Reference mappings:", conf.GetRefMappings(), ".")
+
+	if len(conf.CacheDir) != 0 {
+		logger.Info("Staging cache directory:", conf.CacheDir, ".")
+	}
+
+	if conf.DryRun {
+		logger.Info("Dry-run mode: nothing will be written to the " +
+			"destination repositories.")
+	}
+
+	if len(conf.SSHConfigPath) != 0 {
+		logger.Info("SSH client configuration file:", conf.SSHConfigPath, ".")
+	}
+
+	if len(conf.NetrcPath) != 0 {
+		logger.Info("Netrc file:", conf.NetrcPath, ".")
+	}
+
+	if _, err := loadNetrc(conf.NetrcPath); err != nil {
+		return err
+	}
+
+	// Resolving the repositories validates the SSH options and the SSH
+	// client configuration file.
+	for _, dstRepo := range conf.DstRepos {
+		if _, err := resolveSSHRepo(conf, conf.SSH, dstRepo); err != nil {
+			return err
+		}
+	}
+
+	if _, err := resolveSSHRepo(conf, conf.SrcSSH, conf.SrcRepo); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	if !conf.SSH.hasAuth() && !conf.HTTP.hasAuth() &&
+		len(conf.HTTP.CredentialHelper) == 0 {
 		logger.Warn("Tool configured with no authentication.")
-	} else {
-		if len(conf.GetKnownHosts()) != 0 &&
-			len(conf.GetKnownHostsPath()) != 0 {
-			return ErrHostKey
-		} else if len(conf.GetKnownHosts()) == 0 &&
-			len(conf.GetKnownHostsPath()) == 0 {
-			return ErrNoHostKey
+	} else if conf.SSH.hasAuth() {
+		if err := conf.SSH.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := conf.HTTP.validate(); err != nil {
+		return err
+	}
+
+	for _, dstRepo := range conf.DstRepos {
+		if err := checkAuthScheme(dstRepo, conf.SSH, conf.HTTP); err != nil {
+			return err
+		}
+	}
+
+	if err := checkAuthScheme(conf.SrcRepo, conf.SrcSSH, conf.SrcHTTP); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	if conf.SrcSSH.hasAuth() {
+		if err := conf.SrcSSH.validate(); err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+	}
+
+	if err := conf.Proxy.validate(); err != nil {
+		return err
+	}
+
+	if err := conf.TLS.validate(logger); err != nil {
+		return err
+	}
+
+	if err := conf.Retry.validate(logger); err != nil {
+		return err
+	}
+
+	if err := conf.SSH.Bastion.validate(); err != nil {
+		return err
+	}
+
+	if err := conf.SrcSSH.Bastion.validate(); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	if err := conf.SrcHTTP.validate(); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	return nil
+}
+
+// checkAuthScheme checks that a repository can be authenticated with the
+// provided authentication configuration. The authentication is picked based
+// on the repository URL scheme: HTTP for repositories accessed over HTTP(S)
+// and SSH otherwise. It is an error to only provide the authentication that
+// doesn't match the repository URL scheme.
+func checkAuthScheme(repo string, sshConf SSHConf, httpConf HTTPConf) error {
+	hasSSH := sshConf.hasAuth()
+	hasHTTP := httpConf.hasAuth()
+
+	if isHTTPRepo(repo) {
+		if hasSSH && !hasHTTP {
+			return fmt.Errorf("%w: SSH authentication configured for the HTTP "+
+				"repository %s", ErrAuthMismatch, RedactURL(repo))
 		}
+	} else if hasHTTP && !hasSSH {
+		return fmt.Errorf("%w: HTTP authentication configured for the non-HTTP "+
+			"repository %s", ErrAuthMismatch, RedactURL(repo))
 	}
 
 	return nil
 }
+
+// hasAuth reports whether an SSH configuration provides authentication, either
+// with a private key or with the SSH agent.
+func (sshConf SSHConf) hasAuth() bool {
+	return sshConf.hasPrivateKey() || sshConf.Agent
+}
+
+// hasPrivateKey reports whether an SSH configuration provides a private key,
+// either by content or by file path.
+func (sshConf SSHConf) hasPrivateKey() bool {
+	return len(sshConf.PrivateKey) != 0 || len(sshConf.PrivateKeyPath) != 0
+}
+
+// validate checks an SSH configuration providing authentication. The host
+// public keys are required with both a private key and the SSH agent. An
+// encrypted private key is decrypted to detect a missing or wrong passphrase
+// early.
+func (sshConf SSHConf) validate() error {
+	if len(sshConf.KnownHosts) != 0 && len(sshConf.KnownHostsPath) != 0 {
+		return ErrHostKey
+	} else if len(sshConf.KnownHosts) == 0 && len(sshConf.KnownHostsPath) == 0 {
+		return ErrNoHostKey
+	}
+
+	if sshConf.Agent {
+		if sshConf.hasPrivateKey() {
+			return ErrAgentKey
+		}
+
+		if len(sshConf.AgentSocket) == 0 {
+			return ErrNoAgentSocket
+		}
+
+		return nil
+	}
+
+	if len(sshConf.PrivateKey) != 0 && len(sshConf.PrivateKeyPath) != 0 {
+		return ErrPrivateKey
+	}
+
+	if len(sshConf.Passphrase) != 0 && len(sshConf.PassphrasePath) != 0 {
+		return ErrPassphrase
+	}
+
+	privateKey, err := sshConf.getPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := sshConf.getPassphrase()
+	if err != nil {
+		return err
+	}
+
+	return checkSSHKeyPassphrase(privateKey, passphrase)
+}
+
+// getPrivateKey returns the SSH private key provided either by content or by
+// file path.
+func (sshConf SSHConf) getPrivateKey() (string, error) {
+	if len(sshConf.PrivateKeyPath) == 0 {
+		return sshConf.PrivateKey, nil
+	}
+
+	privateKey, err := os.ReadFile(sshConf.PrivateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the SSH private key: %w", err)
+	}
+
+	return string(privateKey), nil
+}
+
+// getPassphrase returns the SSH private key passphrase provided either by
+// content or by file path. The trailing newline characters of the file are
+// not part of the passphrase.
+func (sshConf SSHConf) getPassphrase() (string, error) {
+	if len(sshConf.PassphrasePath) == 0 {
+		return sshConf.Passphrase, nil
+	}
+
+	passphrase, err := readSecretFile(sshConf.PassphrasePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the SSH private key passphrase: %w",
+			err)
+	}
+
+	return passphrase, nil
+}
+
+// validate checks a bastion configuration. An encrypted bastion private key is
+// decrypted with the bastion passphrase to detect a missing or wrong
+// passphrase early.
+func (bastionConf BastionConf) validate() error {
+	if len(bastionConf.Host) == 0 {
+		if bastionConf != (BastionConf{}) {
+			return fmt.Errorf("%w: no host provided", ErrBastionHost)
+		}
+
+		return nil
+	}
+
+	if _, err := bastionConf.addr(); err != nil {
+		return err
+	}
+
+	if len(bastionConf.PrivateKey) != 0 && len(bastionConf.PrivateKeyPath) != 0 {
+		return ErrBastionPrivateKey
+	}
+
+	if len(bastionConf.KnownHosts) != 0 && len(bastionConf.KnownHostsPath) != 0 {
+		return ErrBastionHostKey
+	}
+
+	if len(bastionConf.Passphrase) != 0 && len(bastionConf.PassphrasePath) != 0 {
+		return ErrBastionPassphrase
+	}
+
+	if !bastionConf.hasPrivateKey() {
+		return nil
+	}
+
+	privateKey, err := bastionConf.getPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := bastionConf.getPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := checkSSHKeyPassphrase(privateKey, passphrase); err != nil {
+		return fmt.Errorf("SSH bastion: %w", err)
+	}
+
+	return nil
+}
+
+// addr returns the address of the bastion. The port defaults to the SSH one.
+func (bastionConf BastionConf) addr() (string, error) {
+	host, port, err := net.SplitHostPort(bastionConf.Host)
+	if err != nil {
+		host, port = strings.Trim(bastionConf.Host, "[]"), strconv.Itoa(defaultSSHPort)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if len(host) == 0 || strings.ContainsAny(host, "@/") || err != nil ||
+		portNumber < 1 || portNumber > maxPort {
+		return "", fmt.Errorf("%w: %q is not in the 'host[:port]' format",
+			ErrBastionHost, bastionConf.Host)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// hasPrivateKey reports whether a bastion configuration provides a private
+// key, either by content or by file path.
+func (bastionConf BastionConf) hasPrivateKey() bool {
+	return len(bastionConf.PrivateKey) != 0 ||
+		len(bastionConf.PrivateKeyPath) != 0
+}
+
+// getPrivateKey returns the bastion private key provided either by content or
+// by file path.
+func (bastionConf BastionConf) getPrivateKey() (string, error) {
+	if len(bastionConf.PrivateKeyPath) == 0 {
+		return bastionConf.PrivateKey, nil
+	}
+
+	privateKey, err := os.ReadFile(bastionConf.PrivateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the SSH bastion private key: %w",
+			err)
+	}
+
+	return string(privateKey), nil
+}
+
+// getPassphrase returns the bastion private key passphrase provided either by
+// content or by file path. The trailing newline characters of the file are
+// not part of the passphrase.
+func (bastionConf BastionConf) getPassphrase() (string, error) {
+	if len(bastionConf.PassphrasePath) == 0 {
+		return bastionConf.Passphrase, nil
+	}
+
+	passphrase, err := readSecretFile(bastionConf.PassphrasePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the SSH bastion private key "+
+			"passphrase: %w", err)
+	}
+
+	return passphrase, nil
+}
+
+// hasAuth reports whether an HTTP configuration provides authentication,
+// either with a token or with a GitHub App.
+func (httpConf HTTPConf) hasAuth() bool {
+	return httpConf.hasToken() || httpConf.GitHubApp.isSet()
+}
+
+// hasToken reports whether an HTTP configuration provides a token, either by
+// content or by file path.
+func (httpConf HTTPConf) hasToken() bool {
+	return len(httpConf.Token) != 0 || len(httpConf.TokenPath) != 0
+}
+
+// validate checks an HTTP configuration. The token file, if any, needs to be
+// readable, the GitHub App, if any, needs to be fully configured and the git
+// credential helper, if any, needs to be found.
+func (httpConf HTTPConf) validate() error {
+	if len(httpConf.Token) != 0 && len(httpConf.TokenPath) != 0 {
+		return ErrToken
+	}
+
+	if httpConf.hasToken() && httpConf.GitHubApp.isSet() {
+		return fmt.Errorf("%w: both an HTTP token and a GitHub App provided",
+			ErrGitHubApp)
+	}
+
+	if err := httpConf.GitHubApp.validate(); err != nil {
+		return err
+	}
+
+	if len(httpConf.CredentialHelper) != 0 {
+		if err := checkCredentialHelper(httpConf.CredentialHelper); err != nil {
+			return err
+		}
+	}
+
+	_, err := httpConf.getToken()
+
+	return err
+}
+
+// getToken returns the HTTP token provided either by content or by file path.
+// The trailing newline characters of the file are not part of the token.
+func (httpConf HTTPConf) getToken() (string, error) {
+	if len(httpConf.TokenPath) == 0 {
+		return httpConf.Token, nil
+	}
+
+	token, err := readSecretFile(httpConf.TokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the HTTP token: %w", err)
+	}
+
+	return token, nil
+}
+
+// readSecretFile returns the content of a file providing a secret without the
+// trailing newline characters.
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
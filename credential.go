@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// credentialHelperTimeout bounds the run of a credential helper.
+const credentialHelperTimeout = time.Minute
+
+var ErrCredentialHelper = errors.New("git credential helper failed")
+
+// credential structure holds the attributes of the git credential helper
+// protocol.
+type credential struct {
+	protocol string
+	host     string
+	username string
+	password string
+}
+
+// encode returns a credential in the git credential helper protocol format.
+func (c credential) encode() []byte {
+	var buf bytes.Buffer
+
+	for _, attr := range [][2]string{
+		{"protocol", c.protocol},
+		{"host", c.host},
+		{"username", c.username},
+		{"password", c.password},
+	} {
+		if len(attr[1]) != 0 {
+			fmt.Fprintf(&buf, "%s=%s\n", attr[0], attr[1])
+		}
+	}
+
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+// credentialHelperCommand returns the shell command of a git credential
+// helper. Like for git, a helper starting with '!' is a shell snippet, an
+// absolute path is run as it is and a name is run as 'git-credential-<name>'.
+func credentialHelperCommand(helper string) string {
+	fields := strings.Fields(helper)
+
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		return helper[1:]
+	case len(fields) != 0 && filepath.IsAbs(fields[0]):
+		return helper
+	default:
+		return "git-credential-" + helper
+	}
+}
+
+// checkCredentialHelper checks that the executable of a git credential helper
+// can be found. The shell snippets are not checked.
+func checkCredentialHelper(helper string) error {
+	if len(strings.Fields(helper)) == 0 {
+		return fmt.Errorf("%w: empty helper", ErrCredentialHelper)
+	}
+
+	if strings.HasPrefix(helper, "!") {
+		return nil
+	}
+
+	executable := strings.Fields(credentialHelperCommand(helper))[0]
+	if _, err := exec.LookPath(executable); err != nil {
+		return fmt.Errorf("%w: %s", ErrCredentialHelper, err.Error())
+	}
+
+	return nil
+}
+
+// runCredentialHelper runs a git credential helper action ('get', 'store' or
+// 'erase') with a credential as input and returns its output.
+func runCredentialHelper(helper, action string, c credential) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		credentialHelperTimeout)
+	defer cancel()
+
+	command := credentialHelperCommand(helper)
+
+	// The action is passed as argument of the helper the same way git does.
+	cmd := exec.CommandContext(ctx, "sh", "-c", command+` "$@"`, command,
+		action)
+	cmd.Stdin = bytes.NewReader(c.encode())
+
+	var stderr bytes.Buffer
+
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s: %s", ErrCredentialHelper, action,
+			err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// fillCredential asks a git credential helper for the user name and the
+// password of a credential. The credential is returned unchanged when the
+// helper doesn't provide them.
+func fillCredential(helper string, c credential) (credential, error) {
+	out, err := runCredentialHelper(helper, "get", c)
+	if err != nil {
+		return c, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "username":
+			c.username = value
+		case "password":
+			c.password = value
+		case "quit":
+			if value == "1" || value == "true" {
+				return c, fmt.Errorf("%w: the helper asked to stop",
+					ErrCredentialHelper)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// credentialAuth is an HTTP basic authentication method with credentials
+// obtained from a git credential helper. The helper is told if the
+// credentials worked (approve) or not (reject).
+type credentialAuth struct {
+	*http.BasicAuth
+	helper     string
+	credential credential
+}
+
+// newCredentialAuth returns the HTTP authentication method of a repository
+// using the credentials from a git credential helper. A nil authentication
+// method is returned when the helper has no credentials for the repository.
+func newCredentialAuth(helper, repo, username string) (*credentialAuth, error) {
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+
+	host := endpoint.Host
+	if endpoint.Port != 0 {
+		host = fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	}
+
+	c, err := fillCredential(helper, credential{
+		protocol: endpoint.Protocol,
+		host:     host,
+		username: username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.password) == 0 {
+		return nil, nil
+	}
+
+	if len(c.username) == 0 {
+		c.username = defaultHTTPUsername
+	}
+
+	return &credentialAuth{
+		BasicAuth: &http.BasicAuth{
+			Username: c.username,
+			Password: c.password,
+		},
+		helper:     helper,
+		credential: c,
+	}, nil
+}
+
+// settleCredential tells the git credential helper, if any, the outcome of
+// using its credentials. The credentials are approved when the remote
+// operation succeeded and rejected when they were refused. Other failures
+// don't tell anything about the credentials. Failing to notify the helper is
+// logged but doesn't fail the mirroring.
+func settleCredential(conf Config, logger *Logger, auth transport.AuthMethod, err error) {
+	credAuth, ok := auth.(*credentialAuth)
+	if !ok {
+		return
+	}
+
+	action := "store"
+
+	switch {
+	case err == nil:
+	case errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed):
+		action = "erase"
+	default:
+		return
+	}
+
+	logger.Debug(conf.Debug, "Running the git credential helper", action,
+		"for", credAuth.credential.host, ".")
+
+	if _, err := runCredentialHelper(credAuth.helper, action,
+		credAuth.credential); err != nil {
+		logger.Warn(err)
+	}
+}
@@ -0,0 +1,232 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// writeTestCredentialHelper writes a git credential helper logging its
+// actions with their input to a file. The 'get' action prints the provided
+// output. It returns the path of the helper and of its log.
+func writeTestCredentialHelper(t *testing.T, dir, output string) (string, string) {
+	t.Helper()
+
+	logPath := path.Join(dir, "helper.log")
+	helperPath := path.Join(dir, "helper")
+
+	script := fmt.Sprintf(`#!/bin/sh
+input=$(cat)
+printf '%%s\n%%s\n' "$1" "$input" >> %s
+if [ "$1" = get ]; then
+	printf '%s'
+fi
+`, logPath, output)
+
+	if err := os.WriteFile(helperPath, []byte(script), 0o700); err != nil {
+		t.Fatalf("failed to write the credential helper: %s", err)
+	}
+
+	return helperPath, logPath
+}
+
+// readTestLog returns the content of a log file.
+func readTestLog(t *testing.T, logPath string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("failed to read %s: %s", logPath, err)
+	}
+
+	return string(content)
+}
+
+// TestCredentialHelperCommand tests the commands run for the git credential
+// helpers.
+func TestCredentialHelperCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		helper  string
+		command string
+	}{
+		{"store", "git-credential-store"},
+		{"store --file /tmp/creds", "git-credential-store --file /tmp/creds"},
+		{"/usr/bin/helper --option", "/usr/bin/helper --option"},
+		{"!f() { echo password=secret; }; f", "f() { echo password=secret; }; f"},
+	} {
+		if command := credentialHelperCommand(test.helper); command != test.command {
+			t.Fatalf("unexpected command for %s: %s", test.helper, command)
+		}
+	}
+
+	if err := checkCredentialHelper("/invalid/helper"); !errors.Is(err,
+		ErrCredentialHelper) {
+		t.Fatal("missing credential helper was allowed")
+	}
+
+	if err := checkCredentialHelper(" "); !errors.Is(err, ErrCredentialHelper) {
+		t.Fatal("empty credential helper was allowed")
+	}
+
+	if err := checkCredentialHelper("!anything"); err != nil {
+		t.Fatalf("shell credential helper was not allowed: %s", err)
+	}
+}
+
+// TestNewCredentialAuth tests obtaining credentials from a git credential
+// helper.
+func TestNewCredentialAuth(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{
+		helperDir := path.Join(dir, "fill")
+		if err := os.Mkdir(helperDir, 0o700); err != nil {
+			t.Fatalf("failed to create a directory: %s", err)
+		}
+
+		helper, logPath := writeTestCredentialHelper(t, helperDir,
+			"username=helperuser\\npassword=secret\\n")
+
+		auth, err := newCredentialAuth(helper,
+			"https://git.example.com:8443/team/repo.git", "user")
+		if err != nil {
+			t.Fatalf("failed to get credentials from the helper: %s", err)
+		}
+
+		if auth == nil || auth.Username != "helperuser" ||
+			auth.Password != "secret" {
+			t.Fatalf("unexpected credentials: %+v", auth)
+		}
+
+		if log := readTestLog(t, logPath); log != "get\nprotocol=https\n"+
+			"host=git.example.com:8443\nusername=user\n" {
+			t.Fatalf("unexpected credential helper input: %q", log)
+		}
+	}
+	{
+		// The helper is also run as a shell snippet.
+		auth, err := newCredentialAuth("!printf 'password=secret\\n'",
+			"https://git.example.com/team/repo.git", "")
+		if err != nil || auth == nil || auth.Username != defaultHTTPUsername ||
+			auth.Password != "secret" {
+			t.Fatalf("unexpected shell helper credentials: %+v, %v", auth, err)
+		}
+	}
+	{
+		// No credentials.
+		auth, err := newCredentialAuth("!true",
+			"https://git.example.com/team/repo.git", "")
+		if err != nil || auth != nil {
+			t.Fatalf("unexpected credentials: %+v, %v", auth, err)
+		}
+	}
+
+	for _, helper := range []string{
+		// Failing helper.
+		"!echo failure >&2; false",
+		// Helper asking to stop.
+		"!printf 'quit=1\\n'",
+	} {
+		_, err := newCredentialAuth(helper,
+			"https://git.example.com/team/repo.git", "")
+		if !errors.Is(err, ErrCredentialHelper) {
+			t.Fatalf("credential helper error was not reported: %s", helper)
+		}
+	}
+}
+
+// TestSettleCredential tests telling the git credential helper whether its
+// credentials worked.
+func TestSettleCredential(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	helper, logPath := writeTestCredentialHelper(t, dir,
+		"username=user\\npassword=secret\\n")
+
+	auth, err := newCredentialAuth(helper,
+		"https://git.example.com/team/repo.git", "")
+	if err != nil || auth == nil {
+		t.Fatalf("failed to get credentials from the helper: %v", err)
+	}
+
+	credentials := "protocol=https\nhost=git.example.com\nusername=user\n" +
+		"password=secret\n"
+
+	// The credentials are approved on success.
+	settleCredential(Config{}, logger, auth, nil)
+
+	log := readTestLog(t, logPath)
+	if !strings.HasSuffix(log, "store\n"+credentials) {
+		t.Fatalf("credentials were not approved: %q", log)
+	}
+
+	// Other errors don't tell anything about the credentials.
+	settleCredential(Config{}, logger, auth, errors.New("network failure"))
+
+	if readTestLog(t, logPath) != log {
+		t.Fatal("credential helper was run for an unrelated error")
+	}
+
+	// The credentials are rejected when refused by the remote.
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+	defer srv.Close()
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: dstRemoteName,
+		URLs: []string{srv.URL + "/team/repo.git"},
+	})
+
+	_, err = listRemote(context.Background(), remote, auth)
+	if !errors.Is(err, transport.ErrAuthenticationRequired) {
+		t.Fatalf("unexpected error for refused credentials: %v", err)
+	}
+
+	settleCredential(Config{}, logger, auth, phaseError(PhaseList, err))
+
+	if log := readTestLog(t, logPath); !strings.HasSuffix(log,
+		"erase\n"+credentials) {
+		t.Fatalf("credentials were not rejected: %q", log)
+	}
+
+	// Other authentication methods are ignored.
+	settleCredential(Config{}, logger, &githttp.BasicAuth{}, nil)
+}
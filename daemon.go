@@ -0,0 +1,377 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default daemon configuration values.
+const (
+	DefaultWorkers         = 4
+	DefaultShutdownTimeout = 5 * time.Minute
+	DefaultWebhookDebounce = 5 * time.Second
+)
+
+// Timeouts of the HTTP server.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverShutdownTimeout   = 10 * time.Second
+)
+
+var (
+	ErrDaemon          = errors.New("invalid daemon configuration")
+	ErrShutdownTimeout = errors.New("in-flight jobs cancelled on shutdown")
+)
+
+// DaemonConf structure defines the configuration of the daemon mode.
+type DaemonConf struct {
+	// Workers is the maximum number of jobs running concurrently.
+	Workers int
+	// ShutdownTimeout is how long the in-flight jobs are given to finish on
+	// shutdown before they are cancelled.
+	ShutdownTimeout time.Duration
+	// Listen is the 'host:port' address of the HTTP server receiving the
+	// webhooks and serving the metrics. No HTTP server runs when empty.
+	Listen string
+	// WebhookSecret, or the content of the file at WebhookSecretPath, is the
+	// secret verifying the webhooks. The webhooks are disabled without one.
+	WebhookSecret     string
+	WebhookSecretPath string
+	// WebhookDebounce is how long the pushes to a repository are collected
+	// into a single run of its jobs.
+	WebhookDebounce time.Duration
+}
+
+// ProcessEnv fallbacks to the environment variables for the webhook secret.
+func (conf *DaemonConf) ProcessEnv(env map[string]string) {
+	if len(conf.WebhookSecret) == 0 {
+		conf.WebhookSecret = env["GMM_WEBHOOK_SECRET"]
+	}
+
+	if len(conf.WebhookSecretPath) == 0 {
+		conf.WebhookSecretPath = env["GMM_WEBHOOK_SECRET_FILE"]
+	}
+}
+
+// daemonJob holds the state of a job in daemon mode. A job is queued at most
+// once and a job triggered while running is queued again when its run
+// finishes so that the runs of a job never overlap.
+type daemonJob struct {
+	job      Job
+	schedule schedule
+	// repoKey identifies the source repository in the webhooks.
+	repoKey    string
+	queued     bool
+	running    bool
+	pending    bool
+	debouncing bool
+}
+
+// Daemon runs mirroring jobs on their schedules until it is stopped.
+type Daemon struct {
+	conf   DaemonConf
+	logger *Logger
+	jobs   []*daemonJob
+	// metrics holds the metrics of the job runs.
+	metrics *metrics
+
+	// run runs a job. It is replaceable for testing.
+	run func(ctx context.Context, job Job, logger *Logger) JobResult
+
+	mu      sync.Mutex
+	queue   chan *daemonJob
+	stopped bool
+}
+
+// NewDaemon returns a daemon running the provided jobs. The zero values of
+// the daemon configuration are replaced by their defaults.
+func NewDaemon(jobs []Job, conf DaemonConf, logger *Logger) (*Daemon, error) {
+	if conf.Workers < 0 || conf.ShutdownTimeout < 0 ||
+		conf.WebhookDebounce < 0 {
+		return nil, fmt.Errorf("%w: negative workers, shutdown timeout or "+
+			"webhook debounce", ErrDaemon)
+	}
+
+	if len(conf.WebhookSecret) != 0 && len(conf.WebhookSecretPath) != 0 {
+		return nil, fmt.Errorf("%w: webhook secret provided via both "+
+			"content and file", ErrDaemon)
+	}
+
+	if len(conf.WebhookSecretPath) != 0 {
+		secret, err := readSecretFile(conf.WebhookSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read the webhook secret: %s",
+				ErrDaemon, err.Error())
+		}
+
+		conf.WebhookSecret = secret
+		conf.WebhookSecretPath = ""
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = DefaultWorkers
+	}
+
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	if conf.WebhookDebounce == 0 {
+		conf.WebhookDebounce = DefaultWebhookDebounce
+	}
+
+	daemon := &Daemon{
+		conf:    conf,
+		logger:  logger,
+		jobs:    make([]*daemonJob, 0, len(jobs)),
+		metrics: newMetrics(jobs),
+		run:     RunJobContext,
+		// Each job is queued at most once so the queue never blocks.
+		queue: make(chan *daemonJob, len(jobs)),
+	}
+
+	for _, job := range jobs {
+		sched, err := job.Schedule.newSchedule()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrDaemon, job.Name,
+				err.Error())
+		}
+
+		if sched == nil && len(conf.WebhookSecret) == 0 {
+			logger.Warn("Job", job.Name, "has no schedule.")
+		}
+
+		daemon.jobs = append(daemon.jobs, &daemonJob{
+			job:      job,
+			schedule: sched,
+			repoKey:  repoKey(job.Config.SrcRepo),
+		})
+	}
+
+	return daemon, nil
+}
+
+// enqueue queues a run of a job. A job already queued isn't queued again and
+// a running job is queued again when its run finishes.
+func (d *Daemon) enqueue(dj *daemonJob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case d.stopped || dj.queued:
+	case dj.running:
+		dj.pending = true
+	default:
+		dj.queued = true
+		d.queue <- dj
+	}
+}
+
+// scheduleJob queues the runs of a job based on its schedule until the
+// context is done.
+func (d *Daemon) scheduleJob(ctx context.Context, dj *daemonJob) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	at := dj.schedule.first(time.Now())
+
+	for !at.IsZero() {
+		runAt := at.Add(dj.job.Schedule.jitter(rnd))
+		d.logger.Debug(dj.job.Config.Debug, "Next run of the", dj.job.Name,
+			"job at", runAt.Format(time.RFC3339), ".")
+
+		timer := time.NewTimer(time.Until(runAt))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		case <-timer.C:
+			d.enqueue(dj)
+		}
+
+		// Skip the runs missed while waiting (for example, when the host
+		// was suspended).
+		at = dj.schedule.next(at)
+		for !at.IsZero() && at.Before(time.Now()) {
+			at = dj.schedule.next(at)
+		}
+	}
+
+	d.logger.Warn("Job", dj.job.Name, "has no more scheduled runs.")
+}
+
+// work runs the queued jobs until the context is done.
+func (d *Daemon) work(ctx, runCtx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dj := <-d.queue:
+			// No new run starts once the context is done.
+			if ctx.Err() != nil {
+				return
+			}
+
+			d.mu.Lock()
+			dj.queued = false
+			dj.running = true
+			d.mu.Unlock()
+
+			d.metrics.start(dj.job.Name)
+			d.metrics.record(d.run(runCtx, dj.job, d.logger), time.Now())
+
+			d.mu.Lock()
+			dj.running = false
+
+			if dj.pending && !d.stopped {
+				dj.pending = false
+				dj.queued = true
+				d.queue <- dj
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// handler returns the handler of the HTTP server.
+func (d *Daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics)
+
+	if len(d.conf.WebhookSecret) != 0 {
+		mux.HandleFunc("/webhook", d.handleWebhook)
+	}
+
+	return mux
+}
+
+// serve runs the HTTP server until the context is done.
+func (d *Daemon) serve(ctx context.Context, listener net.Listener) {
+	server := &http.Server{
+		Handler:           d.handler(),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(),
+			serverShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			d.logger.Warn("Failed to shut down the HTTP server:", err)
+		}
+	}()
+
+	d.logger.Info("Listening on", listener.Addr(), ".")
+
+	if len(d.conf.WebhookSecret) == 0 {
+		d.logger.Warn("No webhook secret configured, the webhooks are " +
+			"disabled.")
+	}
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		d.logger.Error("HTTP server failed:", err)
+	}
+}
+
+// Run runs the jobs on their schedules, at most the configured number of
+// workers at a time, until the context is done. The runs of a job never
+// overlap. When the context is done, no new run starts and the in-flight
+// runs are given the configured shutdown timeout to finish before they are
+// cancelled, in which case ErrShutdownTimeout is returned. When configured,
+// the HTTP server receiving the webhooks and serving the metrics runs until
+// the context is done.
+func (d *Daemon) Run(ctx context.Context) error {
+	var server sync.WaitGroup
+
+	if len(d.conf.Listen) != 0 {
+		listener, err := net.Listen("tcp", d.conf.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		server.Add(1)
+
+		go func() {
+			defer server.Done()
+
+			d.serve(ctx, listener)
+		}()
+	}
+
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	defer cancelRuns()
+
+	var workers, schedulers sync.WaitGroup
+
+	for i := 0; i < d.conf.Workers; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			d.work(ctx, runCtx)
+		}()
+	}
+
+	for _, dj := range d.jobs {
+		if dj.schedule == nil {
+			continue
+		}
+
+		schedulers.Add(1)
+
+		go func(dj *daemonJob) {
+			defer schedulers.Done()
+
+			d.scheduleJob(ctx, dj)
+		}(dj)
+	}
+
+	d.logger.Info("Running", len(d.jobs), "jobs with", d.conf.Workers,
+		"workers.")
+
+	<-ctx.Done()
+
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+
+	schedulers.Wait()
+	server.Wait()
+
+	d.logger.Info("Shutting down, waiting for the in-flight jobs...")
+
+	done := make(chan struct{})
+
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(d.conf.ShutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		cancelRuns()
+		<-done
+
+		return ErrShutdownTimeout
+	}
+}
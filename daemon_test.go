@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRuns records the runs of a daemon's jobs.
+type testRuns struct {
+	mu sync.Mutex
+	// runs is the number of runs of each job.
+	runs map[string]int
+	// running is the number of running jobs.
+	running int
+	// maxRunning is the maximum number of jobs running at the same time.
+	maxRunning int
+	// overlaps is the number of runs overlapping another run of their job.
+	overlaps int
+	// cancelled is the number of runs cancelled.
+	cancelled int
+	active    map[string]bool
+}
+
+// run returns a job run function recording the runs and lasting the
+// provided duration unless cancelled.
+func (tr *testRuns) run(duration time.Duration) func(context.Context, Job, *Logger) JobResult {
+	return func(ctx context.Context, job Job, logger *Logger) JobResult {
+		tr.mu.Lock()
+		if tr.active[job.Name] {
+			tr.overlaps++
+		}
+		tr.active[job.Name] = true
+		tr.runs[job.Name]++
+		tr.running++
+		if tr.running > tr.maxRunning {
+			tr.maxRunning = tr.running
+		}
+		tr.mu.Unlock()
+
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			tr.mu.Lock()
+			tr.cancelled++
+			tr.mu.Unlock()
+		}
+
+		tr.mu.Lock()
+		tr.active[job.Name] = false
+		tr.running--
+		tr.mu.Unlock()
+
+		return JobResult{Job: job}
+	}
+}
+
+func newTestRuns() *testRuns {
+	return &testRuns{
+		runs:   make(map[string]int),
+		active: make(map[string]bool),
+	}
+}
+
+// TestNewDaemon tests creating daemons.
+func TestNewDaemon(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	daemon, err := NewDaemon([]Job{
+		{Name: "a", Schedule: ScheduleConf{Interval: time.Hour}},
+		{Name: "b", Schedule: ScheduleConf{Cron: "@daily"}},
+		{Name: "c"},
+	}, DaemonConf{}, logger)
+	if err != nil {
+		t.Fatalf("failed to create the daemon: %s", err)
+	}
+
+	if daemon.conf.Workers != DefaultWorkers ||
+		daemon.conf.ShutdownTimeout != DefaultShutdownTimeout {
+		t.Fatalf("unexpected daemon configuration: %+v", daemon.conf)
+	}
+
+	if len(daemon.jobs) != 3 || daemon.jobs[0].schedule == nil ||
+		daemon.jobs[1].schedule == nil || daemon.jobs[2].schedule != nil {
+		t.Fatalf("unexpected daemon jobs: %+v", daemon.jobs)
+	}
+
+	if _, err := NewDaemon(nil, DaemonConf{Workers: -1}, logger); !errors.Is(err,
+		ErrDaemon) {
+		t.Fatal("negative workers were allowed")
+	}
+
+	if _, err := NewDaemon([]Job{
+		{Name: "a", Schedule: ScheduleConf{Cron: "invalid"}},
+	}, DaemonConf{}, logger); !errors.Is(err, ErrDaemon) {
+		t.Fatal("invalid schedule was allowed")
+	}
+}
+
+// TestDaemonEnqueue tests queuing the runs of the jobs.
+func TestDaemonEnqueue(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	daemon, err := NewDaemon([]Job{{Name: "a"}}, DaemonConf{}, logger)
+	if err != nil {
+		t.Fatalf("failed to create the daemon: %s", err)
+	}
+
+	dj := daemon.jobs[0]
+
+	// A queued job isn't queued again.
+	daemon.enqueue(dj)
+	daemon.enqueue(dj)
+
+	if len(daemon.queue) != 1 || !dj.queued {
+		t.Fatal("unexpected queue")
+	}
+
+	// A running job is queued again when its run finishes.
+	<-daemon.queue
+	dj.queued = false
+	dj.running = true
+
+	daemon.enqueue(dj)
+
+	if len(daemon.queue) != 0 || !dj.pending {
+		t.Fatal("running job was queued")
+	}
+
+	// Nothing is queued once stopped.
+	dj.running = false
+	dj.pending = false
+	daemon.stopped = true
+
+	daemon.enqueue(dj)
+
+	if len(daemon.queue) != 0 || dj.queued {
+		t.Fatal("job queued once stopped")
+	}
+}
+
+// TestDaemonRun tests running jobs on their schedules.
+func TestDaemonRun(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	daemon, err := NewDaemon([]Job{
+		{Name: "a", Schedule: ScheduleConf{Interval: time.Millisecond}},
+		{Name: "b", Schedule: ScheduleConf{
+			Interval: time.Millisecond,
+			Jitter:   time.Millisecond,
+		}},
+		{Name: "c", Schedule: ScheduleConf{Interval: time.Millisecond}},
+		{Name: "unscheduled"},
+	}, DaemonConf{Workers: 2, ShutdownTimeout: time.Minute}, logger)
+	if err != nil {
+		t.Fatalf("failed to create the daemon: %s", err)
+	}
+
+	runs := newTestRuns()
+	daemon.run = runs.run(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	if err := daemon.Run(ctx); err != nil {
+		t.Fatalf("daemon failed: %s", err)
+	}
+
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+
+	if runs.runs["a"] == 0 || runs.runs["b"] == 0 || runs.runs["c"] == 0 ||
+		runs.runs["unscheduled"] != 0 {
+		t.Fatalf("unexpected runs: %v", runs.runs)
+	}
+
+	if runs.overlaps != 0 {
+		t.Fatalf("runs of the same job overlapped: %d", runs.overlaps)
+	}
+
+	if runs.maxRunning > 2 {
+		t.Fatalf("more jobs than workers ran at the same time: %d",
+			runs.maxRunning)
+	}
+
+	if runs.running != 0 || runs.cancelled != 0 {
+		t.Fatal("runs didn't finish on shutdown")
+	}
+}
+
+// TestDaemonShutdownTimeout tests cancelling the in-flight runs on shutdown.
+func TestDaemonShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	daemon, err := NewDaemon([]Job{
+		{Name: "a", Schedule: ScheduleConf{Interval: time.Hour}},
+	}, DaemonConf{ShutdownTimeout: 10 * time.Millisecond}, logger)
+	if err != nil {
+		t.Fatalf("failed to create the daemon: %s", err)
+	}
+
+	runs := newTestRuns()
+	daemon.run = runs.run(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	if err := daemon.Run(ctx); !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("in-flight run wasn't cancelled: %v", err)
+	}
+
+	runs.mu.Lock()
+	defer runs.mu.Unlock()
+
+	if runs.runs["a"] != 1 || runs.cancelled != 1 || runs.running != 0 {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+}
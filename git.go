@@ -5,32 +5,34 @@
 package mirror
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
 	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/go-git/go-git/v5/utils/ioutil"
 )
 
 const (
-	refsFilterPrefix       = "refs/pull"
-	srcRemoteName          = "src"
-	dstRemoteName          = "dst"
-	tmpKnownHostPathPrefix = "git-mirror-me-known_hosts-"
-	knownHostsPerm         = 0o600
+	srcRemoteName = "src"
+	dstRemoteName = "dst"
 )
 
-// FilterOutRefs takes a repository and removes references based on a slice of
-// prefixes.
-func filterOutRefs(repo *git.Repository, prefixes []string) error {
-	if len(prefixes) == 0 {
+// filterRefs takes a repository and removes the references that don't pass
+// the reference filter.
+func filterRefs(repo *git.Repository, filter refFilter) error {
+	if len(filter) == 0 {
 		return nil
 	}
 
@@ -40,14 +42,9 @@ func filterOutRefs(repo *git.Repository, prefixes []string) error {
 	}
 
 	if err = refs.ForEach(func(ref *plumbing.Reference) error {
-		name := ref.Name().String()
-		for _, prefix := range prefixes {
-			if strings.HasPrefix(name, prefix) {
-				if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
-					return fmt.Errorf("failed to remove reference: %w", err)
-				}
-
-				break
+		if isFilterable(ref.Name()) && !filter.match(ref.Name().String()) {
+			if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+				return fmt.Errorf("failed to remove reference: %w", err)
 			}
 		}
 
@@ -70,28 +67,52 @@ func refsToDeleteSpecs(refs []*plumbing.Reference) []config.RefSpec {
 	return specs
 }
 
-// extraRefs returns a slice of references that are in refs but not in the
-// repository.
-func extraRefs(repo *git.Repository, refs []*plumbing.Reference) ([]*plumbing.Reference, error) {
+// extraRefs returns a slice of references that are in refs but that have no
+// corresponding reference in the repository. The refs are destination
+// references and the reference mapping is used to find their source names
+// in the repository. References outside the namespace of the mapping or with
+// all their source names excluded by the reference filter are never
+// returned.
+func extraRefs(repo *git.Repository, refs []*plumbing.Reference, rc refsConf) ([]*plumbing.Reference, error) {
 	var retRefs []*plumbing.Reference
 
+	repoRefs, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get references: %w", err)
+	}
+
+	repoRefNames := make(map[plumbing.ReferenceName]bool)
+
+	_ = repoRefs.ForEach(func(repoRef *plumbing.Reference) error {
+		repoRefNames[repoRef.Name()] = true
+
+		return nil
+	})
+
 	for _, ref := range refs {
-		repoRefs, err := repo.References()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get references: %w", err)
+		// Only the references under refs/ are mirrored. HEAD, whether
+		// symbolic or detached, is never deleted.
+		if !isFilterable(ref.Name()) {
+			continue
 		}
 
-		found := false
+		mapped, found := false, false
 
-		_ = repoRefs.ForEach(func(repoRef *plumbing.Reference) error {
-			if repoRef.Name().String() == ref.Name().String() {
-				found = true
+		for _, srcName := range rc.mapping.srcNames(ref.Name()) {
+			if !rc.filter.match(srcName.String()) {
+				continue
 			}
 
-			return nil
-		})
+			mapped = true
 
-		if !found {
+			if repoRefNames[srcName] {
+				found = true
+
+				break
+			}
+		}
+
+		if mapped && !found {
 			retRefs = append(retRefs, ref)
 		}
 	}
@@ -101,8 +122,8 @@ func extraRefs(repo *git.Repository, refs []*plumbing.Reference) ([]*plumbing.Re
 
 // extraSpecs takes a repository and a slice of refs and returns the refs
 // that are not in the repository as a slice of delete refspecs.
-func extraSpecs(repo *git.Repository, refs []*plumbing.Reference) ([]config.RefSpec, error) {
-	diffRefs, err := extraRefs(repo, refs)
+func extraSpecs(repo *git.Repository, refs []*plumbing.Reference, rc refsConf) ([]config.RefSpec, error) {
+	diffRefs, err := extraRefs(repo, refs, rc)
 	if err != nil {
 		return nil, err
 	}
@@ -110,29 +131,31 @@ func extraSpecs(repo *git.Repository, refs []*plumbing.Reference) ([]config.RefS
 	return refsToDeleteSpecs(diffRefs), nil
 }
 
-// pruneRemote removes all the references in a remote that are not available in
-// the repo.
-func pruneRemote(conf Config, logger *Logger, remote *git.Remote, auth transport.AuthMethod, repo *git.Repository) error {
-	refs, err := remote.List(&git.ListOptions{
-		Auth: auth,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to list the destination remote: %w", err)
+// pruneRemote deletes the references of a remote that the updates plan for
+// deletion. Only the remote references inside the namespace of the reference
+// mapping and passing the reference filter are planned for deletion so that
+// references not managed by the mirroring are left untouched.
+func pruneRemote(ctx context.Context, conf Config, logger *Logger, remote *git.Remote, auth transport.AuthMethod, updates []RefUpdate) error {
+	var deleteRefs []*plumbing.Reference
+
+	for _, update := range updates {
+		if update.Action == RefDeleted {
+			deleteRefs = append(deleteRefs,
+				plumbing.NewHashReference(update.Name, update.Old))
+		}
 	}
 
-	deleteRefs, _ := extraRefs(repo, refs)
-
 	deleteSpecs := refsToDeleteSpecs(deleteRefs)
 
 	if len(deleteSpecs) > 0 {
 		logger.Debug(conf.Debug, "Pruning the following refs:", deleteRefs)
 
-		err := remote.Push(&git.PushOptions{
+		err := remote.PushContext(ctx, &git.PushOptions{
 			RemoteName: remote.Config().Name,
 			Auth:       auth,
 			RefSpecs:   deleteSpecs,
 		})
-		if err != nil && errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 			return fmt.Errorf("failed to prune destination: %w", err)
 		}
 	} else {
@@ -142,152 +165,501 @@ func pruneRemote(conf Config, logger *Logger, remote *git.Remote, auth transport
 	return nil
 }
 
-// setupStagingRepo initialises an in-memory git repositry populated with the
-// source's references.
-func setupStagingRepo(conf Config, logger *Logger) (*git.Repository, error) {
+// advertisedRefs returns the references advertised by a remote, sorted by
+// name. Unlike the references git.Remote.List returns, HEAD doesn't need to
+// point to a branch: a detached HEAD, which is advertised without its
+// symbolic target, is returned as a hash reference.
+func advertisedRefs(ar *packp.AdvRefs) []*plumbing.Reference {
+	refs := make([]*plumbing.Reference, 0, len(ar.References)+1)
+	for name, hash := range ar.References {
+		refs = append(refs, plumbing.NewHashReference(
+			plumbing.ReferenceName(name), hash))
+	}
+
+	if ar.Head != nil {
+		head := plumbing.NewHashReference(plumbing.HEAD, *ar.Head)
+
+		for _, symref := range ar.Capabilities.Get(capability.SymRef) {
+			if parts := strings.SplitN(symref, ":", 2); len(parts) == 2 &&
+				parts[0] == plumbing.HEAD.String() {
+				head = plumbing.NewSymbolicReference(plumbing.HEAD,
+					plumbing.ReferenceName(parts[1]))
+			}
+		}
+
+		refs = append(refs, head)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name() < refs[j].Name()
+	})
+
+	return refs
+}
+
+// listRemote lists the references of a remote. An empty remote has no
+// references.
+func listRemote(ctx context.Context, remote *git.Remote, auth transport.AuthMethod) (refs []*plumbing.Reference, err error) {
+	ep, err := transport.NewEndpoint(remote.Config().URLs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ioutil.CheckClose(session, &err)
+
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return advertisedRefs(ar), nil
+}
+
+// setupStagingRepo initialises a git repositry populated with the source's
+// references. The staging repository is stored in memory unless a cache
+// directory is configured. In that case, the cached staging repository is
+// fetched incrementally and the references deleted in the source are removed
+// from it.
+func setupStagingRepo(ctx context.Context, conf Config, logger *Logger) (*git.Repository, error) {
+	var (
+		repo *git.Repository
+		err  error
+	)
+
 	// Setup a working repository.
-	logger.Info("Setting up a staging git repository.")
+	if len(conf.CacheDir) == 0 {
+		logger.Info("Setting up a staging git repository.")
+
+		repo, err = git.Init(memory.NewStorage(), nil)
+	} else {
+		logger.Info("Setting up a staging git repository in",
+			cachePath(conf), ".")
+
+		repo, err = openCacheRepo(conf)
+	}
 
-	repo, err := git.Init(memory.NewStorage(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed initialising staging git repository: %w",
 			err)
 	}
 
-	// Set up the source remote.
-	src, err := repo.CreateRemote(&config.RemoteConfig{
-		Name: srcRemoteName,
-		URLs: []string{conf.SrcRepo},
+	// Setting up the authentication can reach remote services (for example,
+	// the GitHub API for the GitHub App installation tokens).
+	var (
+		srcURL  string
+		auth    transport.AuthMethod
+		cleanup func()
+	)
+
+	err = retry(ctx, conf.Retry, logger, "Setting up the source "+
+		"authentication", func() error {
+		var authErr error
+		srcURL, auth, cleanup, authErr = newSrcAuth(ctx, conf, logger)
+
+		return authErr
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed configuring source remote: %w", err)
+		return nil, err
 	}
 
-	// Fetch the source.
-	logger.Info("Fetching all refs from", conf.SrcRepo, "...")
+	defer cleanup()
+
+	// Set up the source remote. The remote is not registered in the staging
+	// repository configuration as a cached staging repository is reused.
+	src := git.NewRemote(repo.Storer, &config.RemoteConfig{
+		Name: srcRemoteName,
+		URLs: []string{srcURL},
+	})
+
+	// Fetch the source. The references advertised to the fetch are the
+	// ones the cached staging repository is pruned against.
+	logger.Info("Fetching all refs from", RedactURL(conf.SrcRepo), "...")
+
+	var advertised refsRecorder
+
+	fetchCtx := withAdvertisedRefs(ctx, &advertised)
+
+	err = retry(ctx, conf.Retry, logger, "Fetching the source", func() error {
+		return countAttempt(fetchCtx, func(ctx context.Context) error {
+			err := src.FetchContext(ctx, &git.FetchOptions{
+				RemoteName: srcRemoteName,
+				Auth:       auth,
+				RefSpecs:   []config.RefSpec{"+refs/*:refs/*"},
+			})
+			if errors.Is(err, git.NoErrAlreadyUpToDate) {
+				return nil
+			}
+
+			return err
+		})
+	})
+
+	settleCredential(conf, logger, auth, err)
 
-	if err := src.Fetch(&git.FetchOptions{
-		RemoteName: srcRemoteName,
-		RefSpecs:   []config.RefSpec{"refs/*:refs/*"},
-	}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+	if err != nil {
 		return nil, fmt.Errorf("failed to fetch source remote: %w", err)
 	}
 
+	if srcRefs, ok := advertised.get(); ok && len(conf.CacheDir) != 0 {
+		if err := pruneCacheRefs(repo, srcRefs); err != nil {
+			return nil, fmt.Errorf("failed to prune the staging cache: %w", err)
+		}
+	}
+
 	return repo, nil
 }
 
-// pushWithAuth sets authentication based on configuration and pushes all
-// references to the configured destination repository (as a mirror).
-func pushWithAuth(conf Config, logger *Logger, stagingRepo *git.Repository) error {
-	var auth transport.AuthMethod
+// pushRemote pushes all the references of the staging repository to a remote
+// (as a mirror) based on the reference mapping.
+func pushRemote(ctx context.Context, logger *Logger, remote *git.Remote, auth transport.AuthMethod, rc refsConf) error {
+	dstRepo := RedactURL(remote.Config().URLs[0])
 
-	// Set up the public host key.
-	//
-	// The host public keys can be provided via both content and path. When
-	// it is provided via content, we need to use a temporary known_hosts
-	// file.
-	knownHostsPath := conf.GetKnownHostsPath()
+	logger.Info("Pushing to", dstRepo, "destination...")
 
-	if len(conf.SSH.KnownHosts) != 0 {
-		knownHostsFile, err := ioutil.TempFile("/tmp", tmpKnownHostPathPrefix)
-		if err != nil {
-			return fmt.Errorf("error creating known_hosts tmp file: %w", err)
+	err := remote.PushContext(ctx, &git.PushOptions{
+		RemoteName: remote.Config().Name,
+		Auth:       auth,
+		RefSpecs:   rc.mapping.pushSpecs(),
+		Force:      true,
+		Prune:      false, // https://github.com/go-git/go-git/issues/520
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, git.NoErrAlreadyUpToDate):
+			logger.Info("Destination", dstRepo, "already up to date.")
+		default:
+			return fmt.Errorf("failed to push to destination: %w", err)
 		}
+	} else {
+		logger.Info("Successfully mirrored pushed to", dstRepo,
+			"destination repository.")
+	}
 
-		defer func() {
-			knownHostsFile.Close()
-			os.Remove(knownHostsFile.Name())
-		}()
-
-		knownHostsPath = knownHostsFile.Name()
+	return nil
+}
 
-		err = os.WriteFile(knownHostsPath, []byte(conf.SSH.KnownHosts), knownHostsPerm)
-		if err != nil {
-			return fmt.Errorf("error writing known_hosts tmp file: %w", err)
-		}
+// mirrorDst sets authentication based on configuration and mirrors the
+// staging repository to a destination repository. The destination is listed
+// first to plan the reference updates. In dry-run mode, nothing else is done.
+func mirrorDst(ctx context.Context, conf Config, logger *Logger, stagingRepo *git.Repository, dstRepo string, rc refsConf) DstResult {
+	result := DstResult{
+		Repo:      dstRepo,
+		Durations: make(map[Phase]time.Duration),
 	}
 
-	// Set up SSH authentication.
-	if len(conf.SSH.PrivateKey) > 0 {
-		logger.Debug(conf.Debug, "Using SSH authentication.")
+	var err error
 
-		sshKeys, err := ssh.NewPublicKeys("git", []byte(conf.SSH.PrivateKey), "")
-		if err != nil {
-			return fmt.Errorf("failed to setup the SSH key: %w", err)
+	// The on-disk storage of a cached staging repository can't be shared by
+	// concurrent pushes so each destination uses its own instance.
+	if len(conf.CacheDir) != 0 {
+		stagingRepo, err = git.PlainOpen(cachePath(conf))
+		if err == nil {
+			stagingRepo, err = filterCacheRepo(stagingRepo, rc.filter)
 		}
 
-		hostKeyCallback, err := ssh.NewKnownHostsCallback(knownHostsPath)
 		if err != nil {
-			return fmt.Errorf("failed to set up host keys: %w", err)
-		}
+			result.Err = phaseError(PhaseList,
+				fmt.Errorf("failed to open the staging cache: %w", err))
 
-		hostKeyCallbackHelper := ssh.HostKeyCallbackHelper{
-			HostKeyCallback: hostKeyCallback,
+			return result
 		}
-		sshKeys.HostKeyCallbackHelper = hostKeyCallbackHelper
-		auth = sshKeys
 	}
 
-	// Set up the destination remote.
-	dst, err := stagingRepo.CreateRemote(&config.RemoteConfig{
-		Name: dstRemoteName,
-		URLs: []string{conf.DstRepo},
+	var (
+		dstURL  string
+		auth    transport.AuthMethod
+		cleanup func()
+	)
+
+	// The credentials of the destination URL are redacted in the logs.
+	dstName := RedactURL(dstRepo)
+
+	err = retry(ctx, conf.Retry, logger, "Setting up the authentication of "+
+		"the "+dstName+" destination", func() error {
+		var authErr error
+		dstURL, auth, cleanup, authErr = newAuth(ctx, conf, logger, dstRepo)
+
+		return authErr
 	})
 	if err != nil {
-		return fmt.Errorf("failed configuring destination remote: %w", err)
+		result.Err = phaseError(PhaseAuth, err)
+
+		return result
 	}
 
-	logger.Info("Pushing to", conf.DstRepo, "destination...")
+	defer cleanup()
 
-	err = dst.Push(&git.PushOptions{
-		RemoteName: dstRemoteName,
-		Auth:       auth,
-		RefSpecs:   []config.RefSpec{"refs/*:refs/*"},
-		Force:      true,
-		Prune:      false, // https://github.com/go-git/go-git/issues/520
+	defer func() {
+		settleCredential(conf, logger, auth, result.Err)
+	}()
+
+	// Set up the destination remote. The remote is not registered in the
+	// staging repository configuration so that pushes to multiple
+	// destinations can share the staging repository concurrently.
+	dst := git.NewRemote(stagingRepo.Storer, &config.RemoteConfig{
+		Name: dstRemoteName,
+		URLs: []string{dstURL},
 	})
+
+	var pushed transferCounter
+
+	ctx = withTransferCounter(ctx, &pushed)
+
+	logger.Info("Listing the", dstName, "destination...")
+
+	start := time.Now()
+	err = retry(ctx, conf.Retry, logger, "Listing the "+dstName+" destination",
+		func() error {
+			var listErr error
+			result.Refs, listErr = listRemote(ctx, dst, auth)
+
+			return listErr
+		})
+	result.Durations[PhaseList] = time.Since(start)
+
 	if err != nil {
-		switch {
-		case errors.Is(err, git.NoErrAlreadyUpToDate):
-			logger.Info("Destination already up to date.")
-		default:
-			return fmt.Errorf("failed to push to destination: %w", err)
+		result.Err = phaseError(PhaseList,
+			fmt.Errorf("failed to list the destination remote: %w", err))
+
+		return result
+	}
+
+	result.Updates, err = planRefUpdates(stagingRepo, result.Refs, rc)
+	if err != nil {
+		result.Err = phaseError(PhaseList, err)
+
+		return result
+	}
+
+	if conf.DryRun {
+		return result
+	}
+
+	start = time.Now()
+	err = phaseError(PhasePush, retry(ctx, conf.Retry, logger,
+		"Pushing to the "+dstName+" destination", func() error {
+			return countAttempt(ctx, func(ctx context.Context) error {
+				return pushRemote(ctx, logger, dst, auth, rc)
+			})
+		}))
+	result.Durations[PhasePush] = time.Since(start)
+
+	if err == nil {
+		// We can not use prune in git.Push due to an existing bug
+		// https://github.com/go-git/go-git/issues/520 so we workaround it
+		// dealing with the prunning with a separate push.
+		logger.Info("Pruning the", dstName, "destination...")
+
+		start = time.Now()
+		err = phaseError(PhasePrune, retry(ctx, conf.Retry, logger,
+			"Pruning the "+dstName+" destination", func() error {
+				return countAttempt(ctx, func(ctx context.Context) error {
+					return pruneRemote(ctx, conf, logger, dst, auth,
+						result.Updates)
+				})
+			}))
+		result.Durations[PhasePrune] = time.Since(start)
+	}
+
+	if err != nil {
+		result.Err = err
+
+		// Some of the updates might have been applied before the failure
+		// so check the destination references again.
+		start = time.Now()
+		refs, listErr := listRemote(ctx, dst, auth)
+		result.Durations[PhaseVerify] = time.Since(start)
+
+		if listErr == nil && refs == nil {
+			refs = []*plumbing.Reference{}
 		}
-	} else {
-		logger.Info("Successfully mirrored pushed to destination repository.")
+
+		rejectUnapplied(result.Updates, refs)
 	}
 
-	// We can not use prune in git.Push due to an existing bug
-	// https://github.com/go-git/go-git/issues/520 so we workaround it dealing
-	// with the prunning with a separate push.
-	logger.Info("Pruning the destination...")
+	result.Pushed = pushed.transfer()
+
+	return result
+}
+
+// mirrorDsts mirrors the staging repository to all the configured destination
+// repositories concurrently. It returns a result for each destination, in
+// the order they are provided in the configuration.
+func mirrorDsts(ctx context.Context, conf Config, logger *Logger, stagingRepo *git.Repository, rc refsConf) []DstResult {
+	var wg sync.WaitGroup
+
+	results := make([]DstResult, len(conf.DstRepos))
+
+	for i, dstRepo := range conf.DstRepos {
+		wg.Add(1)
+
+		go func(i int, dstRepo string) {
+			defer wg.Done()
+
+			results[i] = mirrorDst(ctx, conf, logger, stagingRepo, dstRepo, rc)
+			results[i].Err = redactError(results[i].Err, dstRepo)
+		}(i, dstRepo)
+	}
 
-	err = pruneRemote(conf, logger, dst, auth, stagingRepo)
+	wg.Wait()
+
+	return results
+}
+
+// prepareStagingRepo sets up the staging repository with the source's
+// references that pass the reference filters. It also returns the parsed
+// reference configuration.
+func prepareStagingRepo(ctx context.Context, conf Config, logger *Logger) (*git.Repository, refsConf, error) {
+	rc, err := newRefsConf(conf)
 	if err != nil {
-		return nil
+		return nil, rc, err
 	}
 
-	return nil
+	repo, err := setupStagingRepo(ctx, conf, logger)
+	if err != nil {
+		return nil, rc, err
+	}
+
+	// The cached staging repository keeps the filtered out references and
+	// each destination uses a filtered view of it (see mirrorDst).
+	if len(conf.CacheDir) != 0 {
+		return repo, rc, nil
+	}
+
+	if err := filterRefs(repo, rc.filter); err != nil {
+		return nil, rc, fmt.Errorf("failed to filter out the refs: %w", err)
+	}
+
+	return repo, rc, nil
 }
 
-// DoMirror mirrors the source to the destination git repository based on the
-// provided configuration. Special references (for example GitHub's
-// refs/pull/*) are ignored.
-func DoMirror(conf Config, logger *Logger) error {
-	repo, err := setupStagingRepo(conf, logger)
+// logResult logs the outcome of mirroring to each destination. The reference
+// updates are only logged in debug mode unless running in dry-run mode.
+func logResult(conf Config, logger *Logger, result *MirrorResult) {
+	for _, dst := range result.Dsts {
+		if result.DryRun {
+			logger.Info("Plan for the", RedactURL(dst.Repo), "destination:")
+		}
+
+		for _, update := range dst.Updates {
+			if result.DryRun {
+				logger.Info(update)
+			} else {
+				logger.Debug(conf.Debug, update)
+			}
+		}
+
+		switch {
+		case dst.Err != nil:
+			logger.Error("Mirroring to", RedactURL(dst.Repo), "failed:", dst.Err)
+		case !result.DryRun:
+			logger.Info("Mirroring to", RedactURL(dst.Repo), "succeeded.")
+		case dst.InSync():
+			logger.Info("Destination", RedactURL(dst.Repo), "is in sync.")
+		default:
+			logger.Info("Destination", RedactURL(dst.Repo), "is not in sync.")
+		}
+	}
+}
+
+// Mirror mirrors the source to the destination git repositories based on the
+// provided configuration. Only the references passing the configured
+// reference filters are mirrored. By default, special references (for example
+// GitHub's refs/pull/*) are ignored. The references are renamed in the
+// destinations based on the configured reference mappings. The source is
+// fetched once and pushed to all the destinations. A failure to mirror to a
+// destination doesn't stop the others and it is reported with a *DstsError.
+//
+// In dry-run mode, nothing is pushed to the destinations. The returned result
+// describes the changes mirroring would make and ErrNotInSync is returned when
+// at least one destination is not in sync with the source.
+//
+// The returned result is never nil and it describes the work done even when
+// an error is returned. A failure to fetch the source is returned as a
+// *PhaseError.
+//
+// go-git only supports transports registered for the whole process, so the
+// first mirroring installs the transports of the package as the go-git
+// transports of the http, https, ssh, file and git protocols (see
+// client.InstallProtocol). This affects the other go-git users of the
+// process: their SSH connections don't resolve the SSH client configuration
+// file and they dial the host and the port of the repository URL as they are.
+func Mirror(conf Config, logger *Logger) (*MirrorResult, error) {
+	return MirrorContext(context.Background(), conf, logger)
+}
+
+// MirrorContext is like Mirror but the remote operations are cancelled when
+// the context is done. Like Mirror, it installs the go-git transports of the
+// package for the whole process.
+func MirrorContext(ctx context.Context, conf Config, logger *Logger) (*MirrorResult, error) {
+	start := time.Now()
+
+	installTransports()
+
+	conf.DstRepos = conf.dstRepos()
+
+	result := &MirrorResult{
+		SrcRepo:   conf.SrcRepo,
+		DryRun:    conf.DryRun,
+		Durations: make(map[Phase]time.Duration),
+	}
+
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	ctx, closeRemote, err := remoteContext(ctx, conf)
 	if err != nil {
-		return err
+		return result, phaseError(PhaseFetch, err)
 	}
 
-	// Do not push GitHub special references used for dealing with pull
-	// requests.
-	if err := filterOutRefs(repo, []string{refsFilterPrefix}); err != nil {
-		return fmt.Errorf("failed to filter out the refs: %w", err)
+	defer closeRemote()
+
+	if len(conf.CacheDir) != 0 {
+		unlock, err := lockCache(ctx, cachePath(conf))
+		if err != nil {
+			return result, phaseError(PhaseFetch, err)
+		}
+
+		defer unlock()
 	}
 
-	if err := pushWithAuth(conf, logger, repo); err != nil {
-		return err
+	var fetched transferCounter
+
+	repo, rc, err := prepareStagingRepo(withTransferCounter(ctx, &fetched),
+		conf, logger)
+	result.Durations[PhaseFetch] = time.Since(start)
+	result.Fetched = fetched.transfer()
+
+	if err != nil {
+		return result, phaseError(PhaseFetch, redactError(err, conf.SrcRepo))
 	}
 
-	return nil
+	result.Dsts = mirrorDsts(ctx, conf, logger, repo, rc)
+	logResult(conf, logger, result)
+
+	return result, result.Err()
+}
+
+// DoMirror mirrors the source to the destination git repositories based on
+// the provided configuration. See Mirror for details. It only returns the
+// error and it is kept for compatibility.
+func DoMirror(conf Config, logger *Logger) error {
+	_, err := Mirror(conf, logger)
+
+	return err
 }
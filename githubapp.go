@@ -0,0 +1,403 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const (
+	// defaultGitHubAPIURL is the API of github.com.
+	defaultGitHubAPIURL = "https://api.github.com"
+	// githubAppUsername is the user name used with the installation tokens.
+	githubAppUsername = "x-access-token"
+	// githubAppJWTLifetime is the lifetime of the JWTs authenticating the
+	// GitHub App. GitHub accepts up to 10 minutes.
+	githubAppJWTLifetime = 9 * time.Minute
+	// githubAppClockSkew accounts for the clock drift with GitHub when
+	// issuing JWTs.
+	githubAppClockSkew = time.Minute
+	// githubAppTokenRefreshMargin is how long before its expiry an
+	// installation token is refreshed.
+	githubAppTokenRefreshMargin = 5 * time.Minute
+	// githubAPITimeout bounds the requests to the GitHub API.
+	githubAPITimeout = 30 * time.Second
+)
+
+var ErrGitHubApp = errors.New("invalid GitHub App configuration")
+
+// isSet reports whether a GitHub App is configured. The API URL alone does
+// not configure an app.
+func (appConf GitHubAppConf) isSet() bool {
+	return len(appConf.AppID) != 0 || len(appConf.InstallationID) != 0 ||
+		len(appConf.PrivateKey) != 0 || len(appConf.PrivateKeyPath) != 0
+}
+
+// apiURL returns the GitHub API base URL, defaulting to the one of
+// github.com.
+func (appConf GitHubAppConf) apiURL() string {
+	if len(appConf.APIURL) == 0 {
+		return defaultGitHubAPIURL
+	}
+
+	return strings.TrimSuffix(appConf.APIURL, "/")
+}
+
+// getPrivateKey returns the GitHub App private key provided either by content
+// or by file path.
+func (appConf GitHubAppConf) getPrivateKey() (*rsa.PrivateKey, error) {
+	privateKey := []byte(appConf.PrivateKey)
+
+	if len(appConf.PrivateKeyPath) != 0 {
+		var err error
+
+		privateKey, err = os.ReadFile(appConf.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read the private key: %s",
+				ErrGitHubApp, err.Error())
+		}
+	}
+
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, fmt.Errorf("%w: the private key is not in the PEM format",
+			ErrGitHubApp)
+	}
+
+	// GitHub provides PKCS #1 keys but converted PKCS #8 keys are accepted
+	// too.
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse the private key: %s",
+			ErrGitHubApp, err.Error())
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: the private key is not an RSA key",
+			ErrGitHubApp)
+	}
+
+	return rsaKey, nil
+}
+
+// validate checks a GitHub App configuration. The app ID, the installation ID
+// and the private key are all required.
+func (appConf GitHubAppConf) validate() error {
+	if !appConf.isSet() {
+		return nil
+	}
+
+	if len(appConf.PrivateKey) != 0 && len(appConf.PrivateKeyPath) != 0 {
+		return fmt.Errorf("%w: private key provided via both file path and "+
+			"content", ErrGitHubApp)
+	}
+
+	for _, id := range []struct {
+		name  string
+		value string
+	}{
+		{"app ID", appConf.AppID},
+		{"installation ID", appConf.InstallationID},
+	} {
+		if _, err := strconv.ParseUint(id.value, 10, 64); err != nil {
+			return fmt.Errorf("%w: invalid %s '%s'", ErrGitHubApp, id.name,
+				id.value)
+		}
+	}
+
+	if u, err := url.Parse(appConf.apiURL()); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("%w: invalid API URL '%s'", ErrGitHubApp,
+			appConf.APIURL)
+	}
+
+	_, err := appConf.getPrivateKey()
+
+	return err
+}
+
+// newGitHubAppJWT returns a JWT authenticating a GitHub App.
+func newGitHubAppJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-githubAppClockSkew).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." +
+		encoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+		digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the GitHub App JWT: %w", err)
+	}
+
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// githubAppTokenKey identifies the installation tokens of a GitHub App
+// installation. The app key is part of it so that the tokens are only shared
+// by the authentication methods holding the same key.
+type githubAppTokenKey struct {
+	apiURL         string
+	appID          string
+	installationID string
+	keyDigest      [sha256.Size]byte
+}
+
+// githubAppToken is the installation token of a GitHub App installation,
+// shared by all the authentication methods of the installation.
+type githubAppToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// githubAppTokens holds the installation tokens per installation so that
+// the destinations of a mirror, and the mirroring runs of the daemon, reuse
+// them until they are about to expire.
+var githubAppTokens = struct {
+	sync.Mutex
+	tokens map[githubAppTokenKey]*githubAppToken
+}{tokens: make(map[githubAppTokenKey]*githubAppToken)}
+
+// sharedGitHubAppToken returns the shared installation token of a GitHub App
+// installation.
+func sharedGitHubAppToken(appConf GitHubAppConf, key *rsa.PrivateKey) *githubAppToken {
+	tokenKey := githubAppTokenKey{
+		apiURL:         appConf.apiURL(),
+		appID:          appConf.AppID,
+		installationID: appConf.InstallationID,
+		keyDigest:      sha256.Sum256(x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+	}
+
+	githubAppTokens.Lock()
+	defer githubAppTokens.Unlock()
+
+	token, ok := githubAppTokens.tokens[tokenKey]
+	if !ok {
+		token = &githubAppToken{}
+		githubAppTokens.tokens[tokenKey] = token
+	}
+
+	return token
+}
+
+// githubAppAuth is an HTTP basic authentication method with a GitHub App
+// installation token. The token is shared per installation and it is
+// refreshed before it expires so that long mirrors outlive it.
+type githubAppAuth struct {
+	// ctx is the context of the mirroring run using the authentication
+	// method. go-git sets the authentication of its requests before they
+	// carry their context so the token refreshes use this one instead.
+	ctx     context.Context
+	conf    Config
+	logger  *Logger
+	appConf GitHubAppConf
+	key     *rsa.PrivateKey
+	shared  *githubAppToken
+}
+
+// newGitHubAppAuth returns the HTTP authentication method of a GitHub App
+// installation. An installation token is requested right away unless a
+// valid one is already shared.
+func newGitHubAppAuth(ctx context.Context, conf Config, logger *Logger, appConf GitHubAppConf) (*githubAppAuth, error) {
+	key, err := appConf.getPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &githubAppAuth{
+		ctx:     ctx,
+		conf:    conf,
+		logger:  logger,
+		appConf: appConf,
+		key:     key,
+		shared:  sharedGitHubAppToken(appConf, key),
+	}
+
+	if _, err := auth.validToken(ctx); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
+
+// githubAppTokenError is the error of an installation token request rejected
+// by the GitHub API. It provides the status code of the response so that the
+// error can be classified.
+type githubAppTokenError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (e *githubAppTokenError) Error() string {
+	return fmt.Sprintf("failed to request a GitHub App installation token: "+
+		"%s: %s", e.status, e.message)
+}
+
+// StatusCode returns the status code of the response.
+func (e *githubAppTokenError) StatusCode() int {
+	return e.code
+}
+
+// requestToken requests a new installation token within a context. It returns
+// the token and its expiry.
+func (a *githubAppAuth) requestToken(ctx context.Context) (string, time.Time, error) {
+	jwt, err := newGitHubAppJWT(a.appConf.AppID, a.key, time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ctx, closeRemote, err := remoteContext(ctx, a.conf)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer closeRemote()
+
+	ctx, cancel := context.WithTimeout(ctx, githubAPITimeout)
+	defer cancel()
+
+	tokenURL := fmt.Sprintf("%s/app/installations/%s/access_tokens",
+		a.appConf.apiURL(), a.appConf.InstallationID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to request a GitHub App "+
+			"installation token: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := (&http.Client{Transport: remoteRoundTripper{}}).Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to request a GitHub App "+
+			"installation token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read the GitHub App "+
+			"installation token: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, &githubAppTokenError{
+			status:  resp.Status,
+			code:    resp.StatusCode,
+			message: strings.TrimSpace(string(body)),
+		}
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	if err := json.Unmarshal(body, &token); err != nil || len(token.Token) == 0 {
+		return "", time.Time{}, fmt.Errorf("invalid GitHub App installation "+
+			"token response: %s", strings.TrimSpace(string(body)))
+	}
+
+	return token.Token, token.ExpiresAt, nil
+}
+
+// validToken returns the shared installation token, requesting a new one
+// when there is none or when it is about to expire. The token is requested
+// once for all the authentication methods waiting for it. On failure, the
+// current token, if any, is returned with the error.
+func (a *githubAppAuth) validToken(ctx context.Context) (string, error) {
+	a.shared.mu.Lock()
+	defer a.shared.mu.Unlock()
+
+	if time.Until(a.shared.expires) >= githubAppTokenRefreshMargin {
+		return a.shared.token, nil
+	}
+
+	if len(a.shared.token) != 0 {
+		a.logger.Debug(a.conf.Debug, "Refreshing the GitHub App "+
+			"installation token.")
+	}
+
+	token, expires, err := a.requestToken(ctx)
+	if err != nil {
+		return a.shared.token, err
+	}
+
+	a.shared.token, a.shared.expires = token, expires
+
+	return token, nil
+}
+
+// currentToken returns the installation token, refreshing it when it is about
+// to expire. On refresh failure, a warning is logged and the current token is
+// returned.
+func (a *githubAppAuth) currentToken() string {
+	token, err := a.validToken(a.ctx)
+	if err != nil {
+		a.logger.Warn(err)
+	}
+
+	return token
+}
+
+// SetAuth sets the installation token as basic authentication of a request.
+func (a *githubAppAuth) SetAuth(r *http.Request) {
+	r.SetBasicAuth(githubAppUsername, a.currentToken())
+}
+
+// Name is the name of the authentication method.
+func (a *githubAppAuth) Name() string {
+	return "http-github-app"
+}
+
+// String returns the authentication method without the token.
+func (a *githubAppAuth) String() string {
+	return fmt.Sprintf("%s - app %s, installation %s", a.Name(),
+		a.appConf.AppID, a.appConf.InstallationID)
+}
+
+// The GitHub App authentication is an HTTP authentication method.
+var _ githttp.AuthMethod = (*githubAppAuth)(nil)
@@ -0,0 +1,555 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+)
+
+// newTestGitHubAppKey generates a GitHub App private key. It returns the key
+// and its PEM encoding.
+func newTestGitHubAppKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %s", err)
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+}
+
+// checkTestGitHubAppJWT checks that a JWT authenticates a GitHub App and is
+// signed with its key.
+func checkTestGitHubAppJWT(jwt, appID string, key *rsa.PrivateKey) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid JWT: %s", jwt)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid JWT signature: %w", err)
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:],
+		signature); err != nil {
+		return fmt.Errorf("invalid JWT signature: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if claims.Issuer != appID || claims.IssuedAt > now ||
+		claims.ExpiresAt <= now ||
+		claims.ExpiresAt-claims.IssuedAt > int64((10*time.Minute).Seconds()) {
+		return fmt.Errorf("unexpected JWT claims: %+v", claims)
+	}
+
+	return nil
+}
+
+// testGitHubAPI is a fake GitHub API issuing installation tokens.
+type testGitHubAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	failures int
+	status   int
+	body     string
+	lifetime time.Duration
+	err      error
+}
+
+// newTestGitHubAPI starts a fake GitHub API issuing tokens for the
+// installation 2 of the app 1. The issued tokens are numbered unless a
+// response body is set. The first requests, as many as the failures, fail as
+// unavailable.
+func newTestGitHubAPI(t *testing.T, key *rsa.PrivateKey) *testGitHubAPI {
+	t.Helper()
+
+	api := &testGitHubAPI{status: http.StatusCreated, lifetime: time.Hour}
+
+	api.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			api.mu.Lock()
+			defer api.mu.Unlock()
+
+			api.requests++
+
+			switch {
+			case r.Method != http.MethodPost ||
+				r.URL.Path != "/api/v3/app/installations/2/access_tokens":
+				api.err = fmt.Errorf("unexpected request: %s %s", r.Method,
+					r.URL.Path)
+			case r.Header.Get("Accept") != "application/vnd.github+json":
+				api.err = fmt.Errorf("unexpected Accept header: %s",
+					r.Header.Get("Accept"))
+			default:
+				api.err = checkTestGitHubAppJWT(strings.TrimPrefix(
+					r.Header.Get("Authorization"), "Bearer "), "1", key)
+			}
+
+			if api.err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			if api.failures > 0 {
+				api.failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+
+			w.WriteHeader(api.status)
+
+			if len(api.body) != 0 {
+				fmt.Fprint(w, api.body)
+
+				return
+			}
+
+			fmt.Fprintf(w, `{"token": "token-%d", "expires_at": %q}`,
+				api.requests, time.Now().Add(api.lifetime).Format(time.RFC3339))
+		}))
+
+	return api
+}
+
+// check returns the number of requests received by the fake GitHub API and
+// the error of the last one, if any.
+func (api *testGitHubAPI) check() (int, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	return api.requests, api.err
+}
+
+// TestGitHubAppConfValidate tests the validation of the GitHub App
+// configurations.
+func TestGitHubAppConfValidate(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, keyPEM := newTestGitHubAppKey(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode the key: %s", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %s", err)
+	}
+
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("failed to encode the key: %s", err)
+	}
+
+	keyPath := writeTestFile(t, dir, "key.pem", []byte(keyPEM))
+	pkcs8Path := writeTestFile(t, dir, "pkcs8.pem", pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	ecPath := writeTestFile(t, dir, "ec.pem", pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}))
+
+	appConf := GitHubAppConf{AppID: "1", InstallationID: "2", PrivateKey: keyPEM}
+
+	if err := (GitHubAppConf{}).validate(); err != nil {
+		t.Fatalf("empty GitHub App configuration was not allowed: %s", err)
+	}
+
+	// The API URL alone does not configure a GitHub App.
+	apiOnly := GitHubAppConf{APIURL: "https://github.example.com/api/v3"}
+	if apiOnly.isSet() || apiOnly.validate() != nil {
+		t.Fatal("GitHub App configured with only the API URL")
+	}
+
+	for _, valid := range []GitHubAppConf{
+		appConf,
+		{AppID: "1", InstallationID: "2", PrivateKeyPath: keyPath},
+		{AppID: "1", InstallationID: "2", PrivateKeyPath: pkcs8Path},
+		{
+			AppID:          "1",
+			InstallationID: "2",
+			PrivateKey:     keyPEM,
+			APIURL:         "https://ghes.example.com/api/v3/",
+		},
+	} {
+		if err := valid.validate(); err != nil {
+			t.Fatalf("valid GitHub App configuration was not allowed: %+v: %s",
+				valid, err)
+		}
+	}
+
+	for _, invalid := range []GitHubAppConf{
+		{AppID: "1", InstallationID: "2"},
+		{AppID: "1", PrivateKey: keyPEM},
+		{InstallationID: "2", PrivateKey: keyPEM},
+		{AppID: "app", InstallationID: "2", PrivateKey: keyPEM},
+		{AppID: "1", InstallationID: "-2", PrivateKey: keyPEM},
+		{AppID: "1", InstallationID: "2", PrivateKey: "key"},
+		{AppID: "1", InstallationID: "2", PrivateKeyPath: dir + "/missing"},
+		{AppID: "1", InstallationID: "2", PrivateKeyPath: ecPath},
+		{
+			AppID:          "1",
+			InstallationID: "2",
+			PrivateKey:     keyPEM,
+			PrivateKeyPath: keyPath,
+		},
+		{
+			AppID:          "1",
+			InstallationID: "2",
+			PrivateKey:     keyPEM,
+			APIURL:         "api.github.com",
+		},
+	} {
+		if err := invalid.validate(); !errors.Is(err, ErrGitHubApp) {
+			t.Fatalf("invalid GitHub App configuration was allowed: %+v",
+				invalid)
+		}
+	}
+
+	// A GitHub App and an HTTP token are mutually exclusive.
+	if err := (HTTPConf{Token: "token", GitHubApp: appConf}).validate(); !errors.Is(err,
+		ErrGitHubApp) {
+		t.Fatal("HTTP token and GitHub App provided together were allowed")
+	}
+}
+
+// TestGitHubAppAuth tests the authentication with GitHub App installation
+// tokens.
+func TestGitHubAppAuth(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	key, keyPEM := newTestGitHubAppKey(t)
+
+	api := newTestGitHubAPI(t, key)
+	defer api.Close()
+
+	appConf := GitHubAppConf{
+		AppID:          "1",
+		InstallationID: "2",
+		PrivateKey:     keyPEM,
+		APIURL:         api.URL + "/api/v3/",
+	}
+
+	checkToken := func(auth *githubAppAuth, token string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "https://github.com", nil)
+		auth.SetAuth(req)
+
+		username, password, ok := req.BasicAuth()
+		if !ok || username != githubAppUsername || password != token {
+			t.Fatalf("unexpected credentials: %s, %s", username, password)
+		}
+	}
+
+	auth, err := newGitHubAppAuth(context.Background(), Config{}, logger, appConf)
+	if err != nil {
+		t.Fatalf("failed to get an installation token: %s", err)
+	}
+
+	if requests, err := api.check(); requests != 1 || err != nil {
+		t.Fatalf("unexpected installation token request: %d, %v", requests, err)
+	}
+
+	// The token is reused while valid.
+	checkToken(auth, "token-1")
+	checkToken(auth, "token-1")
+
+	if requests, _ := api.check(); requests != 1 {
+		t.Fatal("valid installation token was refreshed")
+	}
+
+	if strings.Contains(auth.String(), "token-1") {
+		t.Fatal("installation token leaked in the authentication description")
+	}
+
+	// The token is refreshed when it is about to expire.
+	auth.shared.mu.Lock()
+	auth.shared.expires = time.Now().Add(time.Minute)
+	auth.shared.mu.Unlock()
+
+	checkToken(auth, "token-2")
+
+	if requests, err := api.check(); requests != 2 || err != nil {
+		t.Fatalf("unexpected installation token refresh: %d, %v", requests, err)
+	}
+
+	// The token is shared by the authentication methods of the installation.
+	other, err := newGitHubAppAuth(context.Background(), Config{}, logger, appConf)
+	if err != nil {
+		t.Fatalf("failed to get an installation token: %s", err)
+	}
+
+	checkToken(other, "token-2")
+
+	if requests, _ := api.check(); requests != 2 {
+		t.Fatal("shared installation token was requested again")
+	}
+
+	// The current token is kept when the refresh fails.
+	api.mu.Lock()
+	api.status = http.StatusInternalServerError
+	api.mu.Unlock()
+
+	auth.shared.mu.Lock()
+	auth.shared.expires = time.Now()
+	auth.shared.mu.Unlock()
+
+	checkToken(auth, "token-2")
+
+	// The GitHub App takes precedence over the other HTTP credentials.
+	api.mu.Lock()
+	api.status = http.StatusCreated
+	api.mu.Unlock()
+
+	httpAuth, err := newHTTPAuth(context.Background(), Config{NetrcPath: netrcNone}, logger,
+		HTTPConf{GitHubApp: appConf, CredentialHelper: "!false"},
+		"https://github.com/team/repo.git")
+	if err != nil {
+		t.Fatalf("failed to set up HTTP authentication: %s", err)
+	}
+
+	if _, ok := httpAuth.(*githubAppAuth); !ok {
+		t.Fatalf("unexpected HTTP authentication: %v", httpAuth)
+	}
+}
+
+// TestGitHubAppAuthErrors tests the failures to get an installation token.
+func TestGitHubAppAuthErrors(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	key, keyPEM := newTestGitHubAppKey(t)
+	_, otherKeyPEM := newTestGitHubAppKey(t)
+
+	for _, test := range []struct {
+		name    string
+		status  int
+		keyPEM  string
+		body    string
+		apiPath string
+	}{
+		{"refused", http.StatusUnauthorized, keyPEM, "", "/api/v3"},
+		{"wrong key", http.StatusCreated, otherKeyPEM, "", "/api/v3"},
+		{"wrong API URL", http.StatusCreated, keyPEM, "", ""},
+		{"no token", http.StatusCreated, keyPEM, "{}", "/api/v3"},
+		{"invalid response", http.StatusCreated, keyPEM, "token", "/api/v3"},
+	} {
+		api := newTestGitHubAPI(t, key)
+		api.status, api.body = test.status, test.body
+
+		_, err := newGitHubAppAuth(context.Background(), Config{}, logger, GitHubAppConf{
+			AppID:          "1",
+			InstallationID: "2",
+			PrivateKey:     test.keyPEM,
+			APIURL:         api.URL + test.apiPath,
+		})
+
+		api.Close()
+
+		if err == nil {
+			t.Fatalf("installation token was issued: %s", test.name)
+		}
+
+		if test.status == http.StatusUnauthorized &&
+			ClassifyError(err) != ErrorAuth {
+			t.Fatalf("unexpected error kind: %s: %s", ClassifyError(err), err)
+		}
+	}
+
+	// The installation token is requested with the caller context.
+	api := newTestGitHubAPI(t, key)
+	defer api.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := newGitHubAppAuth(ctx, Config{}, logger, GitHubAppConf{
+		AppID:          "1",
+		InstallationID: "2",
+		PrivateKey:     keyPEM,
+		APIURL:         api.URL + "/api/v3",
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("installation token was requested after cancellation: %v", err)
+	}
+
+	if requests, _ := api.check(); requests != 0 {
+		t.Fatal("installation token was requested after cancellation")
+	}
+}
+
+// TestGitHubAppAuthShared tests sharing the installation token between the
+// destinations mirrored concurrently.
+func TestGitHubAppAuthShared(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	key, keyPEM := newTestGitHubAppKey(t)
+
+	api := newTestGitHubAPI(t, key)
+	defer api.Close()
+
+	appConf := GitHubAppConf{
+		AppID:          "1",
+		InstallationID: "2",
+		PrivateKey:     keyPEM,
+		APIURL:         api.URL + "/api/v3",
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 4)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := newGitHubAppAuth(context.Background(), Config{}, logger, appConf)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to get an installation token: %s", err)
+		}
+	}
+
+	if requests, err := api.check(); requests != 1 || err != nil {
+		t.Fatalf("unexpected installation token requests: %d, %v", requests,
+			err)
+	}
+}
+
+// TestMirrorGitHubAppRetry tests retrying the installation token requests
+// failing with a transient error when setting up the authentication of a
+// destination.
+func TestMirrorGitHubAppRetry(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	key, keyPEM := newTestGitHubAppKey(t)
+
+	api := newTestGitHubAPI(t, key)
+	defer api.Close()
+
+	api.failures = 2
+
+	srcRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-src-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary src repo: %s", err)
+	}
+
+	defer os.RemoveAll(srcRepoPath)
+
+	if _, _, err := utils.NewTestRepo(srcRepoPath, []string{}); err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	// The destination can't be reached so the mirroring fails once the
+	// authentication is set up.
+	result, err := Mirror(Config{
+		SrcRepo:  srcRepoPath,
+		DstRepos: []string{"https://127.0.0.1:1/repo.git"},
+		HTTP: HTTPConf{GitHubApp: GitHubAppConf{
+			AppID:          "1",
+			InstallationID: "2",
+			PrivateKey:     keyPEM,
+			APIURL:         api.URL + "/api/v3",
+		}},
+		Retry: RetryConf{
+			Attempts: 3,
+			Backoff:  time.Millisecond,
+		},
+	}, logger)
+	if err == nil {
+		t.Fatal("unreachable destination was mirrored")
+	}
+
+	var phaseErr *PhaseError
+	if !errors.As(result.Dsts[0].Err, &phaseErr) ||
+		phaseErr.Phase != PhaseList {
+		t.Fatalf("unexpected destination error: %v", result.Dsts[0].Err)
+	}
+
+	if requests, err := api.check(); requests != 3 || err != nil {
+		t.Fatalf("unexpected installation token requests: %d, %v", requests,
+			err)
+	}
+}
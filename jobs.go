@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrJobs       = errors.New("invalid jobs file")
+	ErrUnknownJob = errors.New("unknown job")
+)
+
+// jobNameRegexp matches the valid job names.
+var jobNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Job structure defines a named mirroring job of a jobs file. The schedule
+// is only used in daemon mode.
+type Job struct {
+	Name     string
+	Schedule ScheduleConf
+	Config   Config
+}
+
+// jobDefaults structure is the format of the defaults in a jobs file.
+type jobDefaults struct {
+	Schedule ScheduleConf `yaml:"schedule"`
+	Config   `yaml:",inline"`
+}
+
+// jobConf structure is the format of a job in a jobs file.
+type jobConf struct {
+	Name        string `yaml:"name"`
+	jobDefaults `yaml:",inline"`
+}
+
+// jobsFile structure is the format of a jobs file. Each job is decoded on top
+// of the defaults so that it only overrides the values it provides.
+type jobsFile struct {
+	Defaults yaml.Node   `yaml:"defaults"`
+	Jobs     []yaml.Node `yaml:"jobs"`
+}
+
+// LoadJobs loads the mirroring jobs of a YAML jobs file. The file provides
+// the shared defaults of the jobs and the jobs. Each job needs a unique name,
+// a source repository and at least one destination repository.
+func LoadJobs(path string) ([]Job, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobs, err.Error())
+	}
+
+	// Reject the unknown keys, including the secrets, first.
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	var strict struct {
+		Defaults jobDefaults `yaml:"defaults"`
+		Jobs     []jobConf   `yaml:"jobs"`
+	}
+
+	if err := decoder.Decode(&strict); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %s: %s", ErrJobs, path, err.Error())
+	}
+
+	var file jobsFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrJobs, path, err.Error())
+	}
+
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("%w: %s: no jobs", ErrJobs, path)
+	}
+
+	jobs := make([]Job, 0, len(file.Jobs))
+	names := make(map[string]bool, len(file.Jobs))
+
+	for i := range file.Jobs {
+		var job jobConf
+
+		if !file.Defaults.IsZero() {
+			if err := file.Defaults.Decode(&job.jobDefaults); err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrJobs, path, err.Error())
+			}
+		}
+
+		if err := file.Jobs[i].Decode(&job); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrJobs, path, err.Error())
+		}
+
+		// The schedule of a job replaces the default one as a whole as an
+		// interval and a cron expression can't be combined.
+		var override struct {
+			Schedule *ScheduleConf `yaml:"schedule"`
+		}
+
+		if err := file.Jobs[i].Decode(&override); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrJobs, path, err.Error())
+		}
+
+		if override.Schedule != nil {
+			job.Schedule = *override.Schedule
+		}
+
+		if err := job.validate(); err != nil {
+			return nil, fmt.Errorf("%w: %s: job %d: %s", ErrJobs, path, i+1,
+				err.Error())
+		}
+
+		if names[job.Name] {
+			return nil, fmt.Errorf("%w: %s: duplicate job '%s'", ErrJobs, path,
+				job.Name)
+		}
+
+		names[job.Name] = true
+
+		jobs = append(jobs, Job{
+			Name:     job.Name,
+			Schedule: job.Schedule,
+			Config:   job.Config,
+		})
+	}
+
+	return jobs, nil
+}
+
+// validate checks the values a job is required to provide in a jobs file.
+// The rest of the configuration is validated when the job runs.
+func (job jobConf) validate() error {
+	switch {
+	case !jobNameRegexp.MatchString(job.Name):
+		return fmt.Errorf("invalid name '%s'", job.Name)
+	case len(job.SrcRepo) == 0:
+		return fmt.Errorf("%s: %w", job.Name, ErrNoSrc)
+	case len(job.DstRepos) == 0:
+		return fmt.Errorf("%s: %w", job.Name, ErrNoDst)
+	}
+
+	if err := job.Schedule.validate(); err != nil {
+		return fmt.Errorf("%s: %w", job.Name, err)
+	}
+
+	return nil
+}
+
+// SelectJobs returns the jobs with the provided names, in the order of the
+// jobs file. All the jobs are returned when no names are provided.
+func SelectJobs(jobs []Job, names []string) ([]Job, error) {
+	if len(names) == 0 {
+		return jobs, nil
+	}
+
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	var selectedJobs []Job
+
+	for _, job := range jobs {
+		if selected[job.Name] {
+			selectedJobs = append(selectedJobs, job)
+			delete(selected, job.Name)
+		}
+	}
+
+	for _, name := range names {
+		if selected[name] {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownJob, name)
+		}
+	}
+
+	return selectedJobs, nil
+}
+
+// JobResult structure describes the run of a job. The mirroring result is nil
+// when the mirroring didn't run (for example, when the configuration failed).
+type JobResult struct {
+	Job    Job
+	Result *MirrorResult
+	Err    error
+}
+
+// RunJob validates the configuration of a job and runs its mirroring.
+func RunJob(job Job, logger *Logger) JobResult {
+	return RunJobContext(context.Background(), job, logger)
+}
+
+// RunJobContext is like RunJob but the mirroring is cancelled when the
+// context is done.
+func RunJobContext(ctx context.Context, job Job, logger *Logger) JobResult {
+	result := JobResult{Job: job}
+
+	logger.Info("Running the", job.Name, "job...")
+
+	if err := job.Config.Validate(logger); err != nil {
+		result.Err = fmt.Errorf("configuration failed: %w", err)
+	} else {
+		result.Result, result.Err = MirrorContext(ctx, job.Config, logger)
+		if result.Err != nil {
+			result.Err = fmt.Errorf("mirror operation failed: %w", result.Err)
+		}
+	}
+
+	if result.Err != nil {
+		logger.Error("Job", job.Name, "failed:", result.Err)
+	} else {
+		logger.Info("Job", job.Name, "succeeded.")
+	}
+
+	return result
+}
+
+// RunJobs runs jobs one after the other. A failing job doesn't stop the
+// others. It returns a result for each job, in the order they are provided.
+func RunJobs(jobs []Job, logger *Logger) []JobResult {
+	results := make([]JobResult, 0, len(jobs))
+
+	for _, job := range jobs {
+		results = append(results, RunJob(job, logger))
+	}
+
+	return results
+}
@@ -0,0 +1,373 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+)
+
+// TestLoadJobs tests loading jobs files.
+func TestLoadJobs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{
+		jobsPath := writeTestFile(t, dir, "jobs.yml", []byte(`
+defaults:
+  cache-dir: /var/cache/mirrors
+  ref-filters: ["!refs/pull/*"]
+  ssh:
+    known-hosts-path: /etc/mirrors/known_hosts
+    private-key-path: /etc/mirrors/id_ed25519
+  dry-run: true
+  retry:
+    attempts: 3
+    backoff: 2s
+  schedule:
+    interval: 15m
+    jitter: 1m
+
+jobs:
+  - name: project
+    source: https://github.com/org/project.git
+    destinations:
+      - git@git.example.com:mirrors/project.git
+    ssh:
+      private-key-path: /etc/mirrors/project_key
+      bastion:
+        host: bastion.example.com
+    retry:
+      attempts: 5
+    dry-run: false
+
+  - name: other.repo
+    source: https://github.com/org/other.git
+    destinations: [https://git.example.com/mirrors/other.git]
+    ref-filters: []
+    http:
+      token-path: /etc/mirrors/token
+      github-app:
+        app-id: "1"
+    proxy:
+      https-proxy: http://proxy:3128
+    tls:
+      ca-bundle: /etc/mirrors/ca.pem
+    schedule:
+      cron: "0 * * * *"
+`))
+
+		jobs, err := LoadJobs(jobsPath)
+		if err != nil {
+			t.Fatalf("failed to load the jobs file: %s", err)
+		}
+
+		expected := []Job{
+			{
+				Name: "project",
+				Schedule: ScheduleConf{
+					Interval: 15 * time.Minute,
+					Jitter:   time.Minute,
+				},
+				Config: Config{
+					SrcRepo:    "https://github.com/org/project.git",
+					DstRepos:   []string{"git@git.example.com:mirrors/project.git"},
+					RefFilters: []string{"!refs/pull/*"},
+					CacheDir:   "/var/cache/mirrors",
+					SSH: SSHConf{
+						PrivateKeyPath: "/etc/mirrors/project_key",
+						KnownHostsPath: "/etc/mirrors/known_hosts",
+						Bastion:        BastionConf{Host: "bastion.example.com"},
+					},
+					Retry: RetryConf{Attempts: 5, Backoff: 2 * time.Second},
+				},
+			},
+			{
+				Name:     "other.repo",
+				Schedule: ScheduleConf{Cron: "0 * * * *"},
+				Config: Config{
+					SrcRepo:    "https://github.com/org/other.git",
+					DstRepos:   []string{"https://git.example.com/mirrors/other.git"},
+					RefFilters: []string{},
+					CacheDir:   "/var/cache/mirrors",
+					SSH: SSHConf{
+						PrivateKeyPath: "/etc/mirrors/id_ed25519",
+						KnownHostsPath: "/etc/mirrors/known_hosts",
+					},
+					HTTP: HTTPConf{
+						TokenPath: "/etc/mirrors/token",
+						GitHubApp: GitHubAppConf{AppID: "1"},
+					},
+					Proxy:  ProxyConf{HTTPSProxy: "http://proxy:3128"},
+					TLS:    TLSConf{CABundlePath: "/etc/mirrors/ca.pem"},
+					Retry:  RetryConf{Attempts: 3, Backoff: 2 * time.Second},
+					DryRun: true,
+				},
+			},
+		}
+
+		if !reflect.DeepEqual(jobs, expected) {
+			t.Fatalf("unexpected jobs: %+v", jobs)
+		}
+	}
+	{
+		// Jobs without defaults.
+		jobsPath := writeTestFile(t, dir, "nodefaults.yml", []byte(`
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+`))
+
+		jobs, err := LoadJobs(jobsPath)
+		if err != nil || !reflect.DeepEqual(jobs, []Job{{
+			Name:   "project",
+			Config: Config{SrcRepo: "src", DstRepos: []string{"dst"}},
+		}}) {
+			t.Fatalf("unexpected jobs: %+v, %v", jobs, err)
+		}
+	}
+	{
+		// The known hosts of a job are kept over the environment ones.
+		jobsPath := writeTestFile(t, dir, "knownhosts.yml", []byte(`
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+    ssh:
+      known-hosts: job known hosts
+`))
+
+		jobs, err := LoadJobs(jobsPath)
+		if err != nil {
+			t.Fatalf("failed to load the jobs file: %s", err)
+		}
+
+		// No need for logs.
+		devnull, _ := os.Open(os.DevNull)
+		defer devnull.Close()
+		logger := NewLogger(devnull)
+
+		jobs[0].Config.ProcessEnv(logger, map[string]string{
+			"GMM_SSH_PRIVATE_KEY": "env private key",
+			"GMM_SSH_KNOWN_HOSTS": "env known hosts",
+		})
+
+		if jobs[0].Config.SSH.KnownHosts != "job known hosts" ||
+			jobs[0].Config.SSH.PrivateKey != "env private key" {
+			t.Fatalf("unexpected SSH configuration: %+v", jobs[0].Config.SSH)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"empty": "",
+		"no jobs": `
+defaults:
+  cache-dir: /tmp
+`,
+		"invalid YAML": "jobs: [",
+		"unknown key": `
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+    unknown: value
+`,
+		"inline secret": `
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+    http:
+      token: secret
+`,
+		"inline default secret": `
+defaults:
+  ssh:
+    private-key: secret
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+`,
+		"no name": `
+jobs:
+  - source: src
+    destinations: [dst]
+`,
+		"invalid name": `
+jobs:
+  - name: my project
+    source: src
+    destinations: [dst]
+`,
+		"duplicate name": `
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+  - name: project
+    source: src
+    destinations: [dst]
+`,
+		"no source": `
+jobs:
+  - name: project
+    destinations: [dst]
+`,
+		"no destinations": `
+jobs:
+  - name: project
+    source: src
+`,
+		"invalid schedule": `
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+    schedule:
+      cron: invalid
+`,
+		"invalid interval": `
+jobs:
+  - name: project
+    source: src
+    destinations: [dst]
+    schedule:
+      interval: 15
+`,
+	} {
+		jobsPath := writeTestFile(t, dir, "invalid.yml", []byte(content))
+		if _, err := LoadJobs(jobsPath); !errors.Is(err, ErrJobs) {
+			t.Fatalf("invalid jobs file was allowed: %s", name)
+		}
+	}
+
+	if _, err := LoadJobs(path.Join(dir, "missing.yml")); !errors.Is(err,
+		ErrJobs) {
+		t.Fatal("missing jobs file was allowed")
+	}
+}
+
+// TestSelectJobs tests selecting jobs by name.
+func TestSelectJobs(t *testing.T) {
+	t.Parallel()
+
+	jobs := []Job{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	for _, test := range []struct {
+		names    []string
+		expected []Job
+	}{
+		{nil, jobs},
+		{[]string{"c", "a"}, []Job{{Name: "a"}, {Name: "c"}}},
+		{[]string{"b", "b"}, []Job{{Name: "b"}}},
+	} {
+		selected, err := SelectJobs(jobs, test.names)
+		if err != nil || !reflect.DeepEqual(selected, test.expected) {
+			t.Fatalf("unexpected jobs for %v: %+v, %v", test.names, selected,
+				err)
+		}
+	}
+
+	if _, err := SelectJobs(jobs, []string{"a", "d"}); !errors.Is(err,
+		ErrUnknownJob) {
+		t.Fatal("unknown job was selected")
+	}
+}
+
+// TestRunJobs tests running multiple jobs.
+func TestRunJobs(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcRepoPath := path.Join(dir, "src")
+	dstRepoPath := path.Join(dir, "dst")
+
+	if _, _, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+	}); err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	dstRepo, _, err := utils.NewTestRepo(dstRepoPath, []string{})
+	if err != nil {
+		t.Fatalf("failed to create a test dst repo: %s", err)
+	}
+
+	results := RunJobs([]Job{
+		{
+			Name:   "invalid",
+			Config: Config{SrcRepo: srcRepoPath},
+		},
+		{
+			Name: "failing",
+			Config: Config{
+				SrcRepo:  path.Join(dir, "missing"),
+				DstRepos: []string{dstRepoPath},
+			},
+		},
+		{
+			Name: "valid",
+			Config: Config{
+				SrcRepo:  srcRepoPath,
+				DstRepos: []string{dstRepoPath},
+			},
+		},
+	}, logger)
+
+	if len(results) != 3 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	if results[0].Job.Name != "invalid" || results[0].Result != nil ||
+		!errors.Is(results[0].Err, ErrNoDst) {
+		t.Fatalf("unexpected invalid job result: %+v", results[0])
+	}
+
+	if results[1].Job.Name != "failing" || results[1].Err == nil {
+		t.Fatalf("unexpected failing job result: %+v", results[1])
+	}
+
+	if results[2].Job.Name != "valid" || results[2].Err != nil ||
+		results[2].Result == nil {
+		t.Fatalf("unexpected valid job result: %+v", results[2])
+	}
+
+	dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+	if err != nil {
+		t.Fatalf("failed to get the dst repo refs: %s", err)
+	}
+
+	if !utils.SlicesAreEqual(dstRepoRefs, []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}) {
+		t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+	}
+}
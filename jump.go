@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// sshTunnelAuth is an SSH authentication method whose connections to the SSH
+// servers are dialed through a dialer (for example, a SOCKS5 proxy) and, when
+// jumpConfig is set, through the jump host at jumpAddr. Every SSH connection
+// is tunnelled on its own so nothing is listening for the tunnelled
+// connections.
+type sshTunnelAuth struct {
+	ssh.AuthMethod
+	dialer     proxy.Dialer
+	jumpAddr   string
+	jumpConfig *gossh.ClientConfig
+}
+
+// dialSSH connects to the address of an SSH server through the tunnel. The
+// connection to the jump host, including its handshake, is bounded by the
+// deadline of the context.
+func (a *sshTunnelAuth) dialSSH(ctx context.Context, addr string) (net.Conn, error) {
+	if a.jumpConfig == nil {
+		return dialContext(ctx, a.dialer, addr)
+	}
+
+	return dialJumpHost(ctx, a.dialer, a.jumpAddr, a.jumpConfig, addr)
+}
+
+// dialContext connects to an address with a dialer, honouring the context
+// when the dialer supports it.
+func dialContext(ctx context.Context, dialer proxy.Dialer, addr string) (net.Conn, error) {
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, "tcp", addr)
+	}
+
+	return dialer.Dial("tcp", addr)
+}
+
+// dialJumpHost connects to a jump host through a dialer and connects to a
+// target address through the jump host. Closing the returned connection also
+// closes the connection to the jump host.
+func dialJumpHost(ctx context.Context, dialer proxy.Dialer, jumpAddr string, jumpConfig *gossh.ClientConfig, targetAddr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, dialer, jumpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the jump host %s: %w",
+			jumpAddr, err)
+	}
+
+	// The deadline bounds both the handshake with the jump host and the
+	// connection to the target address through it. Both are aborted when
+	// the context is cancelled.
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	stop := closeOnCancel(ctx, conn)
+	defer stop()
+
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, jumpAddr, jumpConfig)
+	if err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("failed to connect to the jump host %s: %w",
+			jumpAddr, contextError(ctx, err))
+	}
+
+	client := gossh.NewClient(sshConn, chans, reqs)
+
+	target, err := client.Dial("tcp", targetAddr)
+	if err != nil {
+		client.Close()
+
+		return nil, fmt.Errorf("failed to connect to %s through the jump "+
+			"host %s: %w", targetAddr, jumpAddr, contextError(ctx, err))
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return &jumpConn{Conn: target, client: client, jumpConn: conn}, nil
+}
+
+// jumpConn is a connection tunnelled through a jump host. As the tunnelled
+// connection doesn't support deadlines, they are set on the connection to the
+// jump host instead.
+type jumpConn struct {
+	net.Conn
+	client   *gossh.Client
+	jumpConn net.Conn
+}
+
+// Close closes the tunnelled connection and the connection to the jump host.
+func (c *jumpConn) Close() error {
+	_ = c.Conn.Close()
+
+	return c.client.Close()
+}
+
+func (c *jumpConn) SetDeadline(t time.Time) error {
+	return c.jumpConn.SetDeadline(t)
+}
+
+func (c *jumpConn) SetReadDeadline(t time.Time) error {
+	return c.jumpConn.SetReadDeadline(t)
+}
+
+func (c *jumpConn) SetWriteDeadline(t time.Time) error {
+	return c.jumpConn.SetWriteDeadline(t)
+}
@@ -0,0 +1,626 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+const testJumpUser = "jumper"
+
+// newTestEchoServer starts a TCP server echoing back what it receives. It
+// returns the address of the server and a function stopping it.
+func newTestEchoServer(t *testing.T) (string, func()) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the echo server: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+
+			go func(conn net.Conn) {
+				defer wg.Done()
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() {
+		listener.Close()
+		wg.Wait()
+	}
+}
+
+// newTestJumpHost starts an SSH server only supporting the forwarding of
+// connections (direct-tcpip channels). The server uses the test SSH key as
+// host key and only accepts it for the test jump user. It returns the address
+// of the server and a function stopping it.
+func newTestJumpHost(t *testing.T) (string, func()) {
+	t.Helper()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if conn.User() != testJumpUser ||
+				!bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the jump host: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+
+			go func(conn net.Conn) {
+				defer wg.Done()
+				serveTestJumpHost(conn, config)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() {
+		listener.Close()
+		wg.Wait()
+	}
+}
+
+// serveTestJumpHost serves an SSH connection of the test jump host.
+func serveTestJumpHost(conn net.Conn, config *gossh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			_ = newChan.Reject(gossh.UnknownChannelType, "unsupported channel")
+
+			continue
+		}
+
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+
+		if err := gossh.Unmarshal(newChan.ExtraData(), &target); err != nil {
+			_ = newChan.Reject(gossh.ConnectionFailed, "invalid target")
+
+			continue
+		}
+
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host,
+			strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+
+			continue
+		}
+
+		channel, chanReqs, err := newChan.Accept()
+		if err != nil {
+			remote.Close()
+
+			continue
+		}
+
+		go gossh.DiscardRequests(chanReqs)
+
+		go func() {
+			defer remote.Close()
+			defer channel.Close()
+
+			done := make(chan struct{}, 2)
+
+			go func() {
+				_, _ = io.Copy(channel, remote)
+				done <- struct{}{}
+			}()
+			go func() {
+				_, _ = io.Copy(remote, channel)
+				done <- struct{}{}
+			}()
+
+			<-done
+		}()
+	}
+}
+
+// testJumpConfig returns the SSH client configuration used to connect to the
+// test jump host.
+func testJumpConfig(t *testing.T, user string) *gossh.ClientConfig {
+	t.Helper()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	return &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.FixedHostKey(signer.PublicKey()),
+	}
+}
+
+// newTestSSHKey generates an SSH private key in the PEM format.
+func newTestSSHKey(t *testing.T) string {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate an SSH key: %s", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal the SSH key: %s", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// TestDialJumpHost tests connecting through a jump host.
+func TestDialJumpHost(t *testing.T) {
+	t.Parallel()
+
+	echoAddr, stopEcho := newTestEchoServer(t)
+	defer stopEcho()
+
+	jumpAddr, stopJump := newTestJumpHost(t)
+	defer stopJump()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	{
+		// Every connection goes through its own connection to the jump host.
+		for i := 0; i < 2; i++ {
+			conn, err := dialJumpHost(ctx, proxy.Direct, jumpAddr,
+				testJumpConfig(t, testJumpUser), echoAddr)
+			if err != nil {
+				t.Fatalf("failed to connect through the jump host: %s", err)
+			}
+
+			message := []byte("ping")
+			if _, err := conn.Write(message); err != nil {
+				conn.Close()
+				t.Fatalf("failed to write through the jump host: %s", err)
+			}
+
+			reply := make([]byte, len(message))
+			_, err = io.ReadFull(conn, reply)
+			conn.Close()
+
+			if err != nil || !bytes.Equal(reply, message) {
+				t.Fatalf("unexpected reply through the jump host: %q, %v",
+					reply, err)
+			}
+		}
+	}
+	{
+		// Unauthorised user.
+		_, err := dialJumpHost(ctx, proxy.Direct, jumpAddr,
+			testJumpConfig(t, "invalid"), echoAddr)
+		if err == nil {
+			t.Fatal("unauthorised jump host user was allowed")
+		}
+	}
+	{
+		// Unreachable jump host.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to reserve a port: %s", err)
+		}
+		unreachableAddr := listener.Addr().String()
+		listener.Close()
+
+		_, err = dialJumpHost(ctx, proxy.Direct, unreachableAddr,
+			testJumpConfig(t, testJumpUser), echoAddr)
+		if err == nil {
+			t.Fatal("unreachable jump host was allowed")
+		}
+	}
+	{
+		// Unresponsive jump host. The deadline of the context bounds the
+		// handshake.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start an unresponsive jump host: %s", err)
+		}
+		defer listener.Close()
+
+		shortCtx, shortCancel := context.WithTimeout(context.Background(),
+			100*time.Millisecond)
+		defer shortCancel()
+
+		jumpConfig := testJumpConfig(t, testJumpUser)
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := dialJumpHost(shortCtx, proxy.Direct,
+				listener.Addr().String(), jumpConfig, echoAddr)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("unresponsive jump host was allowed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection to the unresponsive jump host didn't " +
+				"time out")
+		}
+	}
+}
+
+// TestNewAuthBastion tests setting up the SSH authentication through a
+// bastion.
+func TestNewAuthBastion(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	echoAddr, stopEcho := newTestEchoServer(t)
+	defer stopEcho()
+
+	jumpAddr, stopJump := newTestJumpHost(t)
+	defer stopJump()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	// The bastion only authorises the test SSH key while the repository uses
+	// another one.
+	bastionKnownHosts := knownhosts.Line([]string{jumpAddr}, signer.PublicKey())
+	repoKnownHosts := knownhosts.Line([]string{"git.internal"},
+		signer.PublicKey())
+
+	conf := Config{
+		SSHConfigPath: sshConfigNone,
+		SSH: SSHConf{
+			PrivateKey: newTestSSHKey(t),
+			KnownHosts: repoKnownHosts,
+			Bastion: BastionConf{
+				Host:       jumpAddr,
+				User:       testJumpUser,
+				PrivateKey: testSSHKey,
+				KnownHosts: bastionKnownHosts,
+			},
+		},
+	}
+
+	// dialBastion connects to the echo server through the bastion with the
+	// authentication method of a repository.
+	dialBastion := func(auth transport.AuthMethod) error {
+		dialer, ok := auth.(sshDialer)
+		if !ok {
+			t.Fatal("the authentication method doesn't tunnel the connections")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		conn, err := dialer.dialSSH(ctx, echoAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		message := []byte("ping")
+		if _, err := conn.Write(message); err != nil {
+			return err
+		}
+
+		reply := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(reply, message) {
+			return fmt.Errorf("unexpected reply: %q", reply)
+		}
+
+		return nil
+	}
+
+	{
+		repoURL, auth, cleanup, err := newAuth(context.Background(), conf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the "+
+				"bastion: %s", err)
+		}
+		defer cleanup()
+
+		// The repository URL is left as it is.
+		endpoint, err := transport.NewEndpoint(repoURL)
+		if err != nil || endpoint.Host != "git.internal" ||
+			endpoint.Path != "team/repo.git" {
+			t.Fatalf("unexpected URL: %s, %v", repoURL, err)
+		}
+
+		if err := dialBastion(auth); err != nil {
+			t.Fatalf("failed to connect through the bastion: %s", err)
+		}
+
+		sshAuth, ok := auth.(ssh.AuthMethod)
+		if !ok {
+			t.Fatal("unexpected authentication method")
+		}
+
+		config, err := sshAuth.ClientConfig()
+		if err != nil {
+			t.Fatalf("failed to get the SSH client configuration: %s", err)
+		}
+
+		// The repository host key is validated against the repository
+		// known hosts.
+		remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+		if err := config.HostKeyCallback("git.internal:22", remote,
+			signer.PublicKey()); err != nil {
+			t.Fatalf("repository host key was rejected: %s", err)
+		}
+	}
+	{
+		// The bastion known hosts default to the repository ones.
+		bastionConf := conf
+		bastionConf.SSH.Bastion.KnownHosts = ""
+
+		_, auth, cleanup, err := newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the "+
+				"bastion: %s", err)
+		}
+		defer cleanup()
+
+		if err := dialBastion(auth); err == nil {
+			t.Fatal("unknown bastion host key was accepted")
+		}
+
+		bastionConf.SSH.KnownHosts = repoKnownHosts + "\n" + bastionKnownHosts
+
+		_, auth, cleanup, err = newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the "+
+				"bastion: %s", err)
+		}
+		defer cleanup()
+
+		if err := dialBastion(auth); err != nil {
+			t.Fatalf("failed to connect through the bastion: %s", err)
+		}
+	}
+	{
+		// The bastion private key defaults to the repository one.
+		bastionConf := conf
+		bastionConf.SSH.Bastion.PrivateKey = ""
+
+		_, auth, cleanup, err := newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the "+
+				"bastion: %s", err)
+		}
+		defer cleanup()
+
+		if err := dialBastion(auth); err == nil {
+			t.Fatal("unauthorised bastion key was accepted")
+		}
+	}
+	{
+		// An encrypted bastion private key is decrypted with the bastion
+		// passphrase, not with the repository one.
+		bastionConf := conf
+		bastionConf.SSH.Passphrase = testSSHKeyPassphrase
+		bastionConf.SSH.Bastion.PrivateKey = testEncryptedSSHKey
+
+		_, _, _, err := newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err == nil {
+			t.Fatal("SSH bastion private key was decrypted with the " +
+				"repository passphrase")
+		}
+
+		bastionConf.SSH.Passphrase = ""
+		bastionConf.SSH.Bastion.Passphrase = testSSHKeyPassphrase
+
+		_, _, cleanup, err := newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up the encrypted SSH bastion private "+
+				"key: %s", err)
+		}
+		cleanup()
+	}
+	{
+		// The bastion takes precedence over the jump host of the SSH client
+		// configuration file.
+		dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+		if err != nil {
+			t.Fatalf("failed to create a temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		bastionConf := conf
+		bastionConf.SSHConfigPath = writeTestSSHConfig(t, dir,
+			"Host git.internal\n  ProxyJump invalid,chain\n")
+
+		_, _, cleanup, err := newAuth(context.Background(), bastionConf, logger,
+			"git@git.internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the "+
+				"bastion: %s", err)
+		}
+		cleanup()
+	}
+	{
+		// HTTP repositories don't use the bastion.
+		repoURL, _, cleanup, err := newAuth(context.Background(), conf, logger,
+			"https://git.internal/team/repo.git")
+		if err != nil || repoURL != "https://git.internal/team/repo.git" {
+			t.Fatalf("unexpected HTTP repository URL: %s, %v", repoURL, err)
+		}
+		cleanup()
+	}
+}
+
+// TestMirrorBastion tests mirroring to a repository accessed over SSH through
+// a bastion.
+func TestMirrorBastion(t *testing.T) {
+	t.Parallel()
+
+	installTransports()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	gitAddr, gitKnownHosts, stopGit := newTestGitServer(t)
+	defer stopGit()
+
+	jumpAddr, stopJump := newTestJumpHost(t)
+	defer stopJump()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	srcRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-src-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary src repo: %s", err)
+	}
+
+	defer os.RemoveAll(srcRepoPath)
+
+	if _, _, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+	}); err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	dstRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-dst-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary dst repo: %s", err)
+	}
+
+	defer os.RemoveAll(dstRepoPath)
+
+	dstRepo, err := utils.NewBareRepo(dstRepoPath)
+	if err != nil {
+		t.Fatalf("failed to create a test dst repo: %s", err)
+	}
+
+	conf := Config{
+		SrcRepo: srcRepoPath,
+		DstRepos: []string{fmt.Sprintf("ssh://%s@%s%s", testGitUser, gitAddr,
+			dstRepoPath)},
+		SSHConfigPath: sshConfigNone,
+		SSH: SSHConf{
+			PrivateKey: testSSHKey,
+			KnownHosts: gitKnownHosts,
+			Bastion: BastionConf{
+				Host: jumpAddr,
+				User: testJumpUser,
+				KnownHosts: knownhosts.Line([]string{jumpAddr},
+					signer.PublicKey()),
+			},
+		},
+	}
+
+	if _, err := Mirror(conf, logger); err != nil {
+		t.Fatalf("Mirror through the bastion failed: %s", err)
+	}
+
+	dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+	if err != nil {
+		t.Fatalf("failed to get the dst repo refs: %s", err)
+	}
+
+	if !utils.SlicesAreEqual(dstRepoRefs, []string{
+		"HEAD",
+		"refs/heads/master",
+		"refs/heads/a",
+	}) {
+		t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+	}
+}
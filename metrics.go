@@ -0,0 +1,334 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// The outcomes of the job runs.
+const (
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeNotInSync = "not_in_sync"
+)
+
+var (
+	// metricsOutcomes are the outcomes of the job runs, all of them exposed
+	// from the start so that the counters don't appear on the first run.
+	metricsOutcomes = []string{outcomeSuccess, outcomeFailure, outcomeNotInSync}
+	// metricsPhases are the mirroring phases with a duration histogram.
+	metricsPhases = []Phase{PhaseFetch, PhasePush, PhasePrune}
+	// durationBuckets are the upper bounds, in seconds, of the buckets of the
+	// phase duration histograms.
+	durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120,
+		300, 600, 1800}
+)
+
+// histogram is a Prometheus histogram of durations. The counts of its
+// buckets aren't cumulative.
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+
+			break
+		}
+	}
+
+	h.count++
+	h.sum += seconds
+}
+
+// jobMetrics holds the metrics of a job.
+type jobMetrics struct {
+	runs        map[string]uint64
+	running     bool
+	lastSuccess time.Time
+	durations   map[Phase]*histogram
+	refsUpdated uint64
+	refsPruned  uint64
+	fetched     Transfer
+	pushed      Transfer
+}
+
+// metrics holds the metrics of the jobs run by the daemon and serves them in
+// the Prometheus text exposition format.
+type metrics struct {
+	mu    sync.Mutex
+	names []string
+	jobs  map[string]*jobMetrics
+}
+
+func newMetrics(jobs []Job) *metrics {
+	m := &metrics{
+		names: make([]string, 0, len(jobs)),
+		jobs:  make(map[string]*jobMetrics, len(jobs)),
+	}
+
+	for _, job := range jobs {
+		jm := &jobMetrics{
+			runs:      make(map[string]uint64),
+			durations: make(map[Phase]*histogram),
+		}
+
+		for _, phase := range metricsPhases {
+			jm.durations[phase] = newHistogram()
+		}
+
+		m.names = append(m.names, job.Name)
+		m.jobs[job.Name] = jm
+	}
+
+	return m
+}
+
+// runOutcome returns the outcome of a job run.
+func runOutcome(err error) string {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case errors.Is(err, ErrNotInSync):
+		return outcomeNotInSync
+	default:
+		return outcomeFailure
+	}
+}
+
+// start records the start of a job run.
+func (m *metrics) start(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if jm, ok := m.jobs[name]; ok {
+		jm.running = true
+	}
+}
+
+// record records the result of a job run finished at the provided time.
+func (m *metrics) record(jr JobResult, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jm, ok := m.jobs[jr.Job.Name]
+	if !ok {
+		return
+	}
+
+	jm.running = false
+
+	outcome := runOutcome(jr.Err)
+	jm.runs[outcome]++
+
+	if outcome == outcomeSuccess {
+		jm.lastSuccess = at
+	}
+
+	// The job failed before mirroring, for example on an invalid
+	// configuration.
+	if jr.Result == nil {
+		return
+	}
+
+	if d, ok := jr.Result.Durations[PhaseFetch]; ok {
+		jm.durations[PhaseFetch].observe(d)
+	}
+
+	jm.fetched.Objects += jr.Result.Fetched.Objects
+	jm.fetched.Bytes += jr.Result.Fetched.Bytes
+
+	for _, dst := range jr.Result.Dsts {
+		for _, phase := range []Phase{PhasePush, PhasePrune} {
+			if d, ok := dst.Durations[phase]; ok {
+				jm.durations[phase].observe(d)
+			}
+		}
+
+		jm.pushed.Objects += dst.Pushed.Objects
+		jm.pushed.Bytes += dst.Pushed.Bytes
+
+		// Nothing is applied in dry-run mode.
+		if jr.Result.DryRun {
+			continue
+		}
+
+		counts := dst.Counts()
+		jm.refsUpdated += uint64(counts[RefCreated] + counts[RefUpdated] +
+			counts[RefForced])
+		jm.refsPruned += uint64(counts[RefDeleted])
+	}
+}
+
+// escapeLabel escapes a label value of the text exposition format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat formats a sample value of the text exposition format.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeHeader writes the help and the type of a metric.
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// write writes the metrics in the text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "git_mirror_me_job_runs_total", "counter",
+		"Total number of job runs by outcome.")
+
+	for _, name := range m.names {
+		for _, outcome := range metricsOutcomes {
+			fmt.Fprintf(w, "git_mirror_me_job_runs_total{job=\"%s\",outcome=\"%s\"} %d\n",
+				escapeLabel(name), outcome, m.jobs[name].runs[outcome])
+		}
+	}
+
+	writeHeader(w, "git_mirror_me_job_running", "gauge",
+		"Whether the job is running.")
+
+	for _, name := range m.names {
+		running := 0
+		if m.jobs[name].running {
+			running = 1
+		}
+
+		fmt.Fprintf(w, "git_mirror_me_job_running{job=\"%s\"} %d\n",
+			escapeLabel(name), running)
+	}
+
+	writeHeader(w, "git_mirror_me_job_last_success_timestamp_seconds", "gauge",
+		"Unix time of the last successful job run, 0 if none.")
+
+	for _, name := range m.names {
+		var timestamp float64
+		if lastSuccess := m.jobs[name].lastSuccess; !lastSuccess.IsZero() {
+			timestamp = float64(lastSuccess.UnixNano()) / float64(time.Second)
+		}
+
+		fmt.Fprintf(w, "git_mirror_me_job_last_success_timestamp_seconds{job=\"%s\"} %s\n",
+			escapeLabel(name), formatFloat(timestamp))
+	}
+
+	writeHeader(w, "git_mirror_me_job_phase_duration_seconds", "histogram",
+		"Duration of the mirroring phases, per destination for push and prune.")
+
+	for _, name := range m.names {
+		for _, phase := range metricsPhases {
+			m.writeHistogram(w, name, phase)
+		}
+	}
+
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(*jobMetrics) uint64
+	}{
+		{"git_mirror_me_job_refs_updated_total",
+			"Total number of destination references created or updated.",
+			func(jm *jobMetrics) uint64 { return jm.refsUpdated }},
+		{"git_mirror_me_job_refs_pruned_total",
+			"Total number of destination references pruned.",
+			func(jm *jobMetrics) uint64 { return jm.refsPruned }},
+	} {
+		writeHeader(w, counter.name, "counter", counter.help)
+
+		for _, name := range m.names {
+			fmt.Fprintf(w, "%s{job=\"%s\"} %d\n", counter.name,
+				escapeLabel(name), counter.value(m.jobs[name]))
+		}
+	}
+
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(Transfer) int64
+	}{
+		{"git_mirror_me_job_transferred_objects_total",
+			"Total number of objects in the fetched and pushed packfiles.",
+			func(t Transfer) int64 { return t.Objects }},
+		{"git_mirror_me_job_transferred_bytes_total",
+			"Total size of the fetched and pushed packfiles in bytes.",
+			func(t Transfer) int64 { return t.Bytes }},
+	} {
+		writeHeader(w, counter.name, "counter", counter.help)
+
+		for _, name := range m.names {
+			jm := m.jobs[name]
+
+			fmt.Fprintf(w, "%s{job=\"%s\",direction=\"fetch\"} %d\n",
+				counter.name, escapeLabel(name), counter.value(jm.fetched))
+			fmt.Fprintf(w, "%s{job=\"%s\",direction=\"push\"} %d\n",
+				counter.name, escapeLabel(name), counter.value(jm.pushed))
+		}
+	}
+}
+
+// writeHistogram writes the duration histogram of a job phase.
+func (m *metrics) writeHistogram(w io.Writer, name string, phase Phase) {
+	const metric = "git_mirror_me_job_phase_duration_seconds"
+
+	h := m.jobs[name].durations[phase]
+	labels := fmt.Sprintf("job=\"%s\",phase=\"%s\"", escapeLabel(name), phase)
+
+	var cumulative uint64
+
+	for i, bound := range durationBuckets {
+		cumulative += h.buckets[i]
+
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", metric, labels,
+			formatFloat(bound), cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", metric, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", metric, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", metric, labels, h.count)
+}
+
+// ServeHTTP serves the metrics.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	// The metrics are rendered before writing them so a slow client doesn't
+	// hold the lock and block the jobs recording their runs.
+	var buf bytes.Buffer
+
+	m.write(&buf)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	_, _ = buf.WriteTo(w)
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetrics tests recording the job runs and writing the metrics.
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := newMetrics([]Job{{Name: "a"}, {Name: `b"\`}})
+
+	m.start("a")
+	m.record(JobResult{
+		Job: Job{Name: "a"},
+		Result: &MirrorResult{
+			Durations: map[Phase]time.Duration{PhaseFetch: 2 * time.Second},
+			Fetched:   Transfer{Objects: 3, Bytes: 300},
+			Dsts: []DstResult{
+				{
+					Updates: []RefUpdate{
+						{Action: RefCreated},
+						{Action: RefForced},
+						{Action: RefDeleted},
+						{Action: RefUnchanged},
+						{Action: RefRejected},
+					},
+					Durations: map[Phase]time.Duration{
+						PhaseList:  time.Second,
+						PhasePush:  time.Second,
+						PhasePrune: 50 * time.Millisecond,
+					},
+					Pushed: Transfer{Objects: 2, Bytes: 200},
+				},
+				{
+					Updates:   []RefUpdate{{Action: RefUpdated}},
+					Durations: map[Phase]time.Duration{PhasePush: time.Hour},
+					Pushed:    Transfer{Objects: 1, Bytes: 100},
+				},
+			},
+		},
+	}, time.Unix(1700000000, 500000000))
+	m.start(`b"\`)
+	m.record(JobResult{Job: Job{Name: "a"}, Err: ErrNotInSync,
+		Result: &MirrorResult{
+			DryRun: true,
+			Dsts: []DstResult{
+				{Updates: []RefUpdate{{Action: RefCreated}}},
+			},
+		}}, time.Now())
+	m.record(JobResult{Job: Job{Name: "a"}, Err: errors.New("failed")},
+		time.Now())
+	m.record(JobResult{Job: Job{Name: "unknown"}}, time.Now())
+
+	var buf bytes.Buffer
+
+	m.write(&buf)
+
+	output := buf.String()
+
+	for _, line := range []string{
+		"# TYPE git_mirror_me_job_runs_total counter",
+		`git_mirror_me_job_runs_total{job="a",outcome="success"} 1`,
+		`git_mirror_me_job_runs_total{job="a",outcome="failure"} 1`,
+		`git_mirror_me_job_runs_total{job="a",outcome="not_in_sync"} 1`,
+		`git_mirror_me_job_runs_total{job="b\"\\",outcome="success"} 0`,
+		`git_mirror_me_job_running{job="a"} 0`,
+		`git_mirror_me_job_running{job="b\"\\"} 1`,
+		`git_mirror_me_job_last_success_timestamp_seconds{job="a"} 1.7000000005e+09`,
+		`git_mirror_me_job_last_success_timestamp_seconds{job="b\"\\"} 0`,
+		"# TYPE git_mirror_me_job_phase_duration_seconds histogram",
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="fetch",le="1"} 0`,
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="fetch",le="2.5"} 1`,
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="push",le="1"} 1`,
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="push",le="1800"} 1`,
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="push",le="+Inf"} 2`,
+		`git_mirror_me_job_phase_duration_seconds_sum{job="a",phase="push"} 3601`,
+		`git_mirror_me_job_phase_duration_seconds_count{job="a",phase="push"} 2`,
+		`git_mirror_me_job_phase_duration_seconds_bucket{job="a",phase="prune",le="0.1"} 1`,
+		`git_mirror_me_job_phase_duration_seconds_count{job="b\"\\",phase="fetch"} 0`,
+		`git_mirror_me_job_refs_updated_total{job="a"} 3`,
+		`git_mirror_me_job_refs_pruned_total{job="a"} 1`,
+		`git_mirror_me_job_transferred_objects_total{job="a",direction="fetch"} 3`,
+		`git_mirror_me_job_transferred_objects_total{job="a",direction="push"} 3`,
+		`git_mirror_me_job_transferred_bytes_total{job="a",direction="fetch"} 300`,
+		`git_mirror_me_job_transferred_bytes_total{job="a",direction="push"} 300`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Fatalf("metric not found: %s\n%s", line, output)
+		}
+	}
+}
+
+// TestDaemonMetrics tests serving the metrics of the job runs.
+func TestDaemonMetrics(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	daemon, err := NewDaemon([]Job{
+		{Name: "a", Schedule: ScheduleConf{Interval: time.Hour}},
+	}, DaemonConf{}, logger)
+	if err != nil {
+		t.Fatalf("failed to create the daemon: %s", err)
+	}
+
+	runs := newTestRuns()
+	daemon.run = runs.run(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	if err := daemon.Run(ctx); err != nil {
+		t.Fatalf("daemon failed: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	daemon.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/metrics", nil))
+
+	if rec.Code != http.StatusOK ||
+		rec.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("unexpected response: %d: %s", rec.Code,
+			rec.Header().Get("Content-Type"))
+	}
+
+	if !strings.Contains(rec.Body.String(),
+		`git_mirror_me_job_runs_total{job="a",outcome="success"} 1`+"\n") {
+		t.Fatalf("run not reported:\n%s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	daemon.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+		"/metrics", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+}
@@ -7,8 +7,14 @@ package mirror
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"net/url"
+	"strings"
+	"unicode"
 )
 
+// redacted replaces the credentials in redacted strings.
+const redacted = "redacted"
+
 func mask(what string) string {
 	var masked string
 
@@ -19,3 +25,84 @@ func mask(what string) string {
 
 	return masked
 }
+
+// splitList splits a string holding a list of values separated by commas
+// and/or whitespaces. Empty values are dropped.
+func splitList(list string) []string {
+	values := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values
+}
+
+// RedactURL returns a repository URL with its credentials replaced. For HTTP
+// URLs, the user name is also considered a credential (for example, a token
+// used as user name). Repository locations that are not URLs (for example,
+// paths or scp-like SSH locations) are returned as they are.
+func RedactURL(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+
+	_, hasPassword := u.User.Password()
+
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		u.User = url.User(redacted)
+	case hasPassword:
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	return u.String()
+}
+
+// redactedError is an error whose message has the credentials of a
+// repository URL redacted. It unwraps to the original error.
+type redactedError struct {
+	err      error
+	userinfo string
+	redacted string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.userinfo, e.redacted)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns an error with the credentials of a repository URL
+// redacted from its message, as with RedactURL. The errors of the remote
+// operations can hold the URL (for example, the go-git HTTP errors). A
+// *PhaseError stays the outermost error.
+func redactError(err error, repo string) error {
+	if err == nil {
+		return nil
+	}
+
+	if phaseErr, ok := err.(*PhaseError); ok {
+		return phaseError(phaseErr.Phase, redactError(phaseErr.Err, repo))
+	}
+
+	u, parseErr := url.Parse(repo)
+	if parseErr != nil || u.User == nil {
+		return err
+	}
+
+	redactedURL, parseErr := url.Parse(RedactURL(repo))
+	if parseErr != nil || redactedURL.User.String() == u.User.String() {
+		return err
+	}
+
+	return &redactedError{
+		err:      err,
+		userinfo: u.User.String() + "@",
+		redacted: redactedURL.User.String() + "@",
+	}
+}
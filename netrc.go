@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcNone disables the netrc file.
+const netrcNone = "none"
+
+var ErrNetrc = errors.New("invalid netrc file")
+
+// netrcEntry structure holds the credentials of a netrc machine. The default
+// entry has no machine name.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// defaultNetrcPath returns the path of the netrc file of the user.
+func defaultNetrcPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".netrc")
+}
+
+// loadNetrc parses a netrc file. When the path is empty, the netrc file of the
+// user is used, if it exists. No entries are returned when the netrc file is
+// disabled.
+func loadNetrc(path string) ([]netrcEntry, error) {
+	if path == netrcNone {
+		return nil, nil
+	}
+
+	optional := len(path) == 0
+	if optional {
+		path = defaultNetrcPath()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if optional {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrNetrc, err)
+	}
+
+	entries, err := parseNetrc(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrNetrc, path, err)
+	}
+
+	return entries, nil
+}
+
+// parseNetrc parses the content of a netrc file. The 'account' values are
+// ignored and the macro definitions are skipped.
+func parseNetrc(content string) ([]netrcEntry, error) {
+	var (
+		entries []netrcEntry
+		entry   *netrcEntry
+	)
+
+	lines := strings.Split(content, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+
+		for j := 0; j < len(fields); j++ {
+			token := fields[j]
+
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+
+			// The keywords other than 'default' are followed by a value.
+			var value string
+
+			if token != "default" {
+				if j+1 == len(fields) {
+					return nil, fmt.Errorf("missing value for '%s' on line %d",
+						token, i+1)
+				}
+
+				j++
+				value = fields[j]
+			}
+
+			switch token {
+			case "machine", "default":
+				entries = append(entries, netrcEntry{machine: value})
+				entry = &entries[len(entries)-1]
+			case "login", "password", "account":
+				if entry == nil {
+					return nil, fmt.Errorf("'%s' outside of a machine on "+
+						"line %d", token, i+1)
+				}
+
+				if token == "login" {
+					entry.login = value
+				} else if token == "password" {
+					entry.password = value
+				}
+			case "macdef":
+				// A macro definition ends with an empty line.
+				for i+1 < len(lines) && len(strings.TrimSpace(lines[i+1])) != 0 {
+					i++
+				}
+
+				j = len(fields)
+			default:
+				return nil, fmt.Errorf("unknown keyword '%s' on line %d",
+					token, i+1)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// lookupNetrc returns the netrc entry of a host falling back to the default
+// entry. When a user is provided, only the entries without login or with the
+// same login are considered. The second returned value is false when no entry
+// is found.
+func lookupNetrc(entries []netrcEntry, host, user string) (netrcEntry, bool) {
+	var (
+		fallback netrcEntry
+		found    bool
+	)
+
+	for _, entry := range entries {
+		if len(user) != 0 && len(entry.login) != 0 && entry.login != user {
+			continue
+		}
+
+		if entry.machine == host {
+			return entry, true
+		}
+
+		if len(entry.machine) == 0 && !found {
+			fallback, found = entry, true
+		}
+	}
+
+	return fallback, found
+}
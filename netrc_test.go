@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// TestParseNetrc tests parsing netrc files.
+func TestParseNetrc(t *testing.T) {
+	t.Parallel()
+
+	{
+		entries, err := parseNetrc(`# Comment
+machine git.example.com
+  login user
+  password secret
+
+machine other.example.com login other password othersecret account acct
+
+macdef init
+cd /pub
+bin
+
+default login anonymous password guest # Trailing comment
+`)
+		if err != nil {
+			t.Fatalf("failed to parse a netrc file: %s", err)
+		}
+
+		if !reflect.DeepEqual(entries, []netrcEntry{
+			{machine: "git.example.com", login: "user", password: "secret"},
+			{machine: "other.example.com", login: "other", password: "othersecret"},
+			{login: "anonymous", password: "guest"},
+		}) {
+			t.Fatalf("unexpected netrc entries: %+v", entries)
+		}
+	}
+	{
+		entries, err := parseNetrc("")
+		if err != nil || len(entries) != 0 {
+			t.Fatalf("unexpected entries for an empty netrc file: %+v, %v",
+				entries, err)
+		}
+	}
+
+	for _, content := range []string{
+		"machine",
+		"login user",
+		"machine git.example.com invalid value",
+		"machine git.example.com login",
+	} {
+		if _, err := parseNetrc(content); err == nil {
+			t.Fatalf("invalid netrc file was allowed: %s", content)
+		}
+	}
+}
+
+// TestLookupNetrc tests looking up the netrc credentials of a host.
+func TestLookupNetrc(t *testing.T) {
+	t.Parallel()
+
+	entries := []netrcEntry{
+		{machine: "git.example.com", login: "user", password: "secret"},
+		{machine: "git.example.com", login: "other", password: "othersecret"},
+		{machine: "token.example.com", password: "token"},
+		{login: "anonymous", password: "guest"},
+	}
+
+	for _, test := range []struct {
+		host  string
+		user  string
+		entry netrcEntry
+		found bool
+	}{
+		{"git.example.com", "", entries[0], true},
+		{"git.example.com", "other", entries[1], true},
+		{"token.example.com", "user", entries[2], true},
+		{"unknown.example.com", "", entries[3], true},
+		{"unknown.example.com", "user", netrcEntry{}, false},
+	} {
+		entry, found := lookupNetrc(entries, test.host, test.user)
+		if entry != test.entry || found != test.found {
+			t.Fatalf("unexpected netrc entry for %s and %s: %+v, %v", test.host,
+				test.user, entry, found)
+		}
+	}
+
+	if _, found := lookupNetrc(nil, "git.example.com", ""); found {
+		t.Fatal("netrc entry found without entries")
+	}
+}
+
+// TestLoadNetrc tests loading netrc files.
+func TestLoadNetrc(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{
+		entries, err := loadNetrc(netrcNone)
+		if err != nil || entries != nil {
+			t.Fatalf("disabled netrc file was loaded: %+v, %v", entries, err)
+		}
+	}
+	{
+		netrcPath := writeTestFile(t, dir, "netrc",
+			[]byte("machine git.example.com password secret\n"))
+
+		entries, err := loadNetrc(netrcPath)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("failed to load the netrc file: %+v, %v", entries, err)
+		}
+	}
+	{
+		_, err := loadNetrc(path.Join(dir, "missing"))
+		if !errors.Is(err, ErrNetrc) {
+			t.Fatal("missing netrc file was allowed")
+		}
+
+		invalidPath := writeTestFile(t, dir, "invalid", []byte("login user\n"))
+		if _, err := loadNetrc(invalidPath); !errors.Is(err, ErrNetrc) {
+			t.Fatal("invalid netrc file was allowed")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// isFastForward reports whether updating a reference from the old to the new
+// hash is a fast-forward. Hashes that are not commits in the repository (for
+// example, the old hash is not known) are never fast-forwards.
+func isFastForward(repo *git.Repository, old, new plumbing.Hash) bool {
+	oldCommit, err := repo.CommitObject(old)
+	if err != nil {
+		return false
+	}
+
+	newCommit, err := repo.CommitObject(new)
+	if err != nil {
+		return false
+	}
+
+	ok, err := oldCommit.IsAncestor(newCommit)
+
+	return err == nil && ok
+}
+
+// planRefUpdates computes the updates mirroring the staging repository makes
+// to the references of a destination repository. The updates are sorted by
+// reference name.
+func planRefUpdates(repo *git.Repository, dstRefs []*plumbing.Reference, rc refsConf) ([]RefUpdate, error) {
+	// Map the staging repository references to their destination names.
+	newRefs := make(map[plumbing.ReferenceName]plumbing.Hash)
+
+	refs, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get references: %w", err)
+	}
+
+	_ = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		for _, spec := range rc.mapping {
+			if spec.Match(ref.Name()) {
+				newRefs[spec.Dst(ref.Name())] = ref.Hash()
+			}
+		}
+
+		return nil
+	})
+
+	oldRefs := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, ref := range dstRefs {
+		oldRefs[ref.Name()] = ref.Hash()
+	}
+
+	updates := make([]RefUpdate, 0, len(newRefs))
+
+	for name, newHash := range newRefs {
+		oldHash, found := oldRefs[name]
+
+		update := RefUpdate{
+			Name: name,
+			Old:  oldHash,
+			New:  newHash,
+		}
+
+		switch {
+		case !found:
+			update.Action = RefCreated
+		case oldHash == newHash:
+			update.Action = RefUnchanged
+		case isFastForward(repo, oldHash, newHash):
+			update.Action = RefUpdated
+		default:
+			update.Action = RefForced
+		}
+
+		updates = append(updates, update)
+	}
+
+	deleteRefs, err := extraRefs(repo, dstRefs, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range deleteRefs {
+		updates = append(updates, RefUpdate{
+			Name:   ref.Name(),
+			Old:    ref.Hash(),
+			Action: RefDeleted,
+		})
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Name < updates[j].Name
+	})
+
+	return updates, nil
+}
+
+// rejectUnapplied marks as rejected the updates that are not reflected in the
+// references of the destination listed after mirroring. A nil refs slice
+// marks all the updates changing the destination as rejected.
+func rejectUnapplied(updates []RefUpdate, refs []*plumbing.Reference) {
+	refHashes := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, ref := range refs {
+		refHashes[ref.Name()] = ref.Hash()
+	}
+
+	for i, update := range updates {
+		if update.Action == RefUnchanged {
+			continue
+		}
+
+		// Deleted references are expected to be missing and their hash
+		// defaults to the zero hash.
+		if refs == nil || refHashes[update.Name] != update.New {
+			updates[i].Action = RefRejected
+		}
+	}
+}
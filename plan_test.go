@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitOnTop creates a new commit in a repository having the parent commit
+// as its only parent and returns its hash.
+func commitOnTop(t *testing.T, repo *git.Repository, parent plumbing.Hash) plumbing.Hash {
+	t.Helper()
+
+	parentCommit, err := repo.CommitObject(parent)
+	if err != nil {
+		t.Fatalf("failed to get the parent commit: %s", err)
+	}
+
+	signature := object.Signature{
+		Name:  "Example",
+		Email: "ex@ample.com",
+		When:  time.Now(),
+	}
+	commit := object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      "child commit",
+		TreeHash:     parentCommit.TreeHash,
+		ParentHashes: []plumbing.Hash{parent},
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		t.Fatalf("failed to encode the commit: %s", err)
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatalf("failed to store the commit: %s", err)
+	}
+
+	return hash
+}
+
+// TestPlanRefUpdates tests the planRefUpdates function.
+func TestPlanRefUpdates(t *testing.T) {
+	t.Parallel()
+
+	path, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary repo: %s", err)
+	}
+
+	defer os.RemoveAll(path)
+
+	repo, head, err := utils.NewTestRepo(path, []string{
+		"refs/heads/unchanged",
+		"refs/heads/create",
+		"refs/heads/force-unknown",
+		"refs/heads/force-known",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test repo: %s", err)
+	}
+
+	child := commitOnTop(t, repo, head)
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference(
+		"refs/heads/fast-forward", child))
+	if err != nil {
+		t.Fatalf("failed to set reference: %s", err)
+	}
+
+	unknown := plumbing.NewHash("1111111111111111111111111111111111111111")
+
+	updates, err := planRefUpdates(repo, []*plumbing.Reference{
+		plumbing.NewHashReference("HEAD", head),
+		plumbing.NewHashReference("refs/heads/master", head),
+		plumbing.NewHashReference("refs/heads/unchanged", head),
+		plumbing.NewHashReference("refs/heads/fast-forward", head),
+		plumbing.NewHashReference("refs/heads/force-unknown", unknown),
+		plumbing.NewHashReference("refs/heads/force-known", child),
+		plumbing.NewHashReference("refs/heads/delete", head),
+	}, identityRefsConf)
+	if err != nil {
+		t.Fatalf("failed to plan the ref updates: %s", err)
+	}
+
+	expected := []RefUpdate{
+		{"refs/heads/create", plumbing.ZeroHash, head, RefCreated},
+		{"refs/heads/delete", head, plumbing.ZeroHash, RefDeleted},
+		{"refs/heads/fast-forward", head, child, RefUpdated},
+		{"refs/heads/force-known", child, head, RefForced},
+		{"refs/heads/force-unknown", unknown, head, RefForced},
+		{"refs/heads/master", head, head, RefUnchanged},
+		{"refs/heads/unchanged", head, head, RefUnchanged},
+	}
+
+	if len(updates) != len(expected) {
+		t.Fatalf("unexpected ref updates: %s", updates)
+	}
+
+	for i := range updates {
+		if updates[i] != expected[i] {
+			t.Fatalf("unexpected ref update: got %s, expected %s", updates[i],
+				expected[i])
+		}
+	}
+}
+
+// TestPlanRefUpdatesMapping tests the planRefUpdates function with a reference
+// mapping.
+func TestPlanRefUpdatesMapping(t *testing.T) {
+	t.Parallel()
+
+	path, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary repo: %s", err)
+	}
+
+	defer os.RemoveAll(path)
+
+	repo, head, err := utils.NewTestRepo(path, []string{
+		"refs/heads/a",
+		"refs/tags/v1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test repo: %s", err)
+	}
+
+	rc, err := newRefsConf(Config{
+		RefMappings: []string{"refs/heads/*:refs/heads/upstream/*"},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse the reference configuration: %s", err)
+	}
+
+	updates, err := planRefUpdates(repo, []*plumbing.Reference{
+		plumbing.NewHashReference("refs/heads/own", head),
+		plumbing.NewHashReference("refs/heads/upstream/a", head),
+		plumbing.NewHashReference("refs/heads/upstream/stale", head),
+	}, rc)
+	if err != nil {
+		t.Fatalf("failed to plan the ref updates: %s", err)
+	}
+
+	expected := []RefUpdate{
+		{"refs/heads/upstream/a", head, head, RefUnchanged},
+		{"refs/heads/upstream/master", plumbing.ZeroHash, head, RefCreated},
+		{"refs/heads/upstream/stale", head, plumbing.ZeroHash, RefDeleted},
+	}
+
+	if len(updates) != len(expected) {
+		t.Fatalf("unexpected ref updates: %s", updates)
+	}
+
+	for i := range updates {
+		if updates[i] != expected[i] {
+			t.Fatalf("unexpected ref update: got %s, expected %s", updates[i],
+				expected[i])
+		}
+	}
+}
+
+// TestRejectUnapplied tests the rejectUnapplied function.
+func TestRejectUnapplied(t *testing.T) {
+	t.Parallel()
+
+	old := plumbing.NewHash("1111111111111111111111111111111111111111")
+	new := plumbing.NewHash("2222222222222222222222222222222222222222")
+
+	newUpdates := func() []RefUpdate {
+		return []RefUpdate{
+			{"refs/heads/created", plumbing.ZeroHash, new, RefCreated},
+			{"refs/heads/deleted", old, plumbing.ZeroHash, RefDeleted},
+			{"refs/heads/forced", old, new, RefForced},
+			{"refs/heads/unchanged", old, old, RefUnchanged},
+		}
+	}
+
+	{
+		// All the updates applied.
+		updates := newUpdates()
+		rejectUnapplied(updates, []*plumbing.Reference{
+			plumbing.NewHashReference("refs/heads/created", new),
+			plumbing.NewHashReference("refs/heads/forced", new),
+			plumbing.NewHashReference("refs/heads/unchanged", old),
+		})
+
+		for i, update := range newUpdates() {
+			if updates[i] != update {
+				t.Fatalf("applied update rejected: %s", updates[i])
+			}
+		}
+	}
+	{
+		// None of the updates applied.
+		updates := newUpdates()
+		rejectUnapplied(updates, []*plumbing.Reference{
+			plumbing.NewHashReference("refs/heads/deleted", old),
+			plumbing.NewHashReference("refs/heads/forced", old),
+			plumbing.NewHashReference("refs/heads/unchanged", old),
+		})
+
+		for _, update := range updates[:3] {
+			if update.Action != RefRejected {
+				t.Fatalf("unapplied update not rejected: %s", update)
+			}
+		}
+
+		if updates[3].Action != RefUnchanged {
+			t.Fatalf("unchanged update rejected: %s", updates[3])
+		}
+	}
+	{
+		// Unknown destination references.
+		updates := newUpdates()
+		rejectUnapplied(updates, nil)
+
+		for _, update := range updates[:3] {
+			if update.Action != RefRejected {
+				t.Fatalf("unknown update not rejected: %s", update)
+			}
+		}
+
+		if updates[3].Action != RefUnchanged {
+			t.Fatalf("unchanged update rejected: %s", updates[3])
+		}
+	}
+}
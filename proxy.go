@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// requestProxy returns the proxy of a request to an HTTP(S) repository based
+// on the proxy configuration in the request context. Without a configured
+// HTTP(S) proxy, the proxy of the process environment is used.
+func requestProxy(req *http.Request) (*url.URL, error) {
+	proxyConf := requestRemoteConf(req).proxy
+	if len(proxyConf.HTTPSProxy) == 0 && len(proxyConf.HTTPProxy) == 0 {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	config := httpproxy.Config{
+		HTTPProxy:  proxyConf.HTTPProxy,
+		HTTPSProxy: proxyConf.HTTPSProxy,
+		NoProxy:    proxyConf.NoProxy,
+	}
+
+	return config.ProxyFunc()(req.URL)
+}
+
+// newSSHProxyDialer returns the dialer connecting to the SSH hosts through the
+// SOCKS5 proxy, the hosts matching NoProxy being reached directly. The SSH
+// authentication methods dial with it themselves so the proxy settings of the
+// process environment are left as they are. Without an SSH proxy, it returns
+// nil.
+func newSSHProxyDialer(proxyConf ProxyConf) (proxy.Dialer, error) {
+	if len(proxyConf.SSHProxy) == 0 {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxyConf.SSHProxy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrProxy, err.Error())
+	}
+
+	socks, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrProxy, err.Error())
+	}
+
+	dialer := proxy.NewPerHost(socks, proxy.Direct)
+	dialer.AddFromString(proxyConf.NoProxy)
+
+	return dialer, nil
+}
+
+// isSOCKS5Proxy returns true if a proxy URL is a SOCKS5 one.
+func isSOCKS5Proxy(proxyURL string) bool {
+	u, err := url.Parse(proxyURL)
+
+	return err == nil && (u.Scheme == "socks5" || u.Scheme == "socks5h")
+}
+
+// validate checks the proxy URLs.
+func (proxyConf ProxyConf) validate() error {
+	for _, proxyURL := range []string{proxyConf.HTTPSProxy, proxyConf.HTTPProxy} {
+		if len(proxyURL) == 0 {
+			continue
+		}
+
+		// Like for curl, the HTTP proxies can omit the scheme.
+		if !strings.Contains(proxyURL, "://") {
+			proxyURL = "http://" + proxyURL
+		}
+
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrProxy, err.Error())
+		}
+
+		if len(u.Host) == 0 {
+			return fmt.Errorf("%w: no host in %s", ErrProxy,
+				maskProxyURL(proxyURL))
+		}
+	}
+
+	if len(proxyConf.SSHProxy) != 0 {
+		if !isSOCKS5Proxy(proxyConf.SSHProxy) {
+			return fmt.Errorf("%w: the SSH proxy must be a SOCKS5 proxy: %s",
+				ErrProxy, maskProxyURL(proxyConf.SSHProxy))
+		}
+
+		if _, err := newSSHProxyDialer(proxyConf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maskProxyURL masks the credentials of a proxy URL. The password is masked
+// or, without a password, the user name as it can hold a token. Proxy URLs
+// without a scheme are handled as HTTP ones.
+func maskProxyURL(proxyURL string) string {
+	if len(proxyURL) == 0 {
+		return proxyURL
+	}
+
+	prefix := ""
+	if !strings.Contains(proxyURL, "://") {
+		prefix = "http://"
+	}
+
+	u, err := url.Parse(prefix + proxyURL)
+	if err != nil {
+		// Don't risk leaking credentials in an URL that can't be parsed.
+		return mask(proxyURL)
+	}
+
+	if u.User == nil {
+		return proxyURL
+	}
+
+	if password, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), mask(password))
+	} else {
+		u.User = url.User(mask(u.User.Username()))
+	}
+
+	return strings.TrimPrefix(u.String(), prefix)
+}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	refFilterNegation = "!"
+	refsPrefix        = "refs/"
+)
+
+var (
+	// Do not mirror GitHub special references used for dealing with pull
+	// requests unless a configured rule includes them.
+	defaultRefFilters = []string{"!refs/pull/*"}
+	// Mirror all the references with their source names unless configured
+	// otherwise.
+	defaultRefMappings = []string{"refs/*:refs/*"}
+)
+
+var (
+	ErrRefFilter  = errors.New("invalid reference filter")
+	ErrRefMapping = errors.New("invalid reference mapping")
+)
+
+// refRule is a parsed reference filter rule.
+type refRule struct {
+	re      *regexp.Regexp
+	exclude bool
+}
+
+// refFilter is an ordered set of include/exclude reference rules.
+type refFilter []refRule
+
+// globToRegexp translates a reference glob pattern into an anchored regular
+// expression. '*' matches any sequence of characters (including '/') and '?'
+// matches any single character. A pattern with no wildcards matches the
+// reference with that exact name and all the references under it.
+func globToRegexp(pattern string) string {
+	if !strings.ContainsAny(pattern, "*?") {
+		pattern = strings.TrimSuffix(pattern, "/")
+
+		return "^" + regexp.QuoteMeta(pattern) + "(/.*)?$"
+	}
+
+	var expr strings.Builder
+
+	expr.WriteString("^")
+
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	return expr.String()
+}
+
+// newRefFilter parses a slice of reference filter rules. Each rule is a glob
+// pattern including the matching references. Rules prefixed with '!' exclude
+// the matching references instead.
+func newRefFilter(rules []string) (refFilter, error) {
+	filter := make(refFilter, 0, len(rules))
+
+	for _, rule := range rules {
+		exclude := strings.HasPrefix(rule, refFilterNegation)
+		pattern := strings.TrimPrefix(rule, refFilterNegation)
+
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrRefFilter, rule)
+		}
+
+		re, err := regexp.Compile(globToRegexp(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %s", ErrRefFilter, rule, err)
+		}
+
+		filter = append(filter, refRule{
+			re:      re,
+			exclude: exclude,
+		})
+	}
+
+	return filter, nil
+}
+
+// match reports whether a reference name passes the filter. The rules are
+// evaluated in order and the last matching rule decides. When no rule matches,
+// the reference is included only if the filter has no include rules.
+func (f refFilter) match(name string) bool {
+	included := true
+
+	for _, rule := range f {
+		if !rule.exclude {
+			included = false
+
+			break
+		}
+	}
+
+	for _, rule := range f {
+		if rule.re.MatchString(name) {
+			included = !rule.exclude
+		}
+	}
+
+	return included
+}
+
+// isFilterable reports whether a reference is subject to filtering.
+func isFilterable(name plumbing.ReferenceName) bool {
+	return strings.HasPrefix(name.String(), refsPrefix)
+}
+
+// refMapping is a set of refspec-like rules mapping source reference names to
+// destination reference names.
+type refMapping []config.RefSpec
+
+// newRefMapping parses a slice of reference mapping rules. Each rule has the
+// '<src>:<dst>' format where both sides are reference names under 'refs/',
+// optionally using a single '*' wildcard on both sides.
+func newRefMapping(rules []string) (refMapping, error) {
+	mapping := make(refMapping, 0, len(rules))
+
+	for _, rule := range rules {
+		spec := config.RefSpec(rule)
+
+		if err := spec.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %q: %s", ErrRefMapping, rule, err)
+		}
+
+		if spec.IsForceUpdate() ||
+			!strings.HasPrefix(spec.Src(), refsPrefix) ||
+			!strings.HasPrefix(spec.Reverse().Src(), refsPrefix) {
+			return nil, fmt.Errorf("%w: %q", ErrRefMapping, rule)
+		}
+
+		mapping = append(mapping, spec)
+	}
+
+	return mapping, nil
+}
+
+// pushSpecs returns the mapping as a new slice of forced push refspecs. A new
+// slice is returned as git.Remote.Push modifies the refspecs it is passed.
+func (m refMapping) pushSpecs() []config.RefSpec {
+	specs := make([]config.RefSpec, 0, len(m))
+	for _, spec := range m {
+		specs = append(specs, config.RefSpec("+"+spec.String()))
+	}
+
+	return specs
+}
+
+// srcNames returns the source reference names that map to a destination
+// reference name. An empty slice means that the destination reference is
+// outside the namespace of the mapping.
+func (m refMapping) srcNames(name plumbing.ReferenceName) []plumbing.ReferenceName {
+	var names []plumbing.ReferenceName
+
+	for _, spec := range m {
+		reverse := spec.Reverse()
+		if reverse.Match(name) {
+			names = append(names, reverse.Dst(name))
+		}
+	}
+
+	return names
+}
+
+// refsConf holds the parsed reference configuration used when mirroring.
+type refsConf struct {
+	filter  refFilter
+	mapping refMapping
+}
+
+// newRefsConf parses the reference filters and mappings of a configuration.
+func newRefsConf(conf Config) (refsConf, error) {
+	filter, err := newRefFilter(conf.GetRefFilters())
+	if err != nil {
+		return refsConf{}, err
+	}
+
+	mapping, err := newRefMapping(conf.GetRefMappings())
+	if err != nil {
+		return refsConf{}, err
+	}
+
+	return refsConf{
+		filter:  filter,
+		mapping: mapping,
+	}, nil
+}
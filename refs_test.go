@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// TestNewRefFilter tests the parsing of reference filter rules.
+func TestNewRefFilter(t *testing.T) {
+	t.Parallel()
+
+	{
+		filter, err := newRefFilter([]string{"refs/heads/*", "!refs/heads/a"})
+		if err != nil {
+			t.Fatalf("failed to parse valid rules: %s", err)
+		}
+		if len(filter) != 2 || filter[0].exclude || !filter[1].exclude {
+			t.Fatal("unexpected parsed rules")
+		}
+	}
+	{
+		if _, err := newRefFilter([]string{""}); !errors.Is(err, ErrRefFilter) {
+			t.Fatal("empty rule was allowed")
+		}
+	}
+	{
+		if _, err := newRefFilter([]string{"!"}); !errors.Is(err, ErrRefFilter) {
+			t.Fatal("empty negated rule was allowed")
+		}
+	}
+}
+
+// TestRefFilterMatch tests the matching of reference names against reference
+// filters.
+func TestRefFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		rules    []string
+		name     string
+		expected bool
+	}{
+		// No rules include everything.
+		{[]string{}, "refs/heads/a", true},
+		// The default rules only exclude the pull requests references.
+		{defaultRefFilters, "refs/heads/a", true},
+		{defaultRefFilters, "refs/pull/1/head", false},
+		{defaultRefFilters, "refs/pullx", true},
+		// '*' matches across '/'.
+		{[]string{"refs/heads/*"}, "refs/heads/a/b", true},
+		{[]string{"refs/heads/*"}, "refs/tags/a", false},
+		// '?' matches a single character.
+		{[]string{"refs/tags/v?"}, "refs/tags/v1", true},
+		{[]string{"refs/tags/v?"}, "refs/tags/v10", false},
+		// Patterns with no wildcards match the reference and the ones under it.
+		{[]string{"refs/meta"}, "refs/meta", true},
+		{[]string{"refs/meta"}, "refs/meta/a", true},
+		{[]string{"refs/meta/"}, "refs/meta/a", true},
+		{[]string{"refs/meta"}, "refs/metadata", false},
+		// Regular expression characters are matched literally.
+		{[]string{"refs/heads/a.b"}, "refs/heads/a.b", true},
+		{[]string{"refs/heads/a.b"}, "refs/heads/axb", false},
+		// The last matching rule decides.
+		{[]string{"refs/tags/*", "!refs/tags/*-rc*"}, "refs/tags/v1-rc1", false},
+		{[]string{"!refs/tags/*-rc*", "refs/tags/*"}, "refs/tags/v1-rc1", true},
+		{[]string{"refs/tags/*", "!refs/tags/*-rc*"}, "refs/tags/v1", true},
+		// With include rules, references not matching any rule are excluded.
+		{[]string{"refs/tags/*", "!refs/tags/*-rc*"}, "refs/heads/a", false},
+		// With only exclude rules, references not matching any rule are
+		// included.
+		{[]string{"!refs/tags/*"}, "refs/heads/a", true},
+	}
+
+	for _, test := range tests {
+		filter, err := newRefFilter(test.rules)
+		if err != nil {
+			t.Fatalf("failed to parse rules %s: %s", test.rules, err)
+		}
+
+		if filter.match(test.name) != test.expected {
+			t.Fatalf("unexpected match result for %s with rules %s",
+				test.name, test.rules)
+		}
+	}
+}
+
+// TestNewRefMapping tests the parsing of reference mapping rules.
+func TestNewRefMapping(t *testing.T) {
+	t.Parallel()
+
+	valid := [][]string{
+		{},
+		defaultRefMappings,
+		{"refs/heads/*:refs/heads/upstream/*"},
+		{"refs/tags/*:refs/tags/vendor-*"},
+		{"refs/heads/main:refs/heads/upstream-main"},
+	}
+	for _, rules := range valid {
+		if _, err := newRefMapping(rules); err != nil {
+			t.Fatalf("failed to parse valid rules %s: %s", rules, err)
+		}
+	}
+
+	invalid := [][]string{
+		{""},
+		{"refs/heads/*"},
+		{"refs/heads/*:"},
+		{":refs/heads/a"},
+		{"+refs/heads/*:refs/heads/*"},
+		{"refs/heads/*:refs/heads/main"},
+		{"refs/*/*:refs/*/*"},
+		{"heads/*:refs/heads/*"},
+		{"refs/heads/*:heads/*"},
+		{"refs/heads/*:refs/heads/*", "refs/tags/*"},
+	}
+	for _, rules := range invalid {
+		if _, err := newRefMapping(rules); !errors.Is(err, ErrRefMapping) {
+			t.Fatalf("invalid rules %s were allowed", rules)
+		}
+	}
+}
+
+// TestRefMappingPushSpecs tests the push refspecs of a reference mapping.
+func TestRefMappingPushSpecs(t *testing.T) {
+	t.Parallel()
+
+	mapping := refMapping{"refs/heads/*:refs/heads/upstream/*"}
+
+	specs := mapping.pushSpecs()
+	if len(specs) != 1 || specs[0] != "+refs/heads/*:refs/heads/upstream/*" {
+		t.Fatalf("unexpected push refspecs: %s", specs)
+	}
+
+	// The mapping is not affected by changes to the returned refspecs.
+	specs[0] = "refs/*:refs/*"
+	if mapping[0] != "refs/heads/*:refs/heads/upstream/*" {
+		t.Fatalf("mapping modified through the push refspecs: %s", mapping)
+	}
+}
+
+// TestRefMappingSrcNames tests resolving destination reference names to their
+// source reference names.
+func TestRefMappingSrcNames(t *testing.T) {
+	t.Parallel()
+
+	mapping, err := newRefMapping([]string{
+		"refs/heads/*:refs/heads/upstream/*",
+		"refs/tags/*:refs/tags/vendor-*",
+		"refs/heads/main:refs/heads/upstream-main",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse rules: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"refs/heads/upstream/a", []string{"refs/heads/a"}},
+		{"refs/heads/upstream/a/b", []string{"refs/heads/a/b"}},
+		{"refs/tags/vendor-v1", []string{"refs/tags/v1"}},
+		{"refs/heads/upstream-main", []string{"refs/heads/main"}},
+		{"refs/heads/own", nil},
+		{"refs/tags/v1", nil},
+		{"HEAD", nil},
+	}
+
+	for _, test := range tests {
+		names := mapping.srcNames(plumbing.ReferenceName(test.name))
+		if len(names) != len(test.expected) {
+			t.Fatalf("unexpected source names for %s: %s", test.name, names)
+		}
+
+		for i, name := range names {
+			if name.String() != test.expected[i] {
+				t.Fatalf("unexpected source names for %s: %s", test.name,
+					names)
+			}
+		}
+	}
+}
+
+// TestNewRefsConf tests the parsing of the reference configuration.
+func TestNewRefsConf(t *testing.T) {
+	t.Parallel()
+
+	{
+		rc, err := newRefsConf(Config{})
+		if err != nil {
+			t.Fatalf("failed to parse the default configuration: %s", err)
+		}
+		if len(rc.filter) != len(defaultRefFilters) ||
+			len(rc.mapping) != len(defaultRefMappings) {
+			t.Fatal("unexpected default reference configuration")
+		}
+	}
+	{
+		_, err := newRefsConf(Config{RefFilters: []string{"!"}})
+		if !errors.Is(err, ErrRefFilter) {
+			t.Fatal("invalid reference filter was allowed")
+		}
+	}
+	{
+		_, err := newRefsConf(Config{RefMappings: []string{"refs/*"}})
+		if !errors.Is(err, ErrRefMapping) {
+			t.Fatal("invalid reference mapping was allowed")
+		}
+	}
+}
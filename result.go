@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+var ErrNotInSync = errors.New("destination repositories not in sync")
+
+// RefAction describes the change mirroring makes to a destination reference.
+type RefAction string
+
+const (
+	RefCreated   RefAction = "created"
+	RefUpdated   RefAction = "updated"
+	RefForced    RefAction = "forced"
+	RefDeleted   RefAction = "deleted"
+	RefUnchanged RefAction = "unchanged"
+	// RefRejected is used for the updates that were not applied to the
+	// destination.
+	RefRejected RefAction = "rejected"
+)
+
+// RefUpdate describes the change of a destination reference. Old is the zero
+// hash for references to be created and New is the zero hash for references
+// to be deleted. Fast-forward changes are reported as RefUpdated while all the
+// other changes of existing references are reported as RefForced.
+type RefUpdate struct {
+	Name   plumbing.ReferenceName
+	Old    plumbing.Hash
+	New    plumbing.Hash
+	Action RefAction
+}
+
+func (u RefUpdate) String() string {
+	return fmt.Sprintf("%s %s %s..%s", u.Action, u.Name, u.Old, u.New)
+}
+
+// Phase identifies a step of the mirroring process.
+type Phase string
+
+const (
+	// PhaseAuth covers setting up the authentication for a destination.
+	PhaseAuth Phase = "auth"
+	// PhaseFetch covers setting up the staging repository from the source.
+	PhaseFetch Phase = "fetch"
+	// PhaseList covers listing the references of a destination.
+	PhaseList Phase = "list"
+	// PhasePush covers pushing the references to a destination.
+	PhasePush Phase = "push"
+	// PhasePrune covers deleting the stale references of a destination.
+	PhasePrune Phase = "prune"
+	// PhaseVerify covers listing a destination again, after a failed push or
+	// prune, to find out which updates were applied.
+	PhaseVerify Phase = "verify"
+)
+
+// PhaseError is the error of a failed mirroring phase.
+type PhaseError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// phaseError returns a *PhaseError for an error or nil when there is no error.
+func phaseError(phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &PhaseError{
+		Phase: phase,
+		Err:   err,
+	}
+}
+
+// countActions returns the number of updates for each action.
+func countActions(counts map[RefAction]int, updates []RefUpdate) map[RefAction]int {
+	for _, update := range updates {
+		counts[update.Action]++
+	}
+
+	return counts
+}
+
+// Transfer describes the packfiles transferred with a remote repository.
+type Transfer struct {
+	// Objects is the number of objects in the packfiles.
+	Objects int64
+	// Bytes is the size of the packfile streams, including the sideband
+	// framing and progress messages when used.
+	Bytes int64
+}
+
+// DstResult describes the outcome of mirroring to a single destination
+// repository.
+type DstResult struct {
+	Repo string
+	// Refs are the references of the destination before mirroring.
+	Refs []*plumbing.Reference
+	// Updates are the changes of the destination references, sorted by
+	// reference name. In dry-run mode, these are the changes mirroring would
+	// make.
+	Updates []RefUpdate
+	// Durations are the durations of the phases run for this destination.
+	Durations map[Phase]time.Duration
+	// Pushed describes the packfiles pushed to the destination.
+	Pushed Transfer
+	// Err is a *PhaseError when mirroring to the destination failed.
+	Err error
+}
+
+// InSync reports whether the destination repository was already in sync with
+// the source.
+func (r DstResult) InSync() bool {
+	for _, update := range r.Updates {
+		if update.Action != RefUnchanged {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Counts returns the number of reference updates for each action.
+func (r DstResult) Counts() map[RefAction]int {
+	return countActions(make(map[RefAction]int), r.Updates)
+}
+
+// MirrorResult describes the outcome of mirroring the source to all the
+// destination repositories.
+type MirrorResult struct {
+	SrcRepo string
+	DryRun  bool
+	// Dsts are the results for each destination, in the order they are
+	// provided in the configuration.
+	Dsts []DstResult
+	// Durations are the durations of the phases run once for all the
+	// destinations.
+	Durations map[Phase]time.Duration
+	// Fetched describes the packfiles fetched from the source.
+	Fetched Transfer
+	// Duration is the duration of the entire mirroring.
+	Duration time.Duration
+}
+
+// Counts returns the number of reference updates for each action, across all
+// the destinations.
+func (r *MirrorResult) Counts() map[RefAction]int {
+	counts := make(map[RefAction]int)
+	for _, dst := range r.Dsts {
+		countActions(counts, dst.Updates)
+	}
+
+	return counts
+}
+
+// Err returns a *DstsError when mirroring failed for at least one destination.
+// In dry-run mode, ErrNotInSync is returned when no destination failed but at
+// least one destination is not in sync.
+func (r *MirrorResult) Err() error {
+	var dstsErr DstsError
+
+	inSync := true
+
+	for _, dst := range r.Dsts {
+		if dst.Err != nil {
+			dstsErr.Results = append(dstsErr.Results, dst)
+		} else if !dst.InSync() {
+			inSync = false
+		}
+	}
+
+	if len(dstsErr.Results) > 0 {
+		return &dstsErr
+	}
+
+	if r.DryRun && !inSync {
+		return ErrNotInSync
+	}
+
+	return nil
+}
+
+// DstsError is returned when mirroring failed for at least one of the
+// destination repositories. It provides the results for all the destinations
+// that failed.
+type DstsError struct {
+	Results []DstResult
+}
+
+func (e *DstsError) Error() string {
+	msgs := make([]string, 0, len(e.Results))
+	for _, result := range e.Results {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", RedactURL(result.Repo),
+			result.Err))
+	}
+
+	return fmt.Sprintf("failed to mirror to %d destination(s): %s",
+		len(e.Results), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestDstResultInSync tests the InSync function of a destination result.
+func TestDstResultInSync(t *testing.T) {
+	t.Parallel()
+
+	if !(DstResult{}).InSync() {
+		t.Fatal("empty result not in sync")
+	}
+
+	if !(DstResult{Updates: []RefUpdate{
+		{Name: "refs/heads/a", Action: RefUnchanged},
+	}}).InSync() {
+		t.Fatal("result with unchanged refs only not in sync")
+	}
+
+	for _, action := range []RefAction{
+		RefCreated,
+		RefUpdated,
+		RefForced,
+		RefDeleted,
+		RefRejected,
+	} {
+		if (DstResult{Updates: []RefUpdate{
+			{Name: "refs/heads/a", Action: RefUnchanged},
+			{Name: "refs/heads/b", Action: action},
+		}}).InSync() {
+			t.Fatalf("result with a %s action in sync", action)
+		}
+	}
+}
+
+// TestCounts tests counting the reference updates.
+func TestCounts(t *testing.T) {
+	t.Parallel()
+
+	result := MirrorResult{
+		Dsts: []DstResult{
+			{Updates: []RefUpdate{
+				{Name: "refs/heads/a", Action: RefCreated},
+				{Name: "refs/heads/b", Action: RefCreated},
+				{Name: "refs/heads/c", Action: RefDeleted},
+			}},
+			{Updates: []RefUpdate{
+				{Name: "refs/heads/a", Action: RefCreated},
+				{Name: "refs/heads/b", Action: RefUnchanged},
+			}},
+			{},
+		},
+	}
+
+	counts := result.Dsts[0].Counts()
+	if len(counts) != 2 || counts[RefCreated] != 2 || counts[RefDeleted] != 1 {
+		t.Fatalf("unexpected destination counts: %v", counts)
+	}
+
+	if counts := result.Dsts[2].Counts(); len(counts) != 0 {
+		t.Fatalf("unexpected destination counts: %v", counts)
+	}
+
+	counts = result.Counts()
+	if len(counts) != 3 || counts[RefCreated] != 3 ||
+		counts[RefDeleted] != 1 || counts[RefUnchanged] != 1 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+}
+
+// TestMirrorResultErr tests the error of a mirroring result.
+func TestMirrorResultErr(t *testing.T) {
+	t.Parallel()
+
+	inSync := DstResult{Repo: "a"}
+	notInSync := DstResult{Repo: "b", Updates: []RefUpdate{
+		{Name: "refs/heads/a", Action: RefCreated},
+	}}
+	failed := DstResult{Repo: "c", Err: errors.New("failed")}
+
+	{
+		result := MirrorResult{Dsts: []DstResult{inSync, notInSync}}
+		if err := result.Err(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	{
+		result := MirrorResult{Dsts: []DstResult{inSync, notInSync}, DryRun: true}
+		if err := result.Err(); !errors.Is(err, ErrNotInSync) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	{
+		result := MirrorResult{Dsts: []DstResult{inSync}, DryRun: true}
+		if err := result.Err(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	{
+		result := MirrorResult{Dsts: []DstResult{failed, notInSync}, DryRun: true}
+
+		var dstsErr *DstsError
+		if err := result.Err(); !errors.As(err, &dstsErr) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if len(dstsErr.Results) != 1 || dstsErr.Results[0].Repo != "c" {
+			t.Fatalf("unexpected failed destinations: %v", dstsErr.Results)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Default retry configuration values.
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = time.Minute
+)
+
+var ErrRetry = errors.New("invalid retry configuration")
+
+// RetryConf structure defines the retries of the remote operations (fetching
+// the source and listing, pushing to and pruning the destinations) failing
+// with a transient error. The delay before the first retry is Backoff and it
+// doubles with each retry, up to MaxBackoff. A random delay up to Jitter is
+// added to each retry delay.
+type RetryConf struct {
+	// Attempts is the maximum number of attempts of a remote operation. The
+	// remote operations are not retried when it is 0 or 1.
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff"`
+	Jitter     time.Duration `yaml:"jitter"`
+}
+
+// validate checks that the retry configuration values are not negative and
+// that the maximum backoff is not lower than the backoff.
+func (retryConf RetryConf) validate(logger *Logger) error {
+	if retryConf.Attempts < 0 || retryConf.Backoff < 0 ||
+		retryConf.MaxBackoff < 0 || retryConf.Jitter < 0 {
+		return fmt.Errorf("%w: negative attempts, backoff, maximum backoff "+
+			"or jitter", ErrRetry)
+	}
+
+	if retryConf.backoff() > retryConf.maxBackoff() {
+		return fmt.Errorf("%w: backoff %s above the maximum backoff %s",
+			ErrRetry, retryConf.backoff(), retryConf.maxBackoff())
+	}
+
+	if retryConf.Attempts > 1 {
+		logger.Info("Remote operations attempted up to", retryConf.Attempts,
+			"times on transient errors.")
+	}
+
+	return nil
+}
+
+func (retryConf RetryConf) backoff() time.Duration {
+	if retryConf.Backoff == 0 {
+		return DefaultRetryBackoff
+	}
+
+	return retryConf.Backoff
+}
+
+func (retryConf RetryConf) maxBackoff() time.Duration {
+	if retryConf.MaxBackoff == 0 {
+		return DefaultRetryMaxBackoff
+	}
+
+	return retryConf.MaxBackoff
+}
+
+// delay returns the delay before retrying after a failed attempt, counting
+// from 1.
+func (retryConf RetryConf) delay(attempt int, rnd *rand.Rand) time.Duration {
+	delay := retryConf.backoff()
+
+	for i := 1; i < attempt && delay < retryConf.maxBackoff(); i++ {
+		delay *= 2
+	}
+
+	if delay > retryConf.maxBackoff() {
+		delay = retryConf.maxBackoff()
+	}
+
+	if retryConf.Jitter > 0 {
+		delay += time.Duration(rnd.Int63n(int64(retryConf.Jitter)))
+	}
+
+	return delay
+}
+
+// ErrorKind classifies the errors of the remote operations.
+type ErrorKind string
+
+const (
+	// ErrorNetwork is used for the network failures and the timeouts,
+	// including the HTTP server errors. These are the only transient
+	// errors.
+	ErrorNetwork ErrorKind = "network"
+	// ErrorAuth is used for the authentication and authorization failures.
+	ErrorAuth ErrorKind = "auth"
+	// ErrorHostKey is used for the SSH host keys that are unknown or don't
+	// match the known hosts.
+	ErrorHostKey ErrorKind = "host-key"
+	// ErrorRejected is used for the updates the remote rejected.
+	ErrorRejected ErrorKind = "rejected"
+	// ErrorNotFound is used for the repositories that don't exist.
+	ErrorNotFound ErrorKind = "not-found"
+	// ErrorOther is used for all the other errors.
+	ErrorOther ErrorKind = "other"
+)
+
+// Transient reports whether the errors of a kind are worth retrying.
+func (k ErrorKind) Transient() bool {
+	return k == ErrorNetwork
+}
+
+// unwrapRemoteError is like errors.Unwrap but it also unwraps the go-git
+// client errors.
+func unwrapRemoteError(err error) error {
+	switch clientErr := err.(type) {
+	case *plumbing.UnexpectedError:
+		return clientErr.Err
+	case *plumbing.PermanentError:
+		return clientErr.Err
+	}
+
+	return errors.Unwrap(err)
+}
+
+// classifyChainedError classifies an error based on its type, without
+// unwrapping it. It returns an empty kind when the type is not enough.
+func classifyChainedError(err error) ErrorKind {
+	var (
+		// The HTTP errors of go-git and of the GitHub App token requests.
+		statusErr interface{ StatusCode() int }
+		opErr     *net.OpError
+		dnsErr    *net.DNSError
+		netErr    net.Error
+	)
+
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod):
+		return ErrorAuth
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return ErrorNotFound
+	case errors.As(err, &x509.UnknownAuthorityError{}),
+		errors.As(err, &x509.CertificateInvalidError{}),
+		errors.As(err, &x509.HostnameError{}):
+		return ErrorOther
+	case errors.As(err, &statusErr):
+		return classifyStatusCode(statusErr.StatusCode())
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout || dnsErr.IsTemporary {
+			return ErrorNetwork
+		}
+
+		return ErrorOther
+	case errors.As(err, &opErr):
+		// Only the network operations timing out, failing temporarily or
+		// with their connection broken are transient. For example, the
+		// connections refused and the TLS failures are not.
+		if opErr.Timeout() || isTemporary(opErr) || isConnectionBroken(opErr) {
+			return ErrorNetwork
+		}
+
+		return ErrorOther
+	case errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		isConnectionBroken(err):
+		return ErrorNetwork
+	}
+
+	return ""
+}
+
+// isTemporary reports whether an error is caused by a temporary system
+// error, for example running out of file descriptors.
+func isTemporary(err error) bool {
+	var errno syscall.Errno
+
+	return errors.As(err, &errno) && errno.Temporary()
+}
+
+// isConnectionBroken reports whether an error is a connection reset,
+// aborted or closed by the remote.
+func isConnectionBroken(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// classifyStatusCode classifies an error based on the status code of an HTTP
+// response.
+func classifyStatusCode(code int) ErrorKind {
+	switch {
+	case code >= http.StatusInternalServerError,
+		code == http.StatusTooManyRequests,
+		code == http.StatusRequestTimeout:
+		return ErrorNetwork
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return ErrorAuth
+	case code == http.StatusNotFound:
+		return ErrorNotFound
+	}
+
+	return ErrorOther
+}
+
+// errorMessageKinds are the kinds of the errors only identified by their
+// messages, for example the SSH handshake failures.
+var errorMessageKinds = []struct {
+	message string
+	kind    ErrorKind
+}{
+	{"knownhosts: ", ErrorHostKey},
+	{"host key mismatch", ErrorHostKey},
+	{"unable to authenticate", ErrorAuth},
+	{"permission denied", ErrorAuth},
+	{"command error on ", ErrorRejected},
+	{"unpack error", ErrorRejected},
+	{"pre-receive hook declined", ErrorRejected},
+	{"repository not found", ErrorNotFound},
+	{"does not appear to be a git repository", ErrorNotFound},
+	{"connection reset", ErrorNetwork},
+	{"broken pipe", ErrorNetwork},
+	{"i/o timeout", ErrorNetwork},
+	{"timeout exceeded", ErrorNetwork},
+	{"handshake failed: eof", ErrorNetwork},
+	{"unexpected eof", ErrorNetwork},
+}
+
+// ClassifyError returns the kind of an error of a remote operation. The
+// errors are classified based on their types first and then on the message
+// of the innermost error so that the context added while wrapping it (for
+// example, the repository URLs) is not matched.
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+
+	inner := err
+
+	for chained := err; chained != nil; chained = unwrapRemoteError(chained) {
+		if kind := classifyChainedError(chained); len(kind) != 0 {
+			return kind
+		}
+
+		inner = chained
+	}
+
+	message := strings.ToLower(inner.Error())
+
+	for _, messageKind := range errorMessageKinds {
+		if strings.Contains(message, messageKind.message) {
+			return messageKind.kind
+		}
+	}
+
+	return ErrorOther
+}
+
+// retry runs a remote operation, described by what, retrying it as
+// configured while it fails with a transient error. Each failed attempt is
+// logged. No retry happens once the context is done.
+func retry(ctx context.Context, retryConf RetryConf, logger *Logger, what string, op func() error) error {
+	attempts := retryConf.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			if attempt > 1 {
+				logger.Info(what, "succeeded on attempt", attempt, "of",
+					attempts, ".")
+			}
+
+			return nil
+		}
+
+		if attempts == 1 {
+			return err
+		}
+
+		kind := ClassifyError(err)
+
+		if !kind.Transient() || attempt == attempts || ctx.Err() != nil {
+			logger.Warn(what, "failed on attempt", attempt, "of", attempts,
+				"with a", kind, "error, giving up:", err)
+
+			return err
+		}
+
+		delay := retryConf.delay(attempt, rnd)
+		logger.Warn(what, "failed on attempt", attempt, "of", attempts,
+			"with a", kind, "error, retrying in", delay, ":", err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,522 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// testFaults are the errors injected in the fetches and the pushes of a test
+// repository.
+type testFaults struct {
+	mu sync.Mutex
+	// fetch and push are the errors returned by the next fetches and
+	// pushes, before reaching the repository.
+	fetch []error
+	push  []error
+	// fetches and pushes are the numbers of fetches and pushes attempted.
+	fetches int
+	pushes  int
+}
+
+// next returns the next error to inject, if any, and counts the attempt.
+func (f *testFaults) next(errs *[]error, attempts *int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	*attempts++
+
+	if len(*errs) == 0 {
+		return nil
+	}
+
+	err := (*errs)[0]
+	*errs = (*errs)[1:]
+
+	return err
+}
+
+// faults holds the *testFaults of the test repositories, by path.
+var faults sync.Map
+
+// faultTransport injects the errors of the test repositories into the
+// sessions of a transport.
+type faultTransport struct {
+	transport.Transport
+}
+
+func (t faultTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.Transport.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return faultUploadPackSession{session, ep.Path}, nil
+}
+
+func (t faultTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	session, err := t.Transport.NewReceivePackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return faultReceivePackSession{session, ep.Path}, nil
+}
+
+type faultUploadPackSession struct {
+	transport.UploadPackSession
+	path string
+}
+
+func (s faultUploadPackSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	if f, ok := faults.Load(s.path); ok {
+		f := f.(*testFaults)
+		if err := f.next(&f.fetch, &f.fetches); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.UploadPackSession.UploadPack(ctx, req)
+}
+
+type faultReceivePackSession struct {
+	transport.ReceivePackSession
+	path string
+}
+
+func (s faultReceivePackSession) ReceivePack(ctx context.Context, req *packp.ReferenceUpdateRequest) (*packp.ReportStatus, error) {
+	if f, ok := faults.Load(s.path); ok {
+		f := f.(*testFaults)
+		if err := f.next(&f.push, &f.pushes); err != nil {
+			if req.Packfile != nil {
+				req.Packfile.Close()
+			}
+
+			return nil, err
+		}
+	}
+
+	return s.ReceivePackSession.ReceivePack(ctx, req)
+}
+
+// The local test repositories are accessed over the file protocol. The
+// transports are installed first so that the faults wrap the counting file
+// transport instead of being replaced by it.
+func init() {
+	installTransports()
+	client.InstallProtocol("file", faultTransport{client.Protocols["file"]})
+}
+
+// testNetworkError returns a network error like the ones of a connection
+// reset by the remote.
+func testNetworkError() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+// TestRetryConfValidate tests the validation of the retry configuration.
+func TestRetryConfValidate(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	for _, rc := range []RetryConf{
+		{},
+		{Attempts: 3},
+		{Attempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour,
+			Jitter: time.Second},
+		{Backoff: time.Minute},
+	} {
+		if err := rc.validate(logger); err != nil {
+			t.Fatalf("valid retry configuration failed: %+v: %s", rc, err)
+		}
+	}
+
+	for _, rc := range []RetryConf{
+		{Attempts: -1},
+		{Backoff: -time.Second},
+		{MaxBackoff: -time.Second},
+		{Jitter: -time.Second},
+		{Backoff: time.Hour},
+		{Backoff: time.Minute, MaxBackoff: time.Second},
+	} {
+		if err := rc.validate(logger); !errors.Is(err, ErrRetry) {
+			t.Fatalf("invalid retry configuration was allowed: %+v", rc)
+		}
+	}
+}
+
+// TestRetryConfDelay tests the exponential backoff and the jitter of the
+// retries.
+func TestRetryConfDelay(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	{
+		rc := RetryConf{}
+		for attempt, expected := range []time.Duration{
+			time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+			16 * time.Second, 32 * time.Second, time.Minute, time.Minute,
+		} {
+			if delay := rc.delay(attempt+1, rnd); delay != expected {
+				t.Fatalf("unexpected delay after attempt %d: %s", attempt+1,
+					delay)
+			}
+		}
+
+		if delay := rc.delay(1000, rnd); delay != time.Minute {
+			t.Fatalf("unexpected delay after many attempts: %s", delay)
+		}
+	}
+	{
+		rc := RetryConf{Backoff: time.Second, MaxBackoff: 3 * time.Second,
+			Jitter: time.Second}
+		for i := 0; i < 100; i++ {
+			if delay := rc.delay(1, rnd); delay < time.Second ||
+				delay >= 2*time.Second {
+				t.Fatalf("unexpected delay with jitter: %s", delay)
+			}
+
+			if delay := rc.delay(3, rnd); delay < 3*time.Second ||
+				delay >= 4*time.Second {
+				t.Fatalf("unexpected maximum delay with jitter: %s", delay)
+			}
+		}
+	}
+}
+
+// TestClassifyError tests the classification of the remote operation errors.
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+
+	httpErr := func(code int) error {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+		return githttp.NewErr(&http.Response{StatusCode: code, Request: req})
+	}
+
+	for _, test := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{nil, ""},
+		{testNetworkError(), ErrorNetwork},
+		{fmt.Errorf("failed to fetch source remote: %w", testNetworkError()),
+			ErrorNetwork},
+		{plumbing.NewUnexpectedError(testNetworkError()), ErrorNetwork},
+		{fmt.Errorf("failed: %w", plumbing.NewUnexpectedError(
+			&net.DNSError{Err: "timeout", IsTimeout: true})), ErrorNetwork},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, ErrorOther},
+		{context.DeadlineExceeded, ErrorNetwork},
+		{errors.New("ssh: handshake failed: EOF"), ErrorNetwork},
+		{errors.New("read: connection reset by peer"), ErrorNetwork},
+		{&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE},
+			ErrorNetwork},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE},
+			ErrorNetwork},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			ErrorOther},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{
+			Syscall: "connect", Err: syscall.ECONNREFUSED}}, ErrorOther},
+		{&net.OpError{Op: "remote error", Err: errors.New(
+			"tls: bad certificate")}, ErrorOther},
+		{&net.OpError{Op: "read", Net: "tcp", Err: x509.UnknownAuthorityError{}},
+			ErrorOther},
+		// Only the message of the innermost error is matched.
+		{fmt.Errorf("failed to push to /srv/connection reset/repo.git: %w",
+			errors.New("something else")), ErrorOther},
+		{fmt.Errorf("failed to fetch /srv/permission-denied.git: %w",
+			plumbing.NewUnexpectedError(errors.New("unexpected EOF"))),
+			ErrorNetwork},
+		{httpErr(http.StatusBadGateway), ErrorNetwork},
+		{httpErr(http.StatusTooManyRequests), ErrorNetwork},
+		{httpErr(http.StatusBadRequest), ErrorOther},
+		{httpErr(http.StatusUnauthorized), ErrorAuth},
+		{fmt.Errorf("failed: %w", transport.ErrAuthorizationFailed), ErrorAuth},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, " +
+			"attempted methods [none publickey]"), ErrorAuth},
+		{errors.New("ssh: handshake failed: knownhosts: key mismatch"),
+			ErrorHostKey},
+		{errors.New("ssh: handshake failed: knownhosts: key is unknown"),
+			ErrorHostKey},
+		{httpErr(http.StatusNotFound), ErrorNotFound},
+		{fmt.Errorf("failed: %w", transport.ErrRepositoryNotFound),
+			ErrorNotFound},
+		{errors.New("command error on refs/heads/main: protected branch " +
+			"hook declined"), ErrorRejected},
+		{errors.New("unpack error: unpack-objects abnormal exit"),
+			ErrorRejected},
+		{&githubAppTokenError{code: http.StatusServiceUnavailable},
+			ErrorNetwork},
+		{fmt.Errorf("failed: %w", &githubAppTokenError{
+			code: http.StatusUnauthorized}), ErrorAuth},
+		{&githubAppTokenError{code: http.StatusNotFound}, ErrorNotFound},
+		{&githubAppTokenError{code: http.StatusUnprocessableEntity},
+			ErrorOther},
+		{errors.New("something else"), ErrorOther},
+	} {
+		if kind := ClassifyError(test.err); kind != test.kind {
+			t.Fatalf("unexpected kind of '%v': %s", test.err, kind)
+		}
+	}
+
+	if !ErrorNetwork.Transient() || ErrorAuth.Transient() ||
+		ErrorHostKey.Transient() || ErrorRejected.Transient() ||
+		ErrorNotFound.Transient() || ErrorOther.Transient() {
+		t.Fatal("unexpected transient error kinds")
+	}
+}
+
+// TestRetry tests retrying the remote operations.
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	rc := RetryConf{
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	}
+
+	// failing returns an operation failing with the provided errors before
+	// succeeding and the number of its attempts.
+	failing := func(errs ...error) (func() error, *int) {
+		var attempts int
+
+		return func() error {
+			attempts++
+
+			if len(errs) == 0 {
+				return nil
+			}
+
+			err := errs[0]
+			errs = errs[1:]
+
+			return err
+		}, &attempts
+	}
+
+	{
+		var logs bytes.Buffer
+
+		op, attempts := failing(testNetworkError(), testNetworkError())
+		if err := retry(context.Background(), rc, NewLogger(&logs), "Testing",
+			op); err != nil {
+			t.Fatalf("retried operation failed: %s", err)
+		}
+
+		if *attempts != 3 {
+			t.Fatalf("unexpected attempts: %d", *attempts)
+		}
+
+		for _, line := range []string{
+			"[WARN ]: Testing failed on attempt 1 of 3 with a network error, " +
+				"retrying in 1ms :",
+			"[WARN ]: Testing failed on attempt 2 of 3 with a network error",
+			"[INFO ]: Testing succeeded on attempt 3 of 3 .",
+		} {
+			if !strings.Contains(logs.String(), line) {
+				t.Fatalf("attempt not logged: %s\n%s", line, logs.String())
+			}
+		}
+	}
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	{
+		op, attempts := failing(testNetworkError(), testNetworkError(),
+			testNetworkError())
+		if err := retry(context.Background(), rc, logger, "Testing",
+			op); ClassifyError(err) != ErrorNetwork {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if *attempts != 3 {
+			t.Fatalf("unexpected attempts: %d", *attempts)
+		}
+	}
+	{
+		op, attempts := failing(transport.ErrAuthenticationRequired)
+		if err := retry(context.Background(), rc, logger, "Testing",
+			op); !errors.Is(err, transport.ErrAuthenticationRequired) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if *attempts != 1 {
+			t.Fatalf("non-transient error was retried: %d", *attempts)
+		}
+	}
+	{
+		op, attempts := failing(testNetworkError())
+		if err := retry(context.Background(), RetryConf{}, logger, "Testing",
+			op); err == nil {
+			t.Fatal("operation was retried without retries configured")
+		}
+
+		if *attempts != 1 {
+			t.Fatalf("unexpected attempts: %d", *attempts)
+		}
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		op, attempts := failing(testNetworkError())
+		if err := retry(ctx, rc, logger, "Testing", op); err == nil {
+			t.Fatal("operation was retried once the context was done")
+		}
+
+		if *attempts != 1 {
+			t.Fatalf("unexpected attempts: %d", *attempts)
+		}
+	}
+}
+
+// TestMirrorRetry tests retrying the fetches and the pushes failing with
+// injected errors.
+func TestMirrorRetry(t *testing.T) {
+	t.Parallel()
+
+	// no need for logs
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	// Create a source repository.
+	srcRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-src-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary src repo: %s", err)
+	}
+
+	defer os.RemoveAll(srcRepoPath)
+
+	_, srcHead, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	// Create the destination repositories.
+	newDst := func() string {
+		t.Helper()
+
+		dstRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-dst-")
+		if err != nil {
+			t.Fatalf("failed to create a temporary dst repo: %s", err)
+		}
+
+		if _, err := utils.NewBareRepo(dstRepoPath); err != nil {
+			t.Fatalf("failed to create a test dst repo: %s", err)
+		}
+
+		return dstRepoPath
+	}
+
+	dstRepoPath := newDst()
+	defer os.RemoveAll(dstRepoPath)
+
+	rejectingDstRepoPath := newDst()
+	defer os.RemoveAll(rejectingDstRepoPath)
+
+	srcFaults := &testFaults{
+		fetch: []error{testNetworkError(), testNetworkError()},
+	}
+	dstFaults := &testFaults{
+		push: []error{plumbing.NewUnexpectedError(testNetworkError())},
+	}
+	rejectingDstFaults := &testFaults{
+		push: []error{transport.ErrAuthorizationFailed},
+	}
+
+	faults.Store(srcRepoPath, srcFaults)
+	defer faults.Delete(srcRepoPath)
+	faults.Store(dstRepoPath, dstFaults)
+	defer faults.Delete(dstRepoPath)
+	faults.Store(rejectingDstRepoPath, rejectingDstFaults)
+	defer faults.Delete(rejectingDstRepoPath)
+
+	conf := Config{
+		SrcRepo:  srcRepoPath,
+		DstRepos: []string{dstRepoPath, rejectingDstRepoPath},
+		Retry: RetryConf{
+			Attempts:   3,
+			Backoff:    time.Millisecond,
+			MaxBackoff: 10 * time.Millisecond,
+			Jitter:     time.Millisecond,
+		},
+	}
+
+	result, err := Mirror(conf, logger)
+
+	var dstsErr *DstsError
+	if !errors.As(err, &dstsErr) || len(dstsErr.Results) != 1 ||
+		dstsErr.Results[0].Repo != rejectingDstRepoPath {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if srcFaults.fetches != 3 {
+		t.Fatalf("unexpected fetch attempts: %d", srcFaults.fetches)
+	}
+
+	// The transient failure is retried.
+	if dstFaults.pushes != 2 || result.Dsts[0].Err != nil {
+		t.Fatalf("unexpected push attempts: %d: %v", dstFaults.pushes,
+			result.Dsts[0].Err)
+	}
+
+	dstRepo, err := git.PlainOpen(dstRepoPath)
+	if err != nil {
+		t.Fatalf("failed to open the dst repo: %s", err)
+	}
+
+	ok, err := utils.RepoRefsCheckHash(dstRepo, srcHead, "refs/")
+	if err != nil || !ok {
+		t.Fatalf("unexpected dst repo refs: %v", err)
+	}
+
+	// The authorization failure isn't retried.
+	if rejectingDstFaults.pushes != 1 ||
+		ClassifyError(result.Dsts[1].Err) != ErrorAuth {
+		t.Fatalf("unexpected push attempts: %d: %v",
+			rejectingDstFaults.pushes, result.Dsts[1].Err)
+	}
+
+	// Without retries, the transient failure fails the mirroring.
+	srcFaults.fetch = []error{testNetworkError()}
+	conf.Retry = RetryConf{}
+
+	if _, err := Mirror(conf, logger); ClassifyError(err) != ErrorNetwork {
+		t.Fatalf("unexpected error without retries: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of years a cron schedule is searched for its next run.
+const cronSearchYears = 5
+
+var ErrSchedule = errors.New("invalid schedule")
+
+// ScheduleConf structure defines when a job runs in daemon mode. A job runs
+// either every Interval, starting when the daemon starts, or at the times
+// matching the Cron expression. Each run is delayed by a random duration
+// up to Jitter. A job without an interval or a cron expression is not
+// scheduled.
+type ScheduleConf struct {
+	Interval time.Duration `yaml:"interval"`
+	// Cron is a cron expression with five fields (minute, hour, day of
+	// month, month and day of week) evaluated in the local time zone, or one
+	// of the '@yearly', '@annually', '@monthly', '@weekly', '@daily',
+	// '@midnight' and '@hourly' macros.
+	Cron   string        `yaml:"cron"`
+	Jitter time.Duration `yaml:"jitter"`
+}
+
+// isSet returns true if the job is scheduled.
+func (sc ScheduleConf) isSet() bool {
+	return sc.Interval != 0 || len(sc.Cron) != 0
+}
+
+// validate checks the schedule configuration.
+func (sc ScheduleConf) validate() error {
+	switch {
+	case sc.Interval < 0:
+		return fmt.Errorf("%w: negative interval", ErrSchedule)
+	case sc.Jitter < 0:
+		return fmt.Errorf("%w: negative jitter", ErrSchedule)
+	case sc.Interval != 0 && len(sc.Cron) != 0:
+		return fmt.Errorf("%w: both an interval and a cron expression "+
+			"provided", ErrSchedule)
+	case len(sc.Cron) != 0:
+		_, err := parseCron(sc.Cron)
+
+		return err
+	}
+
+	return nil
+}
+
+// schedule provides the times a job runs at.
+type schedule interface {
+	// first returns the time of the first run when starting at t.
+	first(t time.Time) time.Time
+	// next returns the time of the run following the one at t. The zero
+	// time is returned when there is none.
+	next(t time.Time) time.Time
+}
+
+// newSchedule returns the schedule of a schedule configuration. It returns
+// nil when the job is not scheduled.
+func (sc ScheduleConf) newSchedule() (schedule, error) {
+	switch {
+	case sc.Interval > 0:
+		return intervalSchedule(sc.Interval), nil
+	case len(sc.Cron) != 0:
+		return parseCron(sc.Cron)
+	}
+
+	return nil, nil
+}
+
+// jitter returns a random duration up to the configured jitter.
+func (sc ScheduleConf) jitter(rnd *rand.Rand) time.Duration {
+	if sc.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rnd.Int63n(int64(sc.Jitter)))
+}
+
+// intervalSchedule runs a job at a fixed interval.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) first(t time.Time) time.Time {
+	return t
+}
+
+func (s intervalSchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule runs a job at the times matching a cron expression. Each
+// field is a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// The day of the month and the day of the week match either one
+	// another, like for cron, when both are restricted.
+	domStar, dowStar bool
+}
+
+// cronMacros are the supported cron expression macros.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression. Each field is a comma separated list
+// of '*', values and 'min-max' ranges, optionally followed by a '/step'.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron expression '%s' doesn't have 5 "+
+			"fields", ErrSchedule, expr)
+	}
+
+	var (
+		sched cronSchedule
+		err   error
+	)
+
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&sched.minute, 0, 59},
+		{&sched.hour, 0, 23},
+		{&sched.dom, 1, 31},
+		{&sched.month, 1, 12},
+		// Both 0 and 7 are Sunday.
+		{&sched.dow, 0, 7},
+	} {
+		*field.bits, err = parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cron expression '%s': %s",
+				ErrSchedule, expr, err.Error())
+		}
+	}
+
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+
+	sched.domStar = strings.HasPrefix(fields[2], "*")
+	sched.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return &sched, nil
+}
+
+// parseCronField parses a cron expression field to the bit set of the
+// values it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+
+		if hasStep {
+			var err error
+
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+		}
+
+		start, end := min, max
+
+		if rng != "*" {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+
+			var err error
+
+			start, err = strconv.Atoi(startStr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in '%s'", part)
+			}
+
+			// A single value with a step is a range up to the maximum.
+			switch {
+			case isRange:
+				end, err = strconv.Atoi(endStr)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in '%s'", part)
+				}
+			case !hasStep:
+				end = start
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("'%s' out of the %d-%d range", part, min,
+				max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+// matchDay returns true if the day of t matches the schedule.
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func (s *cronSchedule) first(t time.Time) time.Time {
+	return s.next(t)
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
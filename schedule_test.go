@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestScheduleConfValidate tests the validation of the schedule
+// configuration.
+func TestScheduleConfValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, sc := range []ScheduleConf{
+		{},
+		{Interval: time.Hour},
+		{Interval: time.Hour, Jitter: time.Minute},
+		{Cron: "*/15 * * * *"},
+		{Cron: "@daily", Jitter: time.Minute},
+	} {
+		if err := sc.validate(); err != nil {
+			t.Fatalf("valid schedule failed: %+v: %s", sc, err)
+		}
+	}
+
+	for _, sc := range []ScheduleConf{
+		{Interval: -time.Hour},
+		{Interval: time.Hour, Jitter: -time.Minute},
+		{Interval: time.Hour, Cron: "@daily"},
+		{Cron: "* * * *"},
+		{Cron: "@never"},
+	} {
+		if err := sc.validate(); !errors.Is(err, ErrSchedule) {
+			t.Fatalf("invalid schedule was allowed: %+v", sc)
+		}
+	}
+}
+
+// TestParseCron tests parsing cron expressions.
+func TestParseCron(t *testing.T) {
+	t.Parallel()
+
+	for expr, expected := range map[string]cronSchedule{
+		"* * * * *": {
+			minute: 1<<60 - 1, hour: 1<<24 - 1, dom: 1<<32 - 2,
+			month: 1<<13 - 2, dow: 1<<8 - 1, domStar: true, dowStar: true,
+		},
+		"0,30 9-17/4 1 */6 7": {
+			minute: 1 | 1<<30, hour: 1<<9 | 1<<13 | 1<<17, dom: 1 << 1,
+			month: 1<<1 | 1<<7, dow: 1 | 1<<7, dowStar: false,
+		},
+		"5/20 0 * 1 1-5": {
+			minute: 1<<5 | 1<<25 | 1<<45, hour: 1, dom: 1<<32 - 2,
+			month: 1 << 1, dow: 0x3e, domStar: true,
+		},
+		"@hourly": {
+			minute: 1, hour: 1<<24 - 1, dom: 1<<32 - 2, month: 1<<13 - 2,
+			dow: 1<<8 - 1, domStar: true, dowStar: true,
+		},
+	} {
+		sched, err := parseCron(expr)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %s", expr, err)
+		}
+
+		if *sched != expected {
+			t.Fatalf("unexpected schedule for '%s': %+v", expr, *sched)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"*/a * * * *",
+	} {
+		if _, err := parseCron(expr); !errors.Is(err, ErrSchedule) {
+			t.Fatalf("invalid cron expression was allowed: '%s'", expr)
+		}
+	}
+}
+
+// TestCronScheduleNext tests computing the next run of cron schedules.
+func TestCronScheduleNext(t *testing.T) {
+	t.Parallel()
+
+	// A Wednesday.
+	start := time.Date(2024, time.January, 31, 10, 7, 30, 0, time.UTC)
+
+	for _, test := range []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 15, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 1", time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// Either the day of the month or the day of the week.
+		{"0 0 15 * 5", time.Date(2024, time.February, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		// Never.
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		sched, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %s", test.expr, err)
+		}
+
+		if next := sched.next(start); !next.Equal(test.expected) {
+			t.Fatalf("unexpected next run for '%s': %s", test.expr, next)
+		}
+
+		if first := sched.first(start); !first.Equal(test.expected) {
+			t.Fatalf("unexpected first run for '%s': %s", test.expr, first)
+		}
+	}
+}
+
+// TestIntervalSchedule tests the interval schedules.
+func TestIntervalSchedule(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, time.January, 31, 10, 7, 30, 0, time.UTC)
+	sched, err := ScheduleConf{Interval: time.Hour}.newSchedule()
+
+	if err != nil || sched == nil {
+		t.Fatalf("failed to create the schedule: %v", err)
+	}
+
+	if !sched.first(start).Equal(start) {
+		t.Fatal("unexpected first run")
+	}
+
+	if !sched.next(start).Equal(start.Add(time.Hour)) {
+		t.Fatal("unexpected next run")
+	}
+
+	if sched, err := (ScheduleConf{}).newSchedule(); sched != nil || err != nil {
+		t.Fatal("unexpected schedule without an interval or a cron expression")
+	}
+}
+
+// TestScheduleJitter tests the jitter of the schedules.
+func TestScheduleJitter(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	if jitter := (ScheduleConf{}).jitter(rnd); jitter != 0 {
+		t.Fatalf("unexpected jitter: %s", jitter)
+	}
+
+	sc := ScheduleConf{Jitter: time.Minute}
+	for i := 0; i < 100; i++ {
+		if jitter := sc.jitter(rnd); jitter < 0 || jitter >= time.Minute {
+			t.Fatalf("unexpected jitter: %s", jitter)
+		}
+	}
+}
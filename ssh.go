@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// The supported SSH options. They are named after their OpenSSH client
+// configuration equivalents and, as in OpenSSH, they are case-insensitive.
+const (
+	sshOptionUser              = "user"
+	sshOptionPort              = "port"
+	sshOptionHostKeyAlgorithms = "hostkeyalgorithms"
+	sshOptionKexAlgorithms     = "kexalgorithms"
+	sshOptionCiphers           = "ciphers"
+	sshOptionConnectTimeout    = "connecttimeout"
+	maxPort                    = 65535
+	defaultSSHPort             = 22
+)
+
+var ErrSSHOption = errors.New("invalid SSH option")
+
+// sshOptions holds the parsed SSH options of an SSH configuration. The zero
+// values leave the defaults in place.
+type sshOptions struct {
+	user              string
+	port              int
+	hostKeyAlgorithms []string
+	kexAlgorithms     []string
+	ciphers           []string
+	connectTimeout    time.Duration
+}
+
+// parseSSHOptions parses SSH options provided in the 'Key=Value' format.
+// Algorithm lists are comma separated and the connect timeout is provided in
+// seconds.
+func parseSSHOptions(options []string) (sshOptions, error) {
+	var opts sshOptions
+
+	for _, option := range options {
+		key, value, found := strings.Cut(option, "=")
+		if !found || len(value) == 0 {
+			return opts, fmt.Errorf("%w: %q is not in the 'Key=Value' format",
+				ErrSSHOption, option)
+		}
+
+		var err error
+
+		switch strings.ToLower(key) {
+		case sshOptionUser:
+			opts.user = value
+		case sshOptionPort:
+			opts.port, err = strconv.Atoi(value)
+			if err != nil || opts.port < 1 || opts.port > maxPort {
+				return opts, fmt.Errorf("%w: invalid port %q", ErrSSHOption, value)
+			}
+		case sshOptionHostKeyAlgorithms:
+			opts.hostKeyAlgorithms, err = parseAlgorithms(value)
+		case sshOptionKexAlgorithms:
+			opts.kexAlgorithms, err = parseAlgorithms(value)
+		case sshOptionCiphers:
+			opts.ciphers, err = parseAlgorithms(value)
+		case sshOptionConnectTimeout:
+			seconds, convErr := strconv.Atoi(value)
+			if convErr != nil || seconds < 1 {
+				return opts, fmt.Errorf("%w: invalid connect timeout %q",
+					ErrSSHOption, value)
+			}
+
+			opts.connectTimeout = time.Duration(seconds) * time.Second
+		default:
+			return opts, fmt.Errorf("%w: unsupported option %q", ErrSSHOption,
+				key)
+		}
+
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// parseAlgorithms parses a comma separated list of algorithms.
+func parseAlgorithms(value string) ([]string, error) {
+	algorithms := strings.Split(value, ",")
+	for _, algorithm := range algorithms {
+		if len(algorithm) == 0 {
+			return nil, fmt.Errorf("%w: invalid algorithm list %q",
+				ErrSSHOption, value)
+		}
+	}
+
+	return algorithms, nil
+}
+
+// hasClientConfig reports whether the options change the SSH client
+// configuration.
+func (opts sshOptions) hasClientConfig() bool {
+	return len(opts.hostKeyAlgorithms) != 0 || len(opts.kexAlgorithms) != 0 ||
+		len(opts.ciphers) != 0 || opts.connectTimeout != 0
+}
+
+// sshOptionsAuth is an SSH authentication method applying the SSH options to
+// the SSH client configuration of another SSH authentication method.
+type sshOptionsAuth struct {
+	ssh.AuthMethod
+	opts sshOptions
+}
+
+// ClientConfig returns the SSH client configuration of the wrapped
+// authentication method with the SSH options applied.
+func (a *sshOptionsAuth) ClientConfig() (*gossh.ClientConfig, error) {
+	config, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.opts.hostKeyAlgorithms) != 0 {
+		config.HostKeyAlgorithms = a.opts.hostKeyAlgorithms
+	}
+
+	if len(a.opts.kexAlgorithms) != 0 {
+		config.KeyExchanges = a.opts.kexAlgorithms
+	}
+
+	if len(a.opts.ciphers) != 0 {
+		config.Ciphers = a.opts.ciphers
+	}
+
+	if a.opts.connectTimeout != 0 {
+		config.Timeout = a.opts.connectTimeout
+	}
+
+	return config, nil
+}
+
+// withSSHOptions applies the SSH options to an SSH authentication method. The
+// authentication method is returned unchanged when the options don't change
+// the SSH client configuration.
+func withSSHOptions(auth ssh.AuthMethod, opts sshOptions) ssh.AuthMethod {
+	if !opts.hasClientConfig() {
+		return auth
+	}
+
+	return &sshOptionsAuth{
+		AuthMethod: auth,
+		opts:       opts,
+	}
+}
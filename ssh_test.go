@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestParseSSHOptions tests parsing the SSH options.
+func TestParseSSHOptions(t *testing.T) {
+	t.Parallel()
+
+	{
+		// No options.
+		opts, err := parseSSHOptions(nil)
+		if err != nil || opts.hasClientConfig() || len(opts.user) != 0 ||
+			opts.port != 0 {
+			t.Fatalf("unexpected options: %+v, %v", opts, err)
+		}
+	}
+	{
+		// All the options. The keys are case-insensitive.
+		opts, err := parseSSHOptions([]string{
+			"User=gerrit",
+			"port=29418",
+			"HostKeyAlgorithms=ssh-ed25519,rsa-sha2-512",
+			"KEXALGORITHMS=curve25519-sha256",
+			"Ciphers=aes256-gcm@openssh.com,aes256-ctr",
+			"ConnectTimeout=10",
+		})
+		if err != nil {
+			t.Fatalf("failed to parse the options: %s", err)
+		}
+		if !reflect.DeepEqual(opts, sshOptions{
+			user:              "gerrit",
+			port:              29418,
+			hostKeyAlgorithms: []string{"ssh-ed25519", "rsa-sha2-512"},
+			kexAlgorithms:     []string{"curve25519-sha256"},
+			ciphers:           []string{"aes256-gcm@openssh.com", "aes256-ctr"},
+			connectTimeout:    10 * time.Second,
+		}) {
+			t.Fatalf("unexpected options: %+v", opts)
+		}
+		if !opts.hasClientConfig() {
+			t.Fatal("options not changing the client configuration")
+		}
+	}
+	{
+		// Invalid options.
+		for _, option := range []string{
+			"User",
+			"User=",
+			"Port=0",
+			"Port=65536",
+			"Port=port",
+			"Ciphers=aes256-ctr,,aes128-ctr",
+			"KexAlgorithms=,",
+			"ConnectTimeout=0",
+			"ConnectTimeout=1s",
+			"IdentityFile=/path/to/key",
+		} {
+			_, err := parseSSHOptions([]string{option})
+			if !errors.Is(err, ErrSSHOption) {
+				t.Fatalf("invalid option %q was allowed", option)
+			}
+		}
+	}
+}
+
+// TestSSHOptionsAuth tests applying the SSH options to the SSH client
+// configuration.
+func TestSSHOptionsAuth(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	{
+		// The options are applied to the SSH client configuration.
+		_, auth, cleanup, err := newAuth(context.Background(), Config{
+			SSH: SSHConf{
+				PrivateKey: testSSHKey,
+				KnownHosts: testKnownHost,
+				Options: []string{
+					"User=gerrit",
+					"HostKeyAlgorithms=ssh-ed25519",
+					"KexAlgorithms=curve25519-sha256",
+					"Ciphers=aes256-ctr",
+					"ConnectTimeout=5",
+				},
+			},
+		}, logger, "git@example.com:dst/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication: %s", err)
+		}
+		defer cleanup()
+
+		sshAuth, ok := auth.(ssh.AuthMethod)
+		if !ok {
+			t.Fatal("unexpected authentication method")
+		}
+
+		config, err := sshAuth.ClientConfig()
+		if err != nil {
+			t.Fatalf("failed to get the SSH client configuration: %s", err)
+		}
+
+		if config.User != "gerrit" ||
+			!cmp.Equal(config.HostKeyAlgorithms, []string{"ssh-ed25519"}) ||
+			!cmp.Equal(config.KeyExchanges, []string{"curve25519-sha256"}) ||
+			!cmp.Equal(config.Ciphers, []string{"aes256-ctr"}) ||
+			config.Timeout != 5*time.Second || config.HostKeyCallback == nil {
+			t.Fatalf("unexpected SSH client configuration: %+v", config)
+		}
+	}
+	{
+		// The user of the repository URL is used by default.
+		_, auth, cleanup, err := newAuth(context.Background(), Config{
+			SSH: SSHConf{
+				PrivateKey: testSSHKey,
+				KnownHosts: testKnownHost,
+			},
+		}, logger, "ssh://gerrit@example.com:29418/dst")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication: %s", err)
+		}
+		defer cleanup()
+
+		publicKeys, ok := auth.(*ssh.PublicKeys)
+		if !ok || publicKeys.User != "gerrit" {
+			t.Fatal("unexpected authentication method")
+		}
+	}
+	{
+		// Invalid options.
+		_, _, _, err := newAuth(context.Background(), Config{
+			SSH: SSHConf{
+				PrivateKey: testSSHKey,
+				KnownHosts: testKnownHost,
+				Options:    []string{"invalid"},
+			},
+		}, logger, "git@example.com:dst/repo.git")
+		if !errors.Is(err, ErrSSHOption) {
+			t.Fatal("invalid options were allowed")
+		}
+	}
+}
@@ -0,0 +1,431 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/kevinburke/ssh_config"
+)
+
+// The SSH client configuration file path disabling the SSH client
+// configuration, as in OpenSSH.
+const sshConfigNone = "none"
+
+var (
+	ErrSSHConfig = errors.New("invalid SSH client configuration")
+	ErrProxyJump = errors.New("invalid ProxyJump configuration")
+)
+
+// scpLikePortRegexp matches the port of an SCP-like repository URL, following
+// its host.
+var scpLikePortRegexp = regexp.MustCompile(`^[0-9]{1,5}[:/]`)
+
+// sshRepo is a repository accessed over SSH, resolved with the SSH options
+// and the SSH client configuration file.
+type sshRepo struct {
+	// repo is the configured repository URL.
+	repo     string
+	endpoint *transport.Endpoint
+	// explicitPort reports whether the repository URL provides the port.
+	explicitPort bool
+	opts         sshOptions
+	user         string
+	hostName     string
+	port         int
+	// identityFiles and knownHostsFiles are provided by the SSH client
+	// configuration file.
+	identityFiles   []string
+	knownHostsFiles []string
+	// jumpUser and jumpAddr describe the jump host, if any.
+	jumpUser string
+	jumpAddr string
+}
+
+// defaultSSHConfigPath returns the path of the SSH client configuration file
+// of the user.
+func defaultSSHConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// loadSSHConfig parses an SSH client configuration file. When the path is
+// empty, the SSH client configuration file of the user is used, if it
+// exists. A nil configuration is returned when the SSH client configuration
+// is disabled.
+func loadSSHConfig(path string) (*ssh_config.Config, error) {
+	if path == sshConfigNone {
+		return nil, nil
+	}
+
+	optional := len(path) == 0
+	if optional {
+		path = defaultSSHConfigPath()
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if optional {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrSSHConfig, err)
+	}
+	defer file.Close()
+
+	config, err := ssh_config.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrSSHConfig, path, err)
+	}
+
+	return config, nil
+}
+
+// sshConfigGet returns the value of a key for a host alias of an SSH client
+// configuration. The value is empty when the configuration is nil.
+func sshConfigGet(config *ssh_config.Config, alias, key string) (string, error) {
+	if config == nil {
+		return "", nil
+	}
+
+	value, err := config.Get(alias, key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSSHConfig, err)
+	}
+
+	return value, nil
+}
+
+// sshConfigGetAll returns all the values of a key for a host alias of an SSH
+// client configuration. The values are empty when the configuration is nil.
+func sshConfigGetAll(config *ssh_config.Config, alias, key string) ([]string, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	values, err := config.GetAll(alias, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSSHConfig, err)
+	}
+
+	return values, nil
+}
+
+// expandSSHPath expands the leading '~' and the '%d' (home directory), '%h'
+// (host name), '%p' (port), '%r' (user) and '%%' tokens of a path of an SSH
+// client configuration.
+func expandSSHPath(path string, repo *sshRepo) string {
+	home, _ := os.UserHomeDir()
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", repo.hostName,
+		"%p", strconv.Itoa(repo.port),
+		"%r", repo.user,
+	).Replace(path)
+}
+
+// hasExplicitPort reports whether an SSH repository URL provides the port.
+func hasExplicitPort(repo string, endpoint *transport.Endpoint) bool {
+	if strings.Contains(repo, "://") {
+		repoURL, err := url.Parse(repo)
+
+		return err == nil && len(repoURL.Port()) != 0
+	}
+
+	// SCP-like URLs provide the port between the host and the path.
+	host := endpoint.Host + ":"
+	if len(endpoint.User) != 0 {
+		host = endpoint.User + "@" + host
+	}
+
+	return scpLikePortRegexp.MatchString(strings.TrimPrefix(repo, host))
+}
+
+// resolveSSHRepo resolves a repository accessed over SSH based on the SSH
+// options and the SSH client configuration file, as the OpenSSH client
+// would. The host is used as an alias in the SSH client configuration file
+// providing the host name, the user, the port, the identity files, the known
+// hosts files and the jump host. A configured bastion is used as the jump
+// host instead. Only the user is resolved for the repositories not accessed
+// over SSH.
+//
+// The user of the SSH options takes precedence over the user of the
+// repository URL and the user of the SSH client configuration file,
+// defaulting to 'git'. The port of the repository URL takes precedence over
+// the port of the SSH options and the port of the SSH client configuration
+// file.
+func resolveSSHRepo(conf Config, sshConf SSHConf, repo string) (*sshRepo, error) {
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %s: %w", RedactURL(repo),
+			err)
+	}
+
+	opts, err := parseSSHOptions(sshConf.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := &sshRepo{
+		repo:     repo,
+		endpoint: endpoint,
+		opts:     opts,
+	}
+
+	if endpoint.Protocol != "ssh" {
+		resolved.user = opts.user
+		if len(resolved.user) == 0 {
+			resolved.user = defaultSSHUser
+		}
+
+		return resolved, nil
+	}
+
+	config, err := loadSSHConfig(conf.SSHConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	alias := endpoint.Host
+	resolved.explicitPort = hasExplicitPort(repo, endpoint)
+	resolved.hostName = alias
+	resolved.port = endpoint.Port
+
+	// The tokens of the host name only support the alias.
+	hostName, err := sshConfigGet(config, alias, "HostName")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hostName) != 0 {
+		resolved.hostName = strings.ReplaceAll(hostName, "%h", alias)
+	}
+
+	configUser, err := sshConfigGet(config, alias, "User")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(opts.user) != 0:
+		resolved.user = opts.user
+	case len(endpoint.User) != 0:
+		resolved.user = endpoint.User
+	case len(configUser) != 0:
+		resolved.user = configUser
+	default:
+		resolved.user = defaultSSHUser
+	}
+
+	configPort, err := sshConfigGet(config, alias, "Port")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resolved.explicitPort:
+	case opts.port != 0:
+		resolved.port = opts.port
+	case len(configPort) != 0:
+		resolved.port, err = strconv.Atoi(configPort)
+		if err != nil || resolved.port < 1 || resolved.port > maxPort {
+			return nil, fmt.Errorf("%w: invalid port %q for %s", ErrSSHConfig,
+				configPort, alias)
+		}
+	default:
+		resolved.port = defaultSSHPort
+	}
+
+	identityFiles, err := sshConfigGetAll(config, alias, "IdentityFile")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, identityFile := range identityFiles {
+		resolved.identityFiles = append(resolved.identityFiles,
+			expandSSHPath(identityFile, resolved))
+	}
+
+	// Each UserKnownHostsFile value can provide multiple files.
+	knownHostsFiles, err := sshConfigGetAll(config, alias, "UserKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, knownHostsFile := range knownHostsFiles {
+		for _, file := range strings.Fields(knownHostsFile) {
+			resolved.knownHostsFiles = append(resolved.knownHostsFiles,
+				expandSSHPath(file, resolved))
+		}
+	}
+
+	// The bastion takes precedence over the jump host of the SSH client
+	// configuration file.
+	if len(sshConf.Bastion.Host) != 0 {
+		resolved.jumpAddr, err = sshConf.Bastion.addr()
+		if err != nil {
+			return nil, err
+		}
+
+		resolved.jumpUser = sshConf.Bastion.User
+		if len(resolved.jumpUser) == 0 {
+			resolved.jumpUser = resolved.user
+		}
+
+		return resolved, nil
+	}
+
+	proxyJump, err := sshConfigGet(config, alias, "ProxyJump")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(proxyJump) != 0 && proxyJump != sshConfigNone {
+		resolved.jumpUser, resolved.jumpAddr, err = resolveJumpHost(config,
+			proxyJump, resolved.user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
+
+// resolveJumpHost resolves a jump host provided in the '[user@]host[:port]'
+// format. The host is used as an alias in the SSH client configuration file
+// providing the host name, the user and the port. The user defaults to the
+// provided one. Chains of jump hosts are not supported.
+func resolveJumpHost(config *ssh_config.Config, jumpHost, defaultUser string) (string, string, error) {
+	if strings.Contains(jumpHost, ",") {
+		return "", "", fmt.Errorf("%w: chains of jump hosts are not supported: %s",
+			ErrProxyJump, jumpHost)
+	}
+
+	jumpHost = strings.TrimPrefix(jumpHost, "ssh://")
+
+	user, alias, found := strings.Cut(jumpHost, "@")
+	if !found {
+		user, alias = "", jumpHost
+	}
+
+	port := ""
+
+	if host, hostPort, err := net.SplitHostPort(alias); err == nil {
+		alias, port = host, hostPort
+	}
+
+	if len(alias) == 0 {
+		return "", "", fmt.Errorf("%w: %s", ErrProxyJump, jumpHost)
+	}
+
+	hostName, err := sshConfigGet(config, alias, "HostName")
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(hostName) == 0 {
+		hostName = alias
+	}
+
+	if len(user) == 0 {
+		user, err = sshConfigGet(config, alias, "User")
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if len(user) == 0 {
+		user = defaultUser
+	}
+
+	if len(port) == 0 {
+		port, err = sshConfigGet(config, alias, "Port")
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if len(port) == 0 {
+		port = strconv.Itoa(defaultSSHPort)
+	}
+
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 ||
+		portNumber > maxPort {
+		return "", "", fmt.Errorf("%w: invalid port %q for %s", ErrProxyJump,
+			port, alias)
+	}
+
+	return user, net.JoinHostPort(hostName, port), nil
+}
+
+// addr returns the address of the SSH server of the repository.
+func (r *sshRepo) addr() string {
+	return net.JoinHostPort(r.hostName, strconv.Itoa(r.port))
+}
+
+// url returns the URL used to access the repository on a host and a port.
+// The repository URL is returned unchanged when it already points to them or
+// when the repository is not accessed over SSH.
+func (r *sshRepo) url(host string, port int) string {
+	if r.endpoint.Protocol != "ssh" {
+		return r.repo
+	}
+
+	currentPort := r.endpoint.Port
+	if !r.explicitPort {
+		currentPort = defaultSSHPort
+	}
+
+	if host == r.endpoint.Host && port == currentPort {
+		return r.repo
+	}
+
+	portStr := strconv.Itoa(port)
+
+	// SCP-like URLs can't provide IPv6 hosts.
+	if !strings.Contains(r.repo, "://") && !strings.Contains(host, ":") {
+		userHost := host
+		if len(r.endpoint.User) != 0 {
+			userHost = r.endpoint.User + "@" + host
+		}
+
+		return userHost + ":" + portStr + ":" + r.endpoint.Path
+	}
+
+	repoURL := url.URL{
+		Scheme: "ssh",
+		Host:   net.JoinHostPort(host, portStr),
+		Path:   r.endpoint.Path,
+	}
+
+	if len(r.endpoint.User) != 0 {
+		repoURL.User = url.User(r.endpoint.User)
+	}
+
+	if !strings.HasPrefix(repoURL.Path, "/") {
+		repoURL.Path = "/" + repoURL.Path
+	}
+
+	return repoURL.String()
+}
@@ -0,0 +1,603 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeTestSSHConfig writes an SSH client configuration file in a directory
+// and returns its path.
+func writeTestSSHConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+
+	configPath := path.Join(dir, "ssh_config")
+	if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write the SSH client configuration: %s", err)
+	}
+
+	return configPath
+}
+
+// TestLoadSSHConfig tests loading the SSH client configuration file.
+func TestLoadSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	{
+		// Disabled SSH client configuration.
+		config, err := loadSSHConfig(sshConfigNone)
+		if err != nil || config != nil {
+			t.Fatalf("unexpected disabled configuration: %v, %v", config, err)
+		}
+	}
+	{
+		// Missing SSH client configuration file.
+		_, err := loadSSHConfig(path.Join(dir, "invalid"))
+		if !errors.Is(err, ErrSSHConfig) {
+			t.Fatal("missing SSH client configuration file was allowed")
+		}
+	}
+	{
+		// SSH client configuration file.
+		config, err := loadSSHConfig(writeTestSSHConfig(t, dir,
+			"Host alias\n  HostName example.com\n"))
+		if err != nil || config == nil {
+			t.Fatalf("failed to load the configuration: %s", err)
+		}
+		if hostName, err := sshConfigGet(config, "alias",
+			"HostName"); err != nil || hostName != "example.com" {
+			t.Fatalf("unexpected host name: %s, %v", hostName, err)
+		}
+	}
+	{
+		// Unsupported Match directives.
+		_, err := loadSSHConfig(writeTestSSHConfig(t, dir,
+			"Match host alias\n  HostName example.com\n"))
+		if !errors.Is(err, ErrSSHConfig) {
+			t.Fatal("Match directive was allowed")
+		}
+	}
+}
+
+// TestResolveSSHRepoUser tests picking the SSH user.
+func TestResolveSSHRepoUser(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Config{
+		SSHConfigPath: writeTestSSHConfig(t, dir, "Host *\n  User config\n"),
+	}
+
+	tests := []struct {
+		repo    string
+		options []string
+		user    string
+	}{
+		{"git@example.com:repo/name.git", []string{"User=user"}, "user"},
+		{"gerrit@example.com:repo/name.git", nil, "gerrit"},
+		{"ssh://gerrit@example.com/repo.git", nil, "gerrit"},
+		{"ssh://example.com/repo.git", nil, "config"},
+		{"/path/to/repo", nil, defaultSSHUser},
+		{"/path/to/repo", []string{"User=user"}, "user"},
+	}
+
+	for _, test := range tests {
+		resolved, err := resolveSSHRepo(conf, SSHConf{Options: test.options},
+			test.repo)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %s", test.repo, err)
+		}
+
+		if resolved.user != test.user {
+			t.Fatalf("unexpected user for %s: %s", test.repo, resolved.user)
+		}
+	}
+
+	// The user defaults to 'git' without an SSH client configuration file.
+	resolved, err := resolveSSHRepo(Config{SSHConfigPath: sshConfigNone},
+		SSHConf{}, "ssh://example.com/repo.git")
+	if err != nil || resolved.user != defaultSSHUser {
+		t.Fatalf("unexpected default user: %+v, %v", resolved, err)
+	}
+}
+
+// TestResolveSSHRepoURL tests applying the SSH port option to the repository
+// URLs.
+func TestResolveSSHRepoURL(t *testing.T) {
+	t.Parallel()
+
+	conf := Config{SSHConfigPath: sshConfigNone}
+	sshConf := SSHConf{Options: []string{"Port=2222"}}
+
+	tests := map[string]string{
+		"git@example.com:repo/name.git":      "git@example.com:2222:repo/name.git",
+		"example.com:repo/name.git":          "example.com:2222:repo/name.git",
+		"git@example.com:22/repo/name.git":   "git@example.com:22/repo/name.git",
+		"ssh://git@example.com/repo.git":     "ssh://git@example.com:2222/repo.git",
+		"ssh://git@example.com:22/repo.git":  "ssh://git@example.com:22/repo.git",
+		"https://example.com/repo.git":       "https://example.com/repo.git",
+		"/path/to/repo":                      "/path/to/repo",
+		"file:///path/to/repo":               "file:///path/to/repo",
+		"ssh://git@[::1]/repo.git":           "ssh://git@[::1]:2222/repo.git",
+		"git@example.com:2222:repo/name.git": "git@example.com:2222:repo/name.git",
+	}
+
+	for repo, expected := range tests {
+		resolved, err := resolveSSHRepo(conf, sshConf, repo)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %s", repo, err)
+		}
+
+		if repoURL := resolved.url(resolved.hostName,
+			resolved.port); repoURL != expected {
+			t.Fatalf("unexpected URL for %s: %s", repo, repoURL)
+		}
+	}
+
+	// The rewritten SCP-like URLs keep their path.
+	endpoint, err := transport.NewEndpoint("git@example.com:2222:repo/name.git")
+	if err != nil || endpoint.Port != 2222 || endpoint.Path != "repo/name.git" {
+		t.Fatalf("unexpected endpoint: %+v, %v", endpoint, err)
+	}
+
+	// No port option.
+	resolved, err := resolveSSHRepo(conf, SSHConf{},
+		"git@example.com:repo/name.git")
+	if err != nil || resolved.url(resolved.hostName,
+		resolved.port) != "git@example.com:repo/name.git" {
+		t.Fatalf("unexpected URL without a port option: %+v, %v", resolved, err)
+	}
+
+	// Invalid options.
+	_, err = resolveSSHRepo(conf, SSHConf{Options: []string{"invalid"}},
+		"git@example.com:repo/name.git")
+	if !errors.Is(err, ErrSSHOption) {
+		t.Fatal("invalid options were allowed")
+	}
+}
+
+// TestResolveSSHRepoConfig tests resolving the repositories with the SSH
+// client configuration file.
+func TestResolveSSHRepoConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatalf("failed to get the home directory: %s", err)
+	}
+
+	conf := Config{
+		SSHConfigPath: writeTestSSHConfig(t, dir, `
+Host alias
+  HostName %h.example.com
+  User alias-user
+  Port 2200
+  IdentityFile ~/.ssh/id_alias
+  IdentityFile /keys/%r@%h:%p%%
+  UserKnownHostsFile /known_hosts ~/.ssh/known_hosts_alias
+
+Host jumped
+  HostName 10.0.0.1
+  ProxyJump bastion
+
+Host jumped-explicit
+  ProxyJump admin@bastion:2023
+
+Host jumped-none
+  ProxyJump none
+
+Host jumped-chain
+  ProxyJump bastion,other
+
+Host bastion
+  HostName bastion.example.com
+  User bastion-user
+  Port 2022
+
+Host invalid-port
+  Port invalid
+`),
+	}
+
+	{
+		// Host alias.
+		resolved, err := resolveSSHRepo(conf, SSHConf{}, "alias:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to resolve the host alias: %s", err)
+		}
+		if resolved.hostName != "alias.example.com" ||
+			resolved.user != "alias-user" || resolved.port != 2200 ||
+			len(resolved.jumpAddr) != 0 {
+			t.Fatalf("unexpected host alias resolution: %+v", resolved)
+		}
+		if !reflect.DeepEqual(resolved.identityFiles, []string{
+			path.Join(home, ".ssh/id_alias"),
+			"/keys/alias-user@alias.example.com:2200%",
+		}) {
+			t.Fatalf("unexpected identity files: %v", resolved.identityFiles)
+		}
+		if !reflect.DeepEqual(resolved.knownHostsFiles, []string{
+			"/known_hosts",
+			path.Join(home, ".ssh/known_hosts_alias"),
+		}) {
+			t.Fatalf("unexpected known hosts files: %v",
+				resolved.knownHostsFiles)
+		}
+		if repoURL := resolved.url(resolved.hostName,
+			resolved.port); repoURL != "alias.example.com:2200:team/repo.git" {
+			t.Fatalf("unexpected URL: %s", repoURL)
+		}
+	}
+	{
+		// The SSH options and the repository URL take precedence.
+		resolved, err := resolveSSHRepo(conf, SSHConf{
+			Options: []string{"User=user", "Port=2222"},
+		}, "alias:team/repo.git")
+		if err != nil || resolved.user != "user" || resolved.port != 2222 {
+			t.Fatalf("unexpected option precedence: %+v, %v", resolved, err)
+		}
+
+		resolved, err = resolveSSHRepo(conf, SSHConf{
+			Options: []string{"Port=2222"},
+		}, "ssh://url-user@alias:29418/team/repo.git")
+		if err != nil || resolved.user != "url-user" || resolved.port != 29418 {
+			t.Fatalf("unexpected URL precedence: %+v, %v", resolved, err)
+		}
+		if repoURL := resolved.url(resolved.hostName, resolved.port); repoURL !=
+			"ssh://url-user@alias.example.com:29418/team/repo.git" {
+			t.Fatalf("unexpected URL: %s", repoURL)
+		}
+	}
+	{
+		// Unknown hosts are not changed.
+		resolved, err := resolveSSHRepo(conf, SSHConf{},
+			"git@example.com:team/repo.git")
+		if err != nil || resolved.hostName != "example.com" ||
+			resolved.port != defaultSSHPort ||
+			len(resolved.identityFiles) != 0 {
+			t.Fatalf("unexpected unknown host resolution: %+v, %v", resolved,
+				err)
+		}
+		if repoURL := resolved.url(resolved.hostName,
+			resolved.port); repoURL != "git@example.com:team/repo.git" {
+			t.Fatalf("unexpected URL: %s", repoURL)
+		}
+	}
+	{
+		// Jump hosts.
+		resolved, err := resolveSSHRepo(conf, SSHConf{}, "jumped:team/repo.git")
+		if err != nil || resolved.jumpUser != "bastion-user" ||
+			resolved.jumpAddr != "bastion.example.com:2022" ||
+			resolved.addr() != "10.0.0.1:22" {
+			t.Fatalf("unexpected jump host resolution: %+v, %v", resolved, err)
+		}
+
+		resolved, err = resolveSSHRepo(conf, SSHConf{}, "jumped-explicit:team/repo.git")
+		if err != nil || resolved.jumpUser != "admin" ||
+			resolved.jumpAddr != "bastion.example.com:2023" {
+			t.Fatalf("unexpected jump host resolution: %+v, %v", resolved, err)
+		}
+
+		resolved, err = resolveSSHRepo(conf, SSHConf{}, "jumped-none:team/repo.git")
+		if err != nil || len(resolved.jumpAddr) != 0 {
+			t.Fatalf("unexpected jump host resolution: %+v, %v", resolved, err)
+		}
+
+		_, err = resolveSSHRepo(conf, SSHConf{}, "jumped-chain:team/repo.git")
+		if !errors.Is(err, ErrProxyJump) {
+			t.Fatal("chain of jump hosts was allowed")
+		}
+	}
+	{
+		// Invalid port.
+		_, err := resolveSSHRepo(conf, SSHConf{}, "invalid-port:team/repo.git")
+		if !errors.Is(err, ErrSSHConfig) {
+			t.Fatal("invalid port was allowed")
+		}
+	}
+	{
+		// Missing SSH client configuration file.
+		_, err := resolveSSHRepo(Config{
+			SSHConfigPath: path.Join(dir, "invalid"),
+		}, SSHConf{}, "alias:team/repo.git")
+		if !errors.Is(err, ErrSSHConfig) {
+			t.Fatal("missing SSH client configuration file was allowed")
+		}
+	}
+}
+
+// TestNewAuthSSHConfig tests setting up the SSH authentication with the SSH
+// client configuration file.
+func TestNewAuthSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := path.Join(dir, "key")
+	if err := os.WriteFile(keyPath, []byte(testSSHKey), 0o600); err != nil {
+		t.Fatalf("failed to write the key file: %s", err)
+	}
+
+	encryptedKeyPath := path.Join(dir, "encrypted_key")
+	if err := os.WriteFile(encryptedKeyPath, []byte(testEncryptedSSHKey),
+		0o600); err != nil {
+		t.Fatalf("failed to write the encrypted key file: %s", err)
+	}
+
+	knownHostsPath := path.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsPath, []byte(testKnownHost),
+		0o600); err != nil {
+		t.Fatalf("failed to write the known hosts file: %s", err)
+	}
+
+	conf := Config{
+		SSHConfigPath: writeTestSSHConfig(t, dir, fmt.Sprintf(`
+Host alias
+  HostName github.com
+  User alias-user
+  Port 2200
+  IdentityFile %s/missing_key
+  IdentityFile %s
+  UserKnownHostsFile %s
+
+Host encrypted
+  IdentityFile %s
+
+Host missing
+  IdentityFile %s/missing_key
+`, dir, keyPath, knownHostsPath, encryptedKeyPath, dir)),
+	}
+
+	{
+		// Identity files authentication.
+		repoURL, auth, cleanup, err := newAuth(context.Background(), conf, logger, "alias:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up identity files authentication: %s", err)
+		}
+		defer cleanup()
+
+		if repoURL != "github.com:2200:team/repo.git" {
+			t.Fatalf("unexpected URL: %s", repoURL)
+		}
+
+		identityAuth, ok := auth.(*ssh.PublicKeysCallback)
+		if !ok || identityAuth.User != "alias-user" {
+			t.Fatal("unexpected authentication method")
+		}
+
+		signers, err := identityAuth.Callback()
+		if err != nil || len(signers) != 1 {
+			t.Fatalf("unexpected identity file signers: %v", err)
+		}
+
+		if identityAuth.HostKeyCallback == nil {
+			t.Fatal("identity files authentication without host key " +
+				"validation")
+		}
+	}
+	{
+		// The SSH private key takes precedence over the identity files.
+		_, auth, cleanup, err := newAuth(context.Background(), Config{
+			SSHConfigPath: conf.SSHConfigPath,
+			SSH: SSHConf{
+				PrivateKey: testSSHKey,
+				KnownHosts: testKnownHost,
+			},
+		}, logger, "alias:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication: %s", err)
+		}
+		cleanup()
+
+		if publicKeys, ok := auth.(*ssh.PublicKeys); !ok ||
+			publicKeys.User != "alias-user" {
+			t.Fatal("unexpected authentication method")
+		}
+	}
+	{
+		// Encrypted identity files use the passphrase.
+		_, _, _, err := newAuth(context.Background(), conf, logger, "encrypted:team/repo.git")
+		if !errors.Is(err, ErrNoPassphrase) {
+			t.Fatalf("encrypted identity file without passphrase was allowed: "+
+				"%v", err)
+		}
+
+		_, auth, cleanup, err := newAuth(context.Background(), Config{
+			SSHConfigPath: conf.SSHConfigPath,
+			SSH: SSHConf{
+				Passphrase: testSSHKeyPassphrase,
+			},
+		}, logger, "encrypted:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up encrypted identity file "+
+				"authentication: %s", err)
+		}
+		cleanup()
+
+		if _, ok := auth.(*ssh.PublicKeysCallback); !ok {
+			t.Fatal("unexpected authentication method")
+		}
+	}
+	{
+		// Missing identity files.
+		repoURL, auth, cleanup, err := newAuth(context.Background(), conf, logger, "missing:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up no authentication: %s", err)
+		}
+		cleanup()
+
+		if auth != nil || repoURL != "missing:team/repo.git" {
+			t.Fatal("unexpected authentication method")
+		}
+	}
+}
+
+// TestNewAuthProxyJump tests setting up the SSH authentication through a jump
+// host provided by the SSH client configuration file.
+func TestNewAuthProxyJump(t *testing.T) {
+	t.Parallel()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	echoAddr, stopEcho := newTestEchoServer(t)
+	defer stopEcho()
+
+	jumpAddr, stopJump := newTestJumpHost(t)
+	defer stopJump()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Both the jump host and the target use the test SSH key as host key.
+	knownHosts := knownhosts.Line([]string{jumpAddr}, signer.PublicKey()) +
+		"\n" + knownhosts.Line([]string{"git.internal"}, signer.PublicKey()) +
+		"\n"
+
+	conf := Config{
+		SSHConfigPath: writeTestSSHConfig(t, dir, fmt.Sprintf(`
+Host internal
+  HostName git.internal
+  ProxyJump %s@%s
+`, testJumpUser, jumpAddr)),
+		SSH: SSHConf{
+			PrivateKey: testSSHKey,
+			KnownHosts: knownHosts,
+		},
+	}
+
+	{
+		repoURL, auth, cleanup, err := newAuth(context.Background(), conf, logger,
+			"git@internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the jump "+
+				"host: %s", err)
+		}
+		defer cleanup()
+
+		// The repository is accessed through the jump host with its
+		// resolved URL.
+		endpoint, err := transport.NewEndpoint(repoURL)
+		if err != nil || endpoint.Host != "git.internal" ||
+			endpoint.Path != "team/repo.git" || endpoint.User != "git" {
+			t.Fatalf("unexpected URL: %s, %v", repoURL, err)
+		}
+
+		dialer, ok := auth.(sshDialer)
+		if !ok {
+			t.Fatal("the authentication method doesn't tunnel the connections")
+		}
+
+		conn, err := dialer.dialSSH(ctx, echoAddr)
+		if err != nil {
+			t.Fatalf("failed to connect through the jump host: %s", err)
+		}
+		conn.Close()
+
+		sshAuth, ok := auth.(ssh.AuthMethod)
+		if !ok {
+			t.Fatal("unexpected authentication method")
+		}
+
+		config, err := sshAuth.ClientConfig()
+		if err != nil {
+			t.Fatalf("failed to get the SSH client configuration: %s", err)
+		}
+
+		// The host key is checked against the target.
+		targetAddr := net.JoinHostPort(endpoint.Host, fmt.Sprint(endpoint.Port))
+		remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: endpoint.Port}
+		if err := config.HostKeyCallback(targetAddr, remote,
+			signer.PublicKey()); err != nil {
+			t.Fatalf("target host key was rejected: %s", err)
+		}
+
+		otherSigner, err := gossh.ParsePrivateKey([]byte(newTestSSHKey(t)))
+		if err != nil {
+			t.Fatalf("failed to parse the other key: %s", err)
+		}
+		if err := config.HostKeyCallback(targetAddr, remote,
+			otherSigner.PublicKey()); err == nil {
+			t.Fatal("unknown target host key was accepted")
+		}
+	}
+	{
+		// Unknown jump host key.
+		_, auth, cleanup, err := newAuth(context.Background(), Config{
+			SSHConfigPath: conf.SSHConfigPath,
+			SSH: SSHConf{
+				PrivateKey: testSSHKey,
+				KnownHosts: testKnownHost,
+			},
+		}, logger, "git@internal:team/repo.git")
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication through the jump "+
+				"host: %s", err)
+		}
+		defer cleanup()
+
+		dialer, ok := auth.(sshDialer)
+		if !ok {
+			t.Fatal("the authentication method doesn't tunnel the connections")
+		}
+
+		if _, err := dialer.dialSSH(ctx, echoAddr); err == nil {
+			t.Fatal("unknown jump host key was accepted")
+		}
+	}
+}
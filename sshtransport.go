@@ -0,0 +1,538 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// defaultSSHConnectTimeout bounds the connection to an SSH server,
+	// including the handshake, when no connect timeout is configured.
+	defaultSSHConnectTimeout = 30 * time.Second
+	// sshErrorTimeout bounds the wait for the error message of an SSH
+	// server closing a session without output.
+	sshErrorTimeout = 10 * time.Second
+)
+
+// The messages of the SSH servers reporting a missing repository, as
+// recognised by go-git.
+var sshRepoNotFoundPrefixes = []string{
+	"ERROR: Repository not found.",
+	"conq: repository does not exist.",
+	"Gogs: Repository does not exist or you do not have access",
+}
+
+// sshDialer is implemented by the SSH authentication methods reaching the SSH
+// servers through a jump host or a proxy.
+type sshDialer interface {
+	dialSSH(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// sshTransport is the transport of the repositories accessed over SSH. Unlike
+// the go-git one, it connects to the host and the port of the repository URL
+// as they are: the URLs are resolved with the SSH client configuration file
+// beforehand, per repository (see resolveSSHRepo). The connections are
+// dialed through the authentication method when it is an sshDialer and they
+// are cancelled with the context of the remote operation. The go-git SSH
+// transport can't be used for this as it dials without a context, only
+// through the proxy of the process environment, and its session is internal.
+type sshTransport struct{}
+
+func (sshTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	return newSSHSession(transport.UploadPackServiceName, ep, auth)
+}
+
+func (sshTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return newSSHSession(transport.ReceivePackServiceName, ep, auth)
+}
+
+// sshAuthMethod returns the SSH authentication method used with a
+// repository. Without an authentication method, the go-git default one (the
+// SSH agent) is used.
+func sshAuthMethod(ep *transport.Endpoint, auth transport.AuthMethod) (ssh.AuthMethod, error) {
+	if auth == nil {
+		return ssh.DefaultAuthBuilder(ep.User)
+	}
+
+	sshAuth, ok := auth.(ssh.AuthMethod)
+	if !ok {
+		return nil, transport.ErrInvalidAuthMethod
+	}
+
+	return sshAuth, nil
+}
+
+// closeOnCancel closes a connection when the context is cancelled before the
+// returned function is called. This aborts the SSH handshakes, which only
+// honour the deadlines.
+func closeOnCancel(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// contextError returns the error of the context, when done, instead of the
+// error of an operation aborted by closeOnCancel.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// connectSSH connects to the SSH server of a repository. The connection,
+// including the handshake, is cancelled with the context and bounded by the
+// connect timeout.
+func connectSSH(ctx context.Context, ep *transport.Endpoint, auth ssh.AuthMethod) (*gossh.Client, error) {
+	config, err := auth.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultSSHConnectTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	port := ep.Port
+	if port <= 0 {
+		port = defaultSSHPort
+	}
+
+	addr := net.JoinHostPort(ep.Host, strconv.Itoa(port))
+
+	var conn net.Conn
+
+	if dialer, ok := auth.(sshDialer); ok {
+		conn, err = dialer.dialSSH(ctx, addr)
+	} else {
+		// Like go-git, honour the proxy of the process environment.
+		conn, err = proxy.Dial(ctx, "tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The connect timeout also bounds the handshake.
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	stop := closeOnCancel(ctx, conn)
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, addr, config)
+	stop()
+
+	if err != nil {
+		conn.Close()
+
+		return nil, contextError(ctx, err)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return gossh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sshSession is a git-upload-pack or git-receive-pack session with a
+// repository accessed over SSH. It behaves like the go-git SSH sessions
+// except that it connects when the references are first requested, with the
+// context of the request.
+type sshSession struct {
+	service       string
+	ep            *transport.Endpoint
+	auth          ssh.AuthMethod
+	client        *gossh.Client
+	session       *gossh.Session
+	stdin         io.WriteCloser
+	stdout        io.Reader
+	firstErrLine  chan string
+	isReceivePack bool
+	advRefs       *packp.AdvRefs
+	packRun       bool
+	finished      bool
+}
+
+// newSSHSession returns a session running a git service on the SSH server of
+// a repository. The session connects to the server when the references are
+// first requested.
+func newSSHSession(service string, ep *transport.Endpoint, auth transport.AuthMethod) (*sshSession, error) {
+	sshAuth, err := sshAuthMethod(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshSession{
+		service:       service,
+		ep:            ep,
+		auth:          sshAuth,
+		isReceivePack: service == transport.ReceivePackServiceName,
+	}, nil
+}
+
+// connect connects to the SSH server, unless already connected, and starts
+// the git service on the repository path.
+func (s *sshSession) connect(ctx context.Context) error {
+	if s.client != nil {
+		return nil
+	}
+
+	client, err := connectSSH(ctx, s.ep, s.auth)
+	if err != nil {
+		return err
+	}
+
+	s.client = client
+
+	if err := s.start(); err != nil {
+		client.Close()
+
+		s.client, s.session = nil, nil
+
+		return err
+	}
+
+	return nil
+}
+
+// start starts the git service on the repository path.
+func (s *sshSession) start() error {
+	var err error
+
+	s.session, err = s.client.NewSession()
+	if err != nil {
+		return err
+	}
+
+	s.stdin, err = s.session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	s.stdout, err = s.session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := s.session.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	s.firstErrLine = listenFirstError(stderr)
+
+	return s.session.Start(fmt.Sprintf("%s '%s'", s.service, s.ep.Path))
+}
+
+// listenFirstError returns a channel receiving the first line of the error
+// output of a session. The channel is closed when there is no error output.
+func listenFirstError(r io.Reader) chan string {
+	errLine := make(chan string, 1)
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		if scanner.Scan() {
+			errLine <- scanner.Text()
+		} else {
+			close(errLine)
+		}
+
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	return errLine
+}
+
+// AdvertisedReferences retrieves the references advertised by the server.
+// go-git requests them with a context so this is only used without one.
+func (s *sshSession) AdvertisedReferences() (*packp.AdvRefs, error) {
+	return s.AdvertisedReferencesContext(context.Background())
+}
+
+// AdvertisedReferencesContext connects to the server and retrieves the
+// references it advertises.
+func (s *sshSession) AdvertisedReferencesContext(ctx context.Context) (*packp.AdvRefs, error) {
+	if s.advRefs != nil {
+		return s.advRefs, nil
+	}
+
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	ar := packp.NewAdvRefs()
+	if err := ar.Decode(s.stdoutContext(ctx)); err != nil {
+		if err := s.handleAdvRefDecodeError(ctx, err); err != nil {
+			return nil, err
+		}
+	}
+
+	// Some servers announce capabilities for empty repositories instead of
+	// only sending a flush.
+	if !s.isReceivePack && ar.IsEmpty() {
+		return nil, transport.ErrEmptyRemoteRepository
+	}
+
+	transport.FilterUnsupportedCapabilities(ar.Capabilities)
+	s.advRefs = ar
+
+	return ar, nil
+}
+
+func (s *sshSession) handleAdvRefDecodeError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, packp.ErrEmptyInput):
+		// The server reports a missing repository, or any other error, on
+		// the error output.
+		s.finished = true
+
+		if err := s.checkNotFoundError(ctx); err != nil {
+			return err
+		}
+
+		return io.ErrUnexpectedEOF
+	case errors.Is(err, packp.ErrEmptyAdvRefs):
+		// Empty repositories are valid for git-receive-pack.
+		if s.isReceivePack {
+			return nil
+		}
+
+		if err := s.finish(); err != nil {
+			return err
+		}
+
+		return transport.ErrEmptyRemoteRepository
+	}
+
+	return err
+}
+
+// checkNotFoundError returns the error reported by the server on the error
+// output.
+func (s *sshSession) checkNotFoundError(ctx context.Context) error {
+	timer := time.NewTimer(sshErrorTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("timeout exceeded waiting for the error of %s",
+			s.client.RemoteAddr())
+	case line, ok := <-s.firstErrLine:
+		if !ok {
+			return nil
+		}
+
+		if isSSHRepoNotFoundError(line) {
+			return transport.ErrRepositoryNotFound
+		}
+
+		return fmt.Errorf("unknown error: %s", line)
+	}
+}
+
+// isSSHRepoNotFoundError reports whether an error message of an SSH server
+// reports a missing repository.
+func isSSHRepoNotFoundError(line string) bool {
+	if strings.HasSuffix(line, "does not appear to be a git repository") {
+		return true
+	}
+
+	for _, prefix := range sshRepoNotFoundPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadPack requests a packfile from the server. The response needs to be
+// closed once read.
+func (s *sshSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	if req.IsEmpty() && len(req.Shallows) == 0 {
+		return nil, transport.ErrEmptyUploadPackRequest
+	}
+
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.AdvertisedReferencesContext(ctx); err != nil {
+		return nil, err
+	}
+
+	s.packRun = true
+
+	in := s.stdinContext(ctx)
+	out := s.stdoutContext(ctx)
+
+	if err := req.UploadRequest.Encode(in); err != nil {
+		return nil, fmt.Errorf("sending upload-req message: %w", err)
+	}
+
+	if err := req.UploadHaves.Encode(in, true); err != nil {
+		return nil, fmt.Errorf("sending haves message: %w", err)
+	}
+
+	if err := pktline.NewEncoder(in).Encodef("done\n"); err != nil {
+		return nil, fmt.Errorf("sending done message: %w", err)
+	}
+
+	if err := in.Close(); err != nil {
+		return nil, fmt.Errorf("closing input: %w", err)
+	}
+
+	r, err := ioutil.NonEmptyReader(out)
+	if errors.Is(err, ioutil.ErrEmptyReader) {
+		return nil, transport.ErrEmptyUploadPackRequest
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp := packp.NewUploadPackResponse(req)
+	if err := resp.Decode(ioutil.NewReadCloser(r, s)); err != nil {
+		return nil, fmt.Errorf("error decoding upload-pack response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// ReceivePack sends a reference update request, with its packfile, to the
+// server.
+func (s *sshSession) ReceivePack(ctx context.Context, req *packp.ReferenceUpdateRequest) (*packp.ReportStatus, error) {
+	if _, err := s.AdvertisedReferencesContext(ctx); err != nil {
+		return nil, err
+	}
+
+	s.packRun = true
+
+	in := s.stdinContext(ctx)
+	if err := req.Encode(in); err != nil {
+		return nil, err
+	}
+
+	if err := in.Close(); err != nil {
+		return nil, err
+	}
+
+	// Without report-status, only the exit status is checked.
+	if !req.Capabilities.Supports(capability.ReportStatus) {
+		return nil, s.session.Wait()
+	}
+
+	out := s.stdoutContext(ctx)
+
+	var demuxer *sideband.Demuxer
+
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		demuxer = sideband.NewDemuxer(sideband.Sideband64k, out)
+	case req.Capabilities.Supports(capability.Sideband):
+		demuxer = sideband.NewDemuxer(sideband.Sideband, out)
+	}
+
+	if demuxer != nil {
+		demuxer.Progress = req.Progress
+		out = demuxer
+	}
+
+	report := packp.NewReportStatus()
+	if err := report.Decode(out); err != nil {
+		return nil, err
+	}
+
+	if err := report.Error(); err != nil {
+		return report, err
+	}
+
+	return report, s.session.Wait()
+}
+
+func (s *sshSession) stdinContext(ctx context.Context) io.WriteCloser {
+	return ioutil.NewWriteCloserOnError(
+		ioutil.NewContextWriteCloser(ctx, s.stdin), s.onError)
+}
+
+func (s *sshSession) stdoutContext(ctx context.Context) io.Reader {
+	return ioutil.NewReaderOnError(ioutil.NewContextReader(ctx, s.stdout),
+		s.onError)
+}
+
+func (s *sshSession) onError(error) {
+	_ = s.Close()
+}
+
+// finish ends a session in which no packfile was requested by sending a
+// flush packet so that the server exits gracefully.
+func (s *sshSession) finish() error {
+	if s.finished {
+		return nil
+	}
+
+	s.finished = true
+
+	if !s.packRun {
+		_, err := s.stdin.Write(pktline.FlushPkt)
+
+		return err
+	}
+
+	return nil
+}
+
+// Close ends the session and closes the connection to the SSH server, if
+// connected.
+func (s *sshSession) Close() error {
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.finish()
+
+	_ = s.session.Close()
+
+	if closeErr := s.client.Close(); closeErr != nil &&
+		!errors.Is(closeErr, net.ErrClosed) && err == nil {
+		err = closeErr
+	}
+
+	return err
+}
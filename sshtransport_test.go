@@ -0,0 +1,373 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agherzan/git-mirror-me/internal/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testGitUser = "git"
+
+// newTestGitServer starts an SSH server running the git-upload-pack and
+// git-receive-pack commands on the local repositories. The server uses the
+// test SSH key as host key and only accepts it for the test git user. It
+// returns the address of the server, its known hosts line and a function
+// stopping it.
+func newTestGitServer(t *testing.T) (string, string, func()) {
+	t.Helper()
+
+	signer, err := gossh.ParsePrivateKey([]byte(testSSHKey))
+	if err != nil {
+		t.Fatalf("failed to parse the test SSH key: %s", err)
+	}
+
+	config := &gossh.ServerConfig{
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if conn.User() != testGitUser ||
+				!bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the git server: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+
+			go func(conn net.Conn) {
+				defer wg.Done()
+				serveTestGitServer(conn, config)
+			}(conn)
+		}
+	}()
+
+	addr := listener.Addr().String()
+
+	return addr, knownhosts.Line([]string{addr}, signer.PublicKey()), func() {
+		listener.Close()
+		wg.Wait()
+	}
+}
+
+// serveTestGitServer serves an SSH connection of the test git server.
+func serveTestGitServer(conn net.Conn, config *gossh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(gossh.UnknownChannelType, "unsupported channel")
+
+			continue
+		}
+
+		channel, chanReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+
+		go serveTestGitSession(channel, chanReqs)
+	}
+}
+
+// serveTestGitSession runs the git command of an SSH session.
+func serveTestGitSession(channel gossh.Channel, reqs <-chan *gossh.Request) {
+	defer channel.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+
+			return
+		}
+
+		service, path, _ := strings.Cut(payload.Command, " ")
+		if service != transport.UploadPackServiceName &&
+			service != transport.ReceivePackServiceName {
+			_ = req.Reply(false, nil)
+
+			return
+		}
+
+		_ = req.Reply(true, nil)
+
+		cmd := exec.Command("git", strings.TrimPrefix(service, "git-"),
+			strings.Trim(path, "'"))
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		// The command can exit without reading its input so the input is not
+		// waited for.
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			_, _ = io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+
+		status := struct{ Status uint32 }{}
+		if err := cmd.Run(); err != nil {
+			status.Status = 1
+		}
+
+		_, _ = channel.SendRequest("exit-status", false,
+			gossh.Marshal(&status))
+
+		return
+	}
+}
+
+// TestSSHTransport tests mirroring from and to repositories accessed over
+// SSH.
+func TestSSHTransport(t *testing.T) {
+	t.Parallel()
+
+	installTransports()
+
+	// No need for logs.
+	devnull, _ := os.Open(os.DevNull)
+	defer devnull.Close()
+	logger := NewLogger(devnull)
+
+	addr, knownHosts, stop := newTestGitServer(t)
+	defer stop()
+
+	srcRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-src-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary src repo: %s", err)
+	}
+
+	defer os.RemoveAll(srcRepoPath)
+
+	_, srcHead, err := utils.NewTestRepo(srcRepoPath, []string{
+		"refs/heads/a",
+		"refs/tags/v1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create a test src repo: %s", err)
+	}
+
+	dstRepoPath, err := ioutil.TempDir("/tmp", "git-mirror-me-test-dst-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary dst repo: %s", err)
+	}
+
+	defer os.RemoveAll(dstRepoPath)
+
+	dstRepo, err := utils.NewBareRepo(dstRepoPath)
+	if err != nil {
+		t.Fatalf("failed to create a test dst repo: %s", err)
+	}
+
+	sshConf := SSHConf{
+		PrivateKey: testSSHKey,
+		KnownHosts: knownHosts,
+	}
+
+	conf := Config{
+		SrcRepo:       fmt.Sprintf("ssh://%s@%s%s", testGitUser, addr, srcRepoPath),
+		DstRepos:      []string{fmt.Sprintf("ssh://%s@%s%s", testGitUser, addr, dstRepoPath)},
+		SSHConfigPath: sshConfigNone,
+		SSH:           sshConf,
+		SrcSSH:        sshConf,
+	}
+
+	{
+		result, err := Mirror(conf, logger)
+		if err != nil {
+			t.Fatalf("Mirror failed: %s", err)
+		}
+
+		if result.Fetched.Objects == 0 ||
+			result.Dsts[0].Pushed.Objects != result.Fetched.Objects {
+			t.Fatalf("unexpected transfers: %+v, %+v", result.Fetched,
+				result.Dsts[0].Pushed)
+		}
+
+		dstRepoRefs, err := utils.RepoRefsSlice(dstRepo)
+		if err != nil {
+			t.Fatalf("failed to get the dst repo refs: %s", err)
+		}
+
+		if !utils.SlicesAreEqual(dstRepoRefs, []string{
+			"HEAD",
+			"refs/heads/master",
+			"refs/heads/a",
+			"refs/tags/v1",
+		}) {
+			t.Fatalf("unexpected refs in the dst repo: %s", dstRepoRefs)
+		}
+
+		ok, err := utils.RepoRefsCheckHash(dstRepo, srcHead, "refs/")
+		if err != nil {
+			t.Fatalf("dst repo hash check failed: %s", err)
+		}
+
+		if !ok {
+			t.Fatal("unexpected hash test result for the dst repo")
+		}
+
+		// The destination is in sync.
+		result, err = Mirror(conf, logger)
+		if err != nil {
+			t.Fatalf("Mirror failed: %s", err)
+		}
+
+		if counts := result.Counts(); counts[RefUnchanged] != 3 {
+			t.Fatalf("unexpected counts: %v", counts)
+		}
+	}
+	{
+		// Missing repository.
+		repo := fmt.Sprintf("ssh://%s@%s%s/missing", testGitUser, addr,
+			dstRepoPath)
+
+		repoURL, auth, cleanup, err := newAuth(context.Background(), conf, logger, repo)
+		if err != nil {
+			t.Fatalf("failed to set up SSH authentication: %s", err)
+		}
+		defer cleanup()
+
+		remote := git.NewRemote(nil, &config.RemoteConfig{
+			Name: dstRemoteName,
+			URLs: []string{repoURL},
+		})
+
+		_, err = listRemote(context.Background(), remote, auth)
+		if !errors.Is(err, transport.ErrRepositoryNotFound) {
+			t.Fatalf("unexpected missing repository error: %v", err)
+		}
+	}
+	{
+		// Unknown host key.
+		unknownConf := conf
+		unknownConf.SSH.KnownHosts = testKnownHost
+
+		result, err := Mirror(unknownConf, logger)
+		if err == nil {
+			t.Fatal("unknown host key was accepted")
+		}
+
+		if kind := ClassifyError(result.Dsts[0].Err); kind != ErrorHostKey {
+			t.Fatalf("unexpected error kind: %s: %s", kind, result.Dsts[0].Err)
+		}
+	}
+}
+
+// TestConnectSSHCancel tests cancelling the connection to an unresponsive
+// SSH server.
+func TestConnectSSHCancel(t *testing.T) {
+	t.Parallel()
+
+	// The server accepts the connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the SSH server: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	ep, err := transport.NewEndpoint(fmt.Sprintf("ssh://%s@%s/repo.git",
+		testGitUser, listener.Addr()))
+	if err != nil {
+		t.Fatalf("failed to parse the endpoint: %s", err)
+	}
+
+	auth, err := ssh.NewPublicKeys(testGitUser, []byte(testSSHKey), "")
+	if err != nil {
+		t.Fatalf("failed to set up SSH authentication: %s", err)
+	}
+
+	auth.HostKeyCallback = gossh.InsecureIgnoreHostKey()
+
+	session, err := sshTransport{}.NewUploadPackSession(ep, auth)
+	if err != nil {
+		t.Fatalf("failed to create the SSH session: %s", err)
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+
+	_, err = session.AdvertisedReferencesContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error of a cancelled connection: %v", err)
+	}
+
+	if time.Since(start) > defaultSSHConnectTimeout/2 {
+		t.Fatal("cancelled connection waited for the connect timeout")
+	}
+}
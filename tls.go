@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// isZero returns true if no TLS option is configured.
+func (tlsConf TLSConf) isZero() bool {
+	return tlsConf == TLSConf{}
+}
+
+// validate checks that the TLS files are readable and valid and that the
+// client certificate matches the client key. Skipping the TLS verification is
+// loudly warned about.
+func (tlsConf TLSConf) validate(logger *Logger) error {
+	if len(tlsConf.CABundlePath) != 0 {
+		logger.Info("CA bundle:", tlsConf.CABundlePath, ".")
+	}
+
+	if len(tlsConf.ClientCertPath) != 0 {
+		logger.Info("TLS client certificate:", tlsConf.ClientCertPath, ".")
+	}
+
+	if tlsConf.InsecureSkipVerify {
+		logger.Warn("TLS verification is disabled: the identity of the " +
+			"HTTPS repositories is NOT checked and the connections are " +
+			"open to man-in-the-middle attacks. Only use this for testing.")
+	}
+
+	_, err := newTLSConfig(tlsConf)
+
+	return err
+}
+
+// newTLSConfig returns the TLS client configuration set up from a TLS
+// configuration. Without any TLS option, it returns nil so that the default
+// configuration is used.
+func newTLSConfig(tlsConf TLSConf) (*tls.Config, error) {
+	if tlsConf.isZero() {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// This is explicitly requested and loudly warned about.
+		InsecureSkipVerify: tlsConf.InsecureSkipVerify,
+	}
+
+	if len(tlsConf.CABundlePath) != 0 {
+		bundle, err := os.ReadFile(tlsConf.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read the CA bundle: %s",
+				ErrTLS, err.Error())
+		}
+
+		// The CA bundle extends the system certificates.
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("%w: no certificate found in the CA "+
+				"bundle %s", ErrTLS, tlsConf.CABundlePath)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if len(tlsConf.ClientCertPath) != 0 || len(tlsConf.ClientKeyPath) != 0 {
+		if len(tlsConf.ClientCertPath) == 0 || len(tlsConf.ClientKeyPath) == 0 {
+			return nil, fmt.Errorf("%w: the TLS client certificate and key "+
+				"need to be provided together", ErrTLS)
+		}
+
+		cert, err := tls.LoadX509KeyPair(tlsConf.ClientCertPath,
+			tlsConf.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to load the TLS client "+
+				"certificate: %s", ErrTLS, err.Error())
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
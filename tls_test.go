@@ -0,0 +1,326 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// testCert structure holds a test certificate with its key.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate signed by a parent certificate or a
+// self-signed one when the parent is nil.
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %s", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create a certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse a certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal a key: %s", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newTestPKI generates a CA with a server certificate for 127.0.0.1 and a
+// client certificate.
+func newTestPKI(t *testing.T) (*testCert, *testCert, *testCert) {
+	t.Helper()
+
+	ca := newTestCert(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	server := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	client := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return ca, server, client
+}
+
+// writeTestFile writes a test file in a directory and returns its path.
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+
+	filePath := path.Join(dir, name)
+	if err := os.WriteFile(filePath, content, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+
+	return filePath
+}
+
+// TestNewTLSConfig tests setting up the TLS client configuration.
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _, client := newTestPKI(t)
+	_, _, otherClient := newTestPKI(t)
+
+	caPath := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	certPath := writeTestFile(t, dir, "client.pem", client.certPEM)
+	keyPath := writeTestFile(t, dir, "client.key", client.keyPEM)
+	otherKeyPath := writeTestFile(t, dir, "other.key", otherClient.keyPEM)
+
+	{
+		// No TLS configuration.
+		config, err := newTLSConfig(TLSConf{})
+		if err != nil || config != nil {
+			t.Fatalf("unexpected TLS configuration: %v, %v", config, err)
+		}
+	}
+	{
+		config, err := newTLSConfig(TLSConf{
+			CABundlePath:   caPath,
+			ClientCertPath: certPath,
+			ClientKeyPath:  keyPath,
+		})
+		if err != nil {
+			t.Fatalf("failed to set up the TLS configuration: %s", err)
+		}
+
+		if config.RootCAs == nil || len(config.Certificates) != 1 ||
+			config.InsecureSkipVerify {
+			t.Fatal("unexpected TLS configuration")
+		}
+	}
+	{
+		config, err := newTLSConfig(TLSConf{InsecureSkipVerify: true})
+		if err != nil || !config.InsecureSkipVerify {
+			t.Fatalf("unexpected insecure TLS configuration: %v", err)
+		}
+	}
+
+	for _, tlsConf := range []TLSConf{
+		// Missing CA bundle.
+		{CABundlePath: path.Join(dir, "missing.pem")},
+		// CA bundle without certificates.
+		{CABundlePath: keyPath},
+		// Client certificate without key.
+		{ClientCertPath: certPath},
+		// Client key without certificate.
+		{ClientKeyPath: keyPath},
+		// Client certificate not matching the key.
+		{ClientCertPath: certPath, ClientKeyPath: otherKeyPath},
+	} {
+		if _, err := newTLSConfig(tlsConf); !errors.Is(err, ErrTLS) {
+			t.Fatalf("invalid TLS configuration was allowed: %+v", tlsConf)
+		}
+	}
+}
+
+// TestHTTPTLS tests reaching an HTTPS repository with a custom CA and mutual
+// TLS.
+func TestHTTPTLS(t *testing.T) {
+	t.Parallel()
+
+	installTransports()
+
+	dir, err := ioutil.TempDir("/tmp", "git-mirror-me-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, server, client := newTestPKI(t)
+
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusNotFound)
+		}))
+
+	serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load the server certificate: %s", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	// Silence the TLS handshake errors logged by the server.
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	srv.StartTLS()
+	defer srv.Close()
+
+	tlsConf := TLSConf{
+		CABundlePath:   writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		ClientCertPath: writeTestFile(t, dir, "client.pem", client.certPEM),
+		ClientKeyPath:  writeTestFile(t, dir, "client.key", client.keyPEM),
+	}
+
+	list := func(tlsConf TLSConf) int {
+		remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: dstRemoteName,
+			URLs: []string{srv.URL + "/team/repo.git"},
+		})
+
+		ctx, closeRemote, err := remoteContext(context.Background(),
+			Config{TLS: tlsConf})
+		if err != nil {
+			t.Fatalf("failed to set up the TLS configuration: %s", err)
+		}
+		defer closeRemote()
+
+		if _, err := remote.ListContext(ctx, &git.ListOptions{}); err == nil {
+			t.Fatal("listing the test server succeeded")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		return requests
+	}
+
+	// The server is not trusted without the CA bundle.
+	if list(TLSConf{ClientCertPath: tlsConf.ClientCertPath,
+		ClientKeyPath: tlsConf.ClientKeyPath}) != 0 {
+		t.Fatal("untrusted server was reached")
+	}
+
+	// The server requires a client certificate.
+	if list(TLSConf{CABundlePath: tlsConf.CABundlePath}) != 0 {
+		t.Fatal("server was reached without a client certificate")
+	}
+
+	if list(tlsConf) != 1 {
+		t.Fatal("server was not reached with the TLS configuration")
+	}
+
+	// Skipping the verification doesn't need the CA bundle.
+	insecureConf := tlsConf
+	insecureConf.CABundlePath = ""
+	insecureConf.InsecureSkipVerify = true
+
+	if list(insecureConf) != 2 {
+		t.Fatal("server was not reached skipping the TLS verification")
+	}
+
+	// The TLS files are read again so a renewed CA bundle is used.
+	otherCA, _, _ := newTestPKI(t)
+	writeTestFile(t, dir, "ca.pem", otherCA.certPEM)
+
+	if list(tlsConf) != 2 {
+		t.Fatal("server was reached with a stale CA bundle")
+	}
+
+	writeTestFile(t, dir, "ca.pem", ca.certPEM)
+
+	if list(tlsConf) != 3 {
+		t.Fatal("server was not reached with the renewed CA bundle")
+	}
+}
+
+// TestTLSConfValidateInsecure tests warning about skipping the TLS
+// verification.
+func TestTLSConfValidateInsecure(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+
+	logger := NewLogger(&out)
+
+	if err := (TLSConf{}).validate(logger); err != nil ||
+		strings.Contains(out.String(), "[WARN ]") {
+		t.Fatalf("unexpected TLS validation: %s, %v", out.String(), err)
+	}
+
+	if err := (TLSConf{InsecureSkipVerify: true}).validate(logger); err != nil ||
+		!strings.Contains(out.String(), "[WARN ]: TLS verification is disabled") {
+		t.Fatalf("skipping the TLS verification was not warned about: %s, %v",
+			out.String(), err)
+	}
+}
@@ -0,0 +1,279 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// The size of a packfile header: the signature, the version and the number
+// of objects.
+const packHeaderSize = 12
+
+// The sideband channel carrying the packfile.
+const sidebandPackData = 1
+
+// transferKey is the context key holding the counter of the packfiles
+// transferred with the remote repositories.
+type transferKey struct{}
+
+// transferCounter counts the packfiles transferred with the remote
+// repositories.
+type transferCounter struct {
+	objects int64
+	bytes   int64
+}
+
+// withTransferCounter returns a context counting the packfiles transferred
+// by the remote operations.
+func withTransferCounter(ctx context.Context, counter *transferCounter) context.Context {
+	return context.WithValue(ctx, transferKey{}, counter)
+}
+
+// contextTransferCounter returns the transfer counter of a context or nil
+// when the transfers are not counted.
+func contextTransferCounter(ctx context.Context) *transferCounter {
+	counter, _ := ctx.Value(transferKey{}).(*transferCounter)
+
+	return counter
+}
+
+// transfer returns the counted transfer.
+func (c *transferCounter) transfer() Transfer {
+	return Transfer{
+		Objects: atomic.LoadInt64(&c.objects),
+		Bytes:   atomic.LoadInt64(&c.bytes),
+	}
+}
+
+// add adds a counted transfer.
+func (c *transferCounter) add(transfer Transfer) {
+	atomic.AddInt64(&c.objects, transfer.Objects)
+	atomic.AddInt64(&c.bytes, transfer.Bytes)
+}
+
+// countAttempt runs an attempt of a remote operation counting its transfers
+// apart. They are added to the transfer counter of the context, if any, only
+// when the attempt succeeds so that the retried operations are counted once.
+func countAttempt(ctx context.Context, op func(context.Context) error) error {
+	counter := contextTransferCounter(ctx)
+	if counter == nil {
+		return op(ctx)
+	}
+
+	var attempt transferCounter
+
+	err := op(withTransferCounter(ctx, &attempt))
+	if err == nil {
+		counter.add(attempt.transfer())
+	}
+
+	return err
+}
+
+// packHeader reads the number of objects from the header of a packfile
+// stream.
+type packHeader struct {
+	counter *transferCounter
+	header  []byte
+}
+
+func (h *packHeader) write(p []byte) {
+	if len(h.header) == packHeaderSize {
+		return
+	}
+
+	n := packHeaderSize - len(h.header)
+	if n > len(p) {
+		n = len(p)
+	}
+
+	h.header = append(h.header, p[:n]...)
+
+	if len(h.header) == packHeaderSize && bytes.HasPrefix(h.header, []byte("PACK")) {
+		atomic.AddInt64(&h.counter.objects,
+			int64(binary.BigEndian.Uint32(h.header[8:])))
+	}
+}
+
+// sidebandStream passes the packfile multiplexed in a sideband stream to a
+// packfile header reader. The stream is made of pkt-lines: a 4 hex digits
+// length, including itself, followed by the channel and the data.
+type sidebandStream struct {
+	pack *packHeader
+	// length is the length of the current pkt-line being read.
+	length []byte
+	// remaining is the data left to read in the current pkt-line.
+	remaining int
+	channel   byte
+}
+
+func (s *sidebandStream) write(p []byte) {
+	for len(p) > 0 {
+		if s.remaining == 0 {
+			n := 4 - len(s.length)
+			if n > len(p) {
+				n = len(p)
+			}
+
+			s.length = append(s.length, p[:n]...)
+			p = p[n:]
+
+			if len(s.length) < 4 {
+				return
+			}
+
+			length, err := strconv.ParseUint(string(s.length), 16, 16)
+			s.length = s.length[:0]
+			s.channel = 0
+
+			// Flush and empty pkt-lines carry no data.
+			if err == nil && length > 4 {
+				s.remaining = int(length) - 4
+			}
+
+			continue
+		}
+
+		if s.channel == 0 {
+			s.channel = p[0]
+			p = p[1:]
+			s.remaining--
+
+			continue
+		}
+
+		n := s.remaining
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if s.channel == sidebandPackData {
+			s.pack.write(p[:n])
+		}
+
+		p = p[n:]
+		s.remaining -= n
+	}
+}
+
+// countingReader counts the bytes of a packfile stream and passes them to be
+// parsed.
+type countingReader struct {
+	io.ReadCloser
+	counter *transferCounter
+	write   func([]byte)
+}
+
+// newCountingReader returns a reader counting the packfile read from r,
+// optionally multiplexed in a sideband stream.
+func newCountingReader(r io.ReadCloser, counter *transferCounter, sideband bool) *countingReader {
+	pack := &packHeader{counter: counter}
+	write := pack.write
+
+	if sideband {
+		write = (&sidebandStream{pack: pack}).write
+	}
+
+	return &countingReader{
+		ReadCloser: r,
+		counter:    counter,
+		write:      write,
+	}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	atomic.AddInt64(&r.counter.bytes, int64(n))
+	r.write(p[:n])
+
+	return n, err
+}
+
+// countingTransport counts the packfiles fetched and pushed by the sessions
+// of a transport when their context carries a transfer counter. The fetch
+// sessions also record the references advertised by the remote when their
+// context asks for them.
+type countingTransport struct {
+	transport.Transport
+}
+
+func (t countingTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.Transport.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingUploadPackSession{session}, nil
+}
+
+func (t countingTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	session, err := t.Transport.NewReceivePackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingReceivePackSession{session}, nil
+}
+
+type countingUploadPackSession struct {
+	transport.UploadPackSession
+}
+
+// AdvertisedReferencesContext records the references advertised to the
+// fetch.
+func (s countingUploadPackSession) AdvertisedReferencesContext(ctx context.Context) (*packp.AdvRefs, error) {
+	ar, err := s.UploadPackSession.AdvertisedReferencesContext(ctx)
+
+	if recorder := contextAdvertisedRefs(ctx); err == nil && recorder != nil {
+		recorder.record(ar)
+	}
+
+	return ar, err
+}
+
+// UploadPack counts the fetched packfile. The response packfile is
+// multiplexed in a sideband stream when requested.
+func (s countingUploadPackSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	resp, err := s.UploadPackSession.UploadPack(ctx, req)
+
+	counter := contextTransferCounter(ctx)
+	if err != nil || counter == nil {
+		return resp, err
+	}
+
+	sideband := req.Capabilities.Supports(capability.Sideband) ||
+		req.Capabilities.Supports(capability.Sideband64k)
+
+	counted := packp.NewUploadPackResponseWithPackfile(req,
+		newCountingReader(resp, counter, sideband))
+	counted.ShallowUpdate = resp.ShallowUpdate
+	counted.ServerResponse = resp.ServerResponse
+
+	return counted, nil
+}
+
+type countingReceivePackSession struct {
+	transport.ReceivePackSession
+}
+
+// ReceivePack counts the pushed packfile.
+func (s countingReceivePackSession) ReceivePack(ctx context.Context, req *packp.ReferenceUpdateRequest) (*packp.ReportStatus, error) {
+	if counter := contextTransferCounter(ctx); counter != nil && req.Packfile != nil {
+		req.Packfile = newCountingReader(req.Packfile, counter, false)
+	}
+
+	return s.ReceivePackSession.ReceivePack(ctx, req)
+}
@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testPackfile returns a packfile header for a number of objects followed by
+// some data.
+func testPackfile(objects int) []byte {
+	return append([]byte{'P', 'A', 'C', 'K', 0, 0, 0, 2, 0, 0, 0, byte(objects)},
+		[]byte("objects")...)
+}
+
+// testSideband multiplexes a packfile in a sideband stream, with progress
+// messages, in pkt-lines of the provided maximum data size.
+func testSideband(pack []byte, size int) []byte {
+	var stream bytes.Buffer
+
+	fmt.Fprintf(&stream, "%04x\x02%s", 5+len("progress"), "progress")
+
+	for len(pack) > 0 {
+		n := size
+		if n > len(pack) {
+			n = len(pack)
+		}
+
+		fmt.Fprintf(&stream, "%04x\x01%s", 5+n, pack[:n])
+		pack = pack[n:]
+	}
+
+	stream.WriteString("0000")
+
+	return stream.Bytes()
+}
+
+// oneByteReader reads one byte at a time.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return r.r.Read(p[:1])
+}
+
+// TestCountingReader tests counting the packfile streams.
+func TestCountingReader(t *testing.T) {
+	t.Parallel()
+
+	pack := testPackfile(42)
+
+	for _, test := range []struct {
+		name     string
+		stream   []byte
+		sideband bool
+		objects  int64
+	}{
+		{"packfile", pack, false, 42},
+		{"sideband", testSideband(pack, 1000), true, 42},
+		{"split sideband", testSideband(pack, 5), true, 42},
+		{"not a packfile", []byte("not a packfile"), false, 0},
+		{"short packfile", pack[:8], false, 0},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader(test.stream)
+			if oneByte {
+				r = oneByteReader{r}
+			}
+
+			var counter transferCounter
+
+			read, err := ioutil.ReadAll(newCountingReader(ioutil.NopCloser(r),
+				&counter, test.sideband))
+			if err != nil {
+				t.Fatalf("%s: failed to read: %s", test.name, err)
+			}
+
+			if !bytes.Equal(read, test.stream) {
+				t.Fatalf("%s: the stream was altered", test.name)
+			}
+
+			transfer := counter.transfer()
+			if transfer.Objects != test.objects ||
+				transfer.Bytes != int64(len(test.stream)) {
+				t.Fatalf("%s: unexpected transfer: %+v", test.name, transfer)
+			}
+		}
+	}
+}
+
+// TestTransferCounterContext tests the transfer counters carried by the
+// contexts.
+func TestTransferCounterContext(t *testing.T) {
+	t.Parallel()
+
+	if contextTransferCounter(context.Background()) != nil {
+		t.Fatal("unexpected transfer counter")
+	}
+
+	var counter transferCounter
+
+	ctx := withTransferCounter(context.Background(), &counter)
+	if contextTransferCounter(ctx) != &counter {
+		t.Fatal("transfer counter not found")
+	}
+}
+
+// TestCountAttempt tests counting the transfers of the successful attempts
+// only.
+func TestCountAttempt(t *testing.T) {
+	t.Parallel()
+
+	var counter transferCounter
+
+	ctx := withTransferCounter(context.Background(), &counter)
+
+	attempt := func(fail bool) func(context.Context) error {
+		return func(ctx context.Context) error {
+			contextTransferCounter(ctx).add(Transfer{Objects: 1, Bytes: 10})
+
+			if fail {
+				return io.ErrUnexpectedEOF
+			}
+
+			return nil
+		}
+	}
+
+	if err := countAttempt(ctx, attempt(true)); err == nil {
+		t.Fatal("failed attempt succeeded")
+	}
+
+	if err := countAttempt(ctx, attempt(false)); err != nil {
+		t.Fatalf("attempt failed: %s", err)
+	}
+
+	if transfer := counter.transfer(); transfer != (Transfer{
+		Objects: 1,
+		Bytes:   10,
+	}) {
+		t.Fatalf("unexpected transfer: %+v", transfer)
+	}
+
+	// Without a counter, the attempts are not counted.
+	if err := countAttempt(context.Background(), func(ctx context.Context) error {
+		if contextTransferCounter(ctx) != nil {
+			t.Fatal("unexpected transfer counter")
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("attempt failed: %s", err)
+	}
+}
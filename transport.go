@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+	"github.com/go-git/go-git/v5/plumbing/transport/git"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// remoteConfKey is the context key holding the configuration of the requests
+// to the HTTP(S) repositories.
+type remoteConfKey struct{}
+
+// remoteConf structure holds the configuration of the requests to the HTTP(S)
+// repositories: the proxy configuration and the transport set up with the TLS
+// configuration of a mirroring run.
+type remoteConf struct {
+	proxy     ProxyConf
+	transport *http.Transport
+}
+
+// installOnce guards the installation of the transports.
+var installOnce sync.Once
+
+// installTransports installs the transports of the remote repositories set
+// up by the package, all of them counting the transferred packfiles. As
+// go-git has no per-remote transports, they replace the go-git ones for the
+// whole process (see Mirror). It is called when mirroring rather than on
+// import so that importing the package leaves the go-git transports
+// untouched.
+func installTransports() {
+	installOnce.Do(func() {
+		httpClient := countingTransport{
+			githttp.NewClient(&http.Client{Transport: remoteRoundTripper{}}),
+		}
+		client.InstallProtocol("http", httpClient)
+		client.InstallProtocol("https", httpClient)
+		client.InstallProtocol("ssh", countingTransport{sshTransport{}})
+		client.InstallProtocol("file", countingTransport{file.DefaultClient})
+		client.InstallProtocol("git", countingTransport{git.DefaultClient})
+	})
+}
+
+// remoteContext returns the context of the remote operations carrying the
+// proxy configuration and a transport set up with the TLS configuration. The
+// TLS files are read every time so that they can be renewed between the
+// mirroring runs. The remote operations are cancelled with the parent
+// context. The returned function closes the idle connections of the
+// transport and needs to be called once the remote operations are done.
+func remoteContext(ctx context.Context, conf Config) (context.Context, func(), error) {
+	transport, err := newHTTPTransport(conf.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = context.WithValue(ctx, remoteConfKey{},
+		remoteConf{proxy: conf.Proxy, transport: transport})
+
+	return ctx, transport.CloseIdleConnections, nil
+}
+
+// requestRemoteConf returns the configuration of a request to an HTTP(S)
+// repository. Requests without one use the default configuration.
+func requestRemoteConf(req *http.Request) remoteConf {
+	rc, _ := req.Context().Value(remoteConfKey{}).(remoteConf)
+
+	return rc
+}
+
+// newHTTPTransport returns the transport of the requests to the HTTP(S)
+// repositories and to the hosting services APIs set up with a TLS
+// configuration. The proxy is selected per request.
+func newHTTPTransport(tlsConf TLSConf) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport *http.Transport
+
+	if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = defaultTransport.Clone()
+	} else {
+		transport = &http.Transport{}
+	}
+
+	transport.Proxy = requestProxy
+
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// remoteRoundTripper sends the requests to the HTTP(S) repositories with the
+// transport of their context so that concurrent mirrors can use different
+// proxy and TLS configurations. Requests without one use the default
+// transport.
+type remoteRoundTripper struct{}
+
+func (remoteRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport := requestRemoteConf(req).transport; transport != nil {
+		return transport.RoundTrip(req)
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
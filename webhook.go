@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: Andrei Gherzan <andrei@gherzan.com>
+//
+// SPDX-License-Identifier: MIT
+
+package mirror
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// The maximum size of a webhook payload, like for GitHub.
+const webhookMaxBody = 25 << 20
+
+// The webhook providers.
+const (
+	webhookGitHub = "GitHub"
+	webhookGitLab = "GitLab"
+	webhookGitea  = "Gitea"
+)
+
+// webhookPayload structure is the part of the push webhook payloads used to
+// find the pushed repository. GitHub and Gitea provide the repository while
+// GitLab provides the project.
+type webhookPayload struct {
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// repoKeys returns the keys of the URLs of the pushed repository.
+func (p webhookPayload) repoKeys() map[string]bool {
+	keys := make(map[string]bool)
+
+	for _, repo := range []string{
+		p.Repository.CloneURL, p.Repository.SSHURL, p.Repository.HTMLURL,
+		p.Project.GitHTTPURL, p.Project.GitSSHURL, p.Project.WebURL,
+	} {
+		if key := repoKey(repo); len(key) != 0 {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// repoKey returns the key identifying a repository regardless of the URL
+// used to access it: its lower case host and path, without the user, the
+// port and the '.git' suffix. It returns an empty string for invalid URLs.
+func repoKey(repo string) string {
+	if len(repo) == 0 {
+		return ""
+	}
+
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return ""
+	}
+
+	path := strings.Trim(endpoint.Path, "/")
+	path = strings.TrimSuffix(path, ".git")
+
+	return strings.ToLower(endpoint.Host + "/" + path)
+}
+
+// webhookEvent returns the provider and the event of a webhook. Gitea is
+// checked first as it also provides the GitHub headers.
+func webhookEvent(header http.Header) (string, string) {
+	switch {
+	case len(header.Get("X-Gitea-Event")) != 0:
+		return webhookGitea, header.Get("X-Gitea-Event")
+	case len(header.Get("X-Gitlab-Event")) != 0:
+		return webhookGitLab, header.Get("X-Gitlab-Event")
+	case len(header.Get("X-GitHub-Event")) != 0:
+		return webhookGitHub, header.Get("X-GitHub-Event")
+	}
+
+	return "", ""
+}
+
+// isPushEvent returns true if the event of a provider is a push event.
+func isPushEvent(provider, event string) bool {
+	switch provider {
+	case webhookGitLab:
+		return event == "Push Hook" || event == "Tag Push Hook"
+	default:
+		return event == "push"
+	}
+}
+
+// verifyHMAC returns true if the hex encoded signature is the HMAC-SHA256 of
+// the body.
+func verifyHMAC(signature string, body []byte, secret string) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
+// verifyWebhook returns true if a webhook is authenticated by the secret:
+// GitHub and Gitea sign the payload with HMAC-SHA256 while GitLab provides the
+// secret as a token.
+func verifyWebhook(provider string, header http.Header, body []byte, secret string) bool {
+	switch provider {
+	case webhookGitHub:
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return false
+		}
+
+		return verifyHMAC(strings.TrimPrefix(signature, "sha256="), body,
+			secret)
+	case webhookGitea:
+		return verifyHMAC(header.Get("X-Gitea-Signature"), body, secret)
+	case webhookGitLab:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")),
+			[]byte(secret)) == 1
+	}
+
+	return false
+}
+
+// handleWebhook handles the push webhooks by queuing a run of the jobs
+// mirroring the pushed repository.
+func (d *Daemon) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	provider, event := webhookEvent(r.Header)
+	if len(provider) == 0 {
+		http.Error(w, "unsupported webhook", http.StatusBadRequest)
+
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+	if err != nil {
+		http.Error(w, "failed to read the payload", http.StatusBadRequest)
+
+		return
+	}
+
+	if !verifyWebhook(provider, r.Header, body, d.conf.WebhookSecret) {
+		d.logger.Warn("Rejected a", provider, "webhook with an invalid "+
+			"signature or token.")
+		http.Error(w, "invalid signature or token", http.StatusUnauthorized)
+
+		return
+	}
+
+	if !isPushEvent(provider, event) {
+		fmt.Fprintln(w, "ignored event")
+
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+
+		return
+	}
+
+	keys := payload.repoKeys()
+
+	var names []string
+
+	for _, dj := range d.jobs {
+		if keys[dj.repoKey] {
+			d.debounce(dj)
+			names = append(names, dj.job.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		d.logger.Info("No job mirrors the repository of a", provider,
+			"push.")
+		fmt.Fprintln(w, "no matching job")
+
+		return
+	}
+
+	d.logger.Info("Queuing the", strings.Join(names, ", "), "jobs on a",
+		provider, "push.")
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "queued", strings.Join(names, ", "))
+}
+
+// debounce queues a run of a job after the webhook debounce delay. The
+// webhooks received in the meantime don't queue another run.
+func (d *Daemon) debounce(dj *daemonJob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped || dj.debouncing {
+		return
+	}
+
+	dj.debouncing = true
+
+	time.AfterFunc(d.conf.WebhookDebounce, func() {
+		d.mu.Lock()
+		dj.debouncing = false
+		d.mu.Unlock()
+
+		d.enqueue(dj)
+	})
+}